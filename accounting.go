@@ -2,16 +2,17 @@ package main
 
 import (
 	"fmt"
-	"net"
 	"os"
+	"time"
 
 	"gopkg.in/ini.v1"
+	"layeh.com/radius/rfc2866"
 )
 
 type Accounting struct {
-	Enabled          bool   // Enable/Disable Radius Accounting
-	ServerIP         net.IP // Radius Accounting server IP
-	Secret           string // Radius Accounting secret
+	Enabled          bool          // Enable/Disable Radius Accounting
+	Servers          RadiusServers // Radius Accounting servers
+	Secret           string        // Radius Accounting secret, the default of the servers
 	UserName         string
 	AcctSessionId    string
 	CallingStationId string
@@ -22,6 +23,13 @@ type Accounting struct {
 	NASIdentifier    string
 	NASPortId        string
 	NASIPAddress     string
+	InterimInterval  time.Duration          // Interval between Interim-Update requests
+	InputRate        int64                  // Simulated download rate, in bytes per second
+	OutputRate       int64                  // Simulated upload rate, in bytes per second
+	PacketSize       int                    // Average packet size, used to count packets
+	TerminateCause   string                 // Acct-Terminate-Cause sent in the Stop request
+	StatusType       rfc2866.AcctStatusType // Acct-Status-Type of the first request of the session
+	Attributes       RadiusAttributes       // Dictionary attributes of the section
 }
 
 func (a *Accounting) ReadRadiusAccountingConfig(config *Config) {
@@ -49,12 +57,16 @@ func (a *Accounting) ReadRadiusAccountingConfig(config *Config) {
 		a.Enabled = false
 	}
 
-	server := cfg.Section("accounting").Key("server").String()
-	a.ServerIP = net.ParseIP(server)
-
 	secret := cfg.Section("accounting").Key("secret").String()
 	a.Secret = secret
 
+	server := cfg.Section("accounting").Key("server").String()
+	a.Servers.DeadTime = defaultRadiusDeadTime
+	a.Servers.Servers, err = parseRadiusServerList(server, RadiusServer{Secret: secret, Timeout: defaultRadiusTimeout, Retries: defaultRadiusRetries}, radiusAcctPort)
+	if err != nil {
+		fmt.Printf("Invalid accounting server: %v\n", err)
+	}
+
 	username := cfg.Section("accounting").Key("User-Name").String()
 	a.UserName = username
 
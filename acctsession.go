@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+// AccountingSession reports the sessions of a device to the accounting
+// server: Start once authenticated, Interim-Update while it is online
+// and Stop when it leaves or is disconnected. A first session configured
+// with another Acct-Status-Type begins with that request instead of Start.
+type AccountingSession struct {
+	cfg      *Accounting
+	waitAuth bool
+	wireless *Wireless // AP of a wireless device, nil for a wired one
+
+	mu        sync.Mutex // Guards sessionID, read by the CoA server, and address
+	sessionID string
+	address   net.IP                // Leased address, the Framed-IP-Address unless configured
+	onChange  func(old, new string) // Told every sessionID change, under mu
+	started   time.Time
+	sessions  int
+
+	// Traffic counters, in octets and packets since the session start
+	inOctets, outOctets   uint64
+	inPackets, outPackets uint64
+
+	authenticated chan struct{}
+	disconnect    chan string
+	roam          chan chan struct{} // Closed once the device moved
+	stop          chan string
+	done          chan struct{}
+}
+
+// NewAccountingSession creates the accounting session of a device. When
+// waitAuth is set a session starts on each Authenticated call, otherwise
+// at once and again after every disconnection.
+func NewAccountingSession(cfg *Accounting, waitAuth bool) *AccountingSession {
+	s := &AccountingSession{
+		cfg:           cfg,
+		waitAuth:      waitAuth,
+		authenticated: make(chan struct{}, 1),
+		disconnect:    make(chan string),
+		roam:          make(chan chan struct{}),
+		stop:          make(chan string),
+		done:          make(chan struct{}),
+	}
+	if !waitAuth {
+		s.Authenticated()
+	}
+	return s
+}
+
+// Authenticated starts a session, if none is running
+func (s *AccountingSession) Authenticated() {
+	select {
+	case s.authenticated <- struct{}{}:
+	default:
+	}
+}
+
+// SessionID returns the Acct-Session-Id of the running session, or an
+// empty string
+func (s *AccountingSession) SessionID() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessionID
+}
+
+// watch calls f with every change of the Acct-Session-Id, starting with
+// the running session if any. f is called with the session locked.
+func (s *AccountingSession) watch(f func(old, new string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = f
+	if s.sessionID != "" {
+		f("", s.sessionID)
+	}
+}
+
+// setSessionID changes the Acct-Session-Id, empty between sessions
+func (s *AccountingSession) setSessionID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.onChange != nil {
+		s.onChange(s.sessionID, id)
+	}
+	s.sessionID = id
+}
+
+// SetAddress reports the address leased to the device in the following
+// requests, as Framed-IP-Address unless one is configured
+func (s *AccountingSession) SetAddress(addr net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.address = addr
+}
+
+// Disconnect ends the running session, if any, with an Accounting-Stop
+// carrying the given Acct-Terminate-Cause
+func (s *AccountingSession) Disconnect(cause string) {
+	select {
+	case s.disconnect <- cause:
+	case <-s.done:
+	}
+}
+
+// Roam moves a wireless device to its next access point. The running
+// session ends with an Accounting-Stop on the old AP, or goes on with an
+// Interim-Update from the new one with fast roaming. It returns once the
+// device is on the new AP.
+func (s *AccountingSession) Roam() {
+	moved := make(chan struct{})
+	select {
+	case s.roam <- moved:
+		<-moved
+	case <-s.done:
+		s.wireless.roam()
+	}
+}
+
+// Stop ends the session with the configured Acct-Terminate-Cause. It is
+// meant to be registered with GracefulShutdown.
+func (s *AccountingSession) Stop() error {
+	select {
+	case s.stop <- s.cfg.TerminateCause:
+		<-s.done
+	case <-s.done:
+	}
+	return nil
+}
+
+// Run sends the accounting requests of the sessions until it is stopped
+// or the context is cancelled
+func (s *AccountingSession) Run(ctx context.Context) {
+	defer close(s.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stop:
+			return
+		case <-s.disconnect:
+			// No session to end
+			continue
+		case moved := <-s.roam:
+			s.wireless.roam()
+			close(moved)
+			continue
+		case <-s.authenticated:
+		}
+
+		if !s.runSession(ctx) {
+			return
+		}
+		if !s.waitAuth {
+			// Without authentication the device comes right back
+			s.Authenticated()
+		}
+	}
+}
+
+// runSession reports one session and returns whether it ended with a
+// disconnection, after which a new session can start
+func (s *AccountingSession) runSession(ctx context.Context) bool {
+	s.begin()
+	defer s.end()
+
+	status := s.cfg.StatusType
+	if s.sessions > 1 {
+		// The device came back
+		status = rfc2866.AcctStatusType_Value_Start
+	}
+	switch status {
+	case rfc2866.AcctStatusType_Value_InterimUpdate:
+		// Join a session that has been running for an interim interval
+		s.started = s.started.Add(-s.cfg.InterimInterval)
+		s.account(time.Now())
+		s.send(ctx, rfc2866.AcctStatusType_Value_InterimUpdate, "")
+	case rfc2866.AcctStatusType_Value_Stop:
+		// Only report the end of such a session
+		s.started = s.started.Add(-s.cfg.InterimInterval)
+		s.account(time.Now())
+		s.send(ctx, rfc2866.AcctStatusType_Value_Stop, s.cfg.TerminateCause)
+		return false
+	default:
+		s.send(ctx, rfc2866.AcctStatusType_Value_Start, "")
+	}
+
+	ticker := time.NewTicker(s.cfg.InterimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case cause := <-s.stop:
+			s.account(time.Now())
+			s.send(ctx, rfc2866.AcctStatusType_Value_Stop, cause)
+			return false
+		case cause := <-s.disconnect:
+			s.discardAuthenticated()
+			s.account(time.Now())
+			s.send(ctx, rfc2866.AcctStatusType_Value_Stop, cause)
+			return true
+		case moved := <-s.roam:
+			if s.wireless.RoamAccounting == roamInterim {
+				s.wireless.roam()
+				close(moved)
+				s.account(time.Now())
+				s.send(ctx, rfc2866.AcctStatusType_Value_InterimUpdate, "")
+				continue
+			}
+			// The session ends on the old AP, the next one starts on the
+			// new AP
+			s.discardAuthenticated()
+			s.account(time.Now())
+			s.send(ctx, rfc2866.AcctStatusType_Value_Stop, s.wireless.RoamCause)
+			s.wireless.roam()
+			close(moved)
+			return true
+		case now := <-ticker.C:
+			s.account(now)
+			s.send(ctx, rfc2866.AcctStatusType_Value_InterimUpdate, "")
+		}
+	}
+}
+
+// discardAuthenticated drops the authentications received during the
+// session, which are stale once it ends
+func (s *AccountingSession) discardAuthenticated() {
+	select {
+	case <-s.authenticated:
+	default:
+	}
+}
+
+// begin opens a new session with zeroed counters. A configured
+// Acct-Session-Id is only used by the first session.
+func (s *AccountingSession) begin() {
+	s.sessions++
+	sessionID := s.cfg.AcctSessionId
+	if sessionID == "" || s.sessions > 1 {
+		sessionID = newAcctSessionID(s.cfg.CallingStationId, s.sessions)
+	}
+	s.setSessionID(sessionID)
+	s.started = time.Now()
+	s.inOctets, s.outOctets, s.inPackets, s.outPackets = 0, 0, 0, 0
+}
+
+// end closes the session
+func (s *AccountingSession) end() {
+	s.setSessionID("")
+}
+
+// account grows the counters by the configured traffic rates
+func (s *AccountingSession) account(now time.Time) {
+	elapsed := now.Sub(s.started).Seconds()
+	s.inOctets = uint64(elapsed * float64(s.cfg.InputRate))
+	s.outOctets = uint64(elapsed * float64(s.cfg.OutputRate))
+	if s.cfg.PacketSize > 0 {
+		s.inPackets = s.inOctets / uint64(s.cfg.PacketSize)
+		s.outPackets = s.outOctets / uint64(s.cfg.PacketSize)
+	}
+}
+
+// send builds and sends an Accounting-Request of the given status
+func (s *AccountingSession) send(ctx context.Context, status rfc2866.AcctStatusType, cause string) {
+	now := time.Now()
+
+	metrics.IncrementRADIUS()
+	_, response, err := s.cfg.Servers.Exchange(ctx, func(secret []byte) (*radius.Packet, error) {
+		packet := s.packet(status, cause, now)
+		packet.Secret = secret
+		return packet, nil
+	})
+	if err != nil {
+		logger.Error("Accounting %s for %s failed: %v", status, s.cfg.CallingStationId, err)
+		metrics.IncrementErrors()
+		return
+	}
+	if response.Code != radius.CodeAccountingResponse {
+		logger.Warn("Unexpected %s to accounting %s for %s", response.Code, status, s.cfg.CallingStationId)
+		return
+	}
+	logger.Info("Accounting %s for %s acknowledged (session %s, %v)",
+		status, s.cfg.CallingStationId, s.sessionID, time.Since(s.started).Round(time.Second))
+}
+
+// packet builds an Accounting-Request carrying the session attributes
+func (s *AccountingSession) packet(status rfc2866.AcctStatusType, cause string, now time.Time) *radius.Packet {
+	a := s.cfg
+	packet := radius.New(radius.CodeAccountingRequest, []byte(a.Secret))
+
+	// Configured attributes first, the session ones below take precedence
+	if err := a.Attributes.Apply(packet); err != nil {
+		logger.Warn("Accounting attributes for %s: %v", a.CallingStationId, err)
+	}
+	if s.wireless != nil {
+		if err := s.wireless.apply(packet); err != nil {
+			logger.Warn("Access point attributes for %s: %v", a.CallingStationId, err)
+		}
+	}
+
+	if _, configured := a.Attributes.Lookup(rfc2865.FramedIPAddress_Type); !configured {
+		s.mu.Lock()
+		address := s.address
+		s.mu.Unlock()
+		if address != nil {
+			rfc2865.FramedIPAddress_Set(packet, address)
+		}
+	}
+
+	rfc2866.AcctStatusType_Set(packet, status)
+	rfc2866.AcctSessionID_SetString(packet, s.sessionID)
+	rfc2869.EventTimestamp_Set(packet, now)
+
+	userName := a.UserName
+	if userName == "" {
+		userName = a.CallingStationId
+	}
+	rfc2865.UserName_SetString(packet, userName)
+	rfc2865.CallingStationID_SetString(packet, a.CallingStationId)
+
+	if status == rfc2866.AcctStatusType_Value_Start {
+		return packet
+	}
+
+	rfc2866.AcctSessionTime_Set(packet, rfc2866.AcctSessionTime(now.Sub(s.started)/time.Second))
+	// Octet counters are 32 bits, the overflow goes in the Gigawords
+	rfc2866.AcctInputOctets_Set(packet, rfc2866.AcctInputOctets(uint32(s.inOctets)))
+	rfc2866.AcctOutputOctets_Set(packet, rfc2866.AcctOutputOctets(uint32(s.outOctets)))
+	rfc2869.AcctInputGigawords_Set(packet, rfc2869.AcctInputGigawords(s.inOctets>>32))
+	rfc2869.AcctOutputGigawords_Set(packet, rfc2869.AcctOutputGigawords(s.outOctets>>32))
+	rfc2866.AcctInputPackets_Set(packet, rfc2866.AcctInputPackets(uint32(s.inPackets)))
+	rfc2866.AcctOutputPackets_Set(packet, rfc2866.AcctOutputPackets(uint32(s.outPackets)))
+
+	if status == rfc2866.AcctStatusType_Value_Stop {
+		if terminate, err := parseTerminateCause(cause); err == nil {
+			rfc2866.AcctTerminateCause_Set(packet, terminate)
+		} else {
+			logger.Warn("Invalid Acct-Terminate-Cause: %v", err)
+		}
+	}
+	return packet
+}
+
+// newAcctSessionID builds a session ID in the usual NAS format: a random
+// prefix, the station MAC and the session number
+func newAcctSessionID(callingStationID string, n int) string {
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
+	mac := strings.NewReplacer(":", "", "-", "", ".", "").Replace(callingStationID)
+	return fmt.Sprintf("%s-%s-%010d", strings.ToUpper(hex.EncodeToString(prefix)), strings.ToUpper(mac), n)
+}
+
+// parseTerminateCause accepts an Acct-Terminate-Cause name (e.g.
+// User-Request) or number
+func parseTerminateCause(value string) (rfc2866.AcctTerminateCause, error) {
+	return lookupRadiusValue(value, rfc2866.AcctTerminateCause_Strings)
+}
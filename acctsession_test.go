@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+// TestAccountingPacketCounters tests session time, counters and
+// Gigawords wrapping in Interim-Update and Stop requests
+func TestAccountingPacketCounters(t *testing.T) {
+	cfg := &Accounting{
+		Secret:           "secret",
+		CallingStationId: "90:6c:ac:64:95:c1",
+		Attributes:       testRadiusAttributes(t, "[accounting]\nNAS-Port-Type = Wireless-802.11\nCalling-Station-Id = 00:00:00:00:00:01\n"),
+		InputRate:        3 << 30, // 3 GiB/s
+		OutputRate:       1000,
+		PacketSize:       1000,
+		TerminateCause:   "Admin-Reboot",
+	}
+	s := NewAccountingSession(cfg, false)
+	s.begin()
+
+	start := s.packet(rfc2866.AcctStatusType_Value_Start, "", s.started)
+	if _, err := rfc2866.AcctSessionTime_Lookup(start); err == nil {
+		t.Error("Accounting-Start should not carry counters")
+	}
+	if rfc2865.UserName_GetString(start) != cfg.CallingStationId || rfc2865.NASPortType_Get(start) != rfc2865.NASPortType_Value_Wireless80211 {
+		t.Errorf("unexpected User-Name %q or NAS-Port-Type %v", rfc2865.UserName_GetString(start), rfc2865.NASPortType_Get(start))
+	}
+	if rfc2865.CallingStationID_GetString(start) != cfg.CallingStationId {
+		t.Errorf("configured Calling-Station-Id %q overrides the device MAC", rfc2865.CallingStationID_GetString(start))
+	}
+	if _, err := rfc2865.FramedIPAddress_Lookup(start); err == nil {
+		t.Error("Framed-IP-Address sent without a lease")
+	}
+	s.SetAddress(net.IPv4(10, 10, 1, 22))
+	if ip := rfc2865.FramedIPAddress_Get(s.packet(rfc2866.AcctStatusType_Value_Start, "", s.started)); !ip.Equal(net.IPv4(10, 10, 1, 22)) {
+		t.Errorf("Framed-IP-Address %s, expected the lease", ip)
+	}
+
+	now := s.started.Add(2 * time.Second)
+	s.account(now)
+	interim := s.packet(rfc2866.AcctStatusType_Value_InterimUpdate, "", now)
+	if rfc2866.AcctSessionTime_Get(interim) != 2 {
+		t.Errorf("unexpected Acct-Session-Time %d", rfc2866.AcctSessionTime_Get(interim))
+	}
+	// 6 GiB = 1 Gigaword and 2 GiB
+	if rfc2869.AcctInputGigawords_Get(interim) != 1 || rfc2866.AcctInputOctets_Get(interim) != 2<<30 {
+		t.Errorf("unexpected input counters %d gigawords, %d octets",
+			rfc2869.AcctInputGigawords_Get(interim), rfc2866.AcctInputOctets_Get(interim))
+	}
+	if rfc2866.AcctOutputOctets_Get(interim) != 2000 || rfc2866.AcctOutputPackets_Get(interim) != 2 {
+		t.Errorf("unexpected output counters %d octets, %d packets",
+			rfc2866.AcctOutputOctets_Get(interim), rfc2866.AcctOutputPackets_Get(interim))
+	}
+
+	stop := s.packet(rfc2866.AcctStatusType_Value_Stop, cfg.TerminateCause, now)
+	if rfc2866.AcctTerminateCause_Get(stop) != rfc2866.AcctTerminateCause_Value_AdminReboot {
+		t.Errorf("unexpected Acct-Terminate-Cause %v", rfc2866.AcctTerminateCause_Get(stop))
+	}
+	if rfc2866.AcctSessionID_GetString(stop) != s.sessionID || s.sessionID == "" {
+		t.Errorf("unexpected Acct-Session-Id %q", rfc2866.AcctSessionID_GetString(stop))
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// ARP operations
+const (
+	arpRequest = 1
+	arpReply   = 2
+)
+
+const arpPacketLen = 28
+
+// Address conflict detection timing (RFC 5227 section 1.1)
+const (
+	arpProbeWait        = 1 * time.Second
+	arpProbeNum         = 3
+	arpProbeMin         = 1 * time.Second
+	arpProbeMax         = 2 * time.Second
+	arpAnnounceWait     = 2 * time.Second
+	arpAnnounceNum      = 2
+	arpAnnounceInterval = 2 * time.Second
+	arpDefendInterval   = 10 * time.Second
+)
+
+// ARPState is the state of the address held by the ARP client
+type ARPState int
+
+const (
+	ARPIdle ARPState = iota
+	ARPProbing
+	ARPAnnouncing
+	ARPBound
+)
+
+func (s ARPState) String() string {
+	switch s {
+	case ARPIdle:
+		return "IDLE"
+	case ARPProbing:
+		return "PROBING"
+	case ARPAnnouncing:
+		return "ANNOUNCING"
+	case ARPBound:
+		return "BOUND"
+	}
+	return "UNKNOWN"
+}
+
+// ARP holds the ARP configuration of a simulated device
+type ARP struct {
+	Enabled    bool // Enable/Disable ARP
+	ClientMAC  net.HardwareAddr
+	SrcMac     net.HardwareAddr // Source MAC (Ethernet Header)
+	Address    net.IP           // Static address, claimed at startup
+	Probe      bool             // Probe the address before using it (RFC 5227)
+	Gratuitous time.Duration    // Interval between gratuitous ARPs, 0 to disable
+}
+
+// arpPacket is an Ethernet/IPv4 ARP packet
+type arpPacket struct {
+	Op        uint16
+	SenderMAC net.HardwareAddr
+	SenderIP  net.IP
+	TargetMAC net.HardwareAddr
+	TargetIP  net.IP
+}
+
+// parseARP decodes an Ethernet/IPv4 ARP packet
+func parseARP(b []byte) (*arpPacket, bool) {
+	if len(b) < arpPacketLen {
+		return nil, false
+	}
+	if binary.BigEndian.Uint16(b[0:2]) != 1 || binary.BigEndian.Uint16(b[2:4]) != uint16(ethernet.EtherTypeIPv4) ||
+		b[4] != 6 || b[5] != 4 {
+		return nil, false
+	}
+	return &arpPacket{
+		Op:        binary.BigEndian.Uint16(b[6:8]),
+		SenderMAC: net.HardwareAddr(b[8:14]),
+		SenderIP:  net.IP(b[14:18]),
+		TargetMAC: net.HardwareAddr(b[18:24]),
+		TargetIP:  net.IP(b[24:28]),
+	}, true
+}
+
+// MarshalBinary encodes the packet
+func (p *arpPacket) MarshalBinary() ([]byte, error) {
+	b := make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(b[0:2], 1) // Ethernet
+	binary.BigEndian.PutUint16(b[2:4], uint16(ethernet.EtherTypeIPv4))
+	b[4], b[5] = 6, 4
+	binary.BigEndian.PutUint16(b[6:8], p.Op)
+	copy(b[8:14], p.SenderMAC)
+	copy(b[14:18], p.SenderIP.To4())
+	copy(b[18:24], p.TargetMAC)
+	copy(b[24:28], p.TargetIP.To4())
+	return b, nil
+}
+
+// ARPClient probes and announces the address of a simulated device,
+// answers ARP requests for it and sends periodic gratuitous ARPs
+type ARPClient struct {
+	cfg *ARP
+	raw *RawClient
+
+	// OnConflict is called from the client goroutine when another host
+	// holds the claimed address
+	OnConflict func(net.IP)
+
+	state      ARPState
+	addr       net.IP
+	sent       int
+	lastDefend time.Time
+
+	claims  chan net.IP
+	packets chan *arpPacket
+}
+
+// NewARPClient creates an ARP client for the configured device
+func NewARPClient(cfg *ARP, raw *RawClient) *ARPClient {
+	return &ARPClient{
+		cfg:     cfg,
+		raw:     raw,
+		claims:  make(chan net.IP, 4),
+		packets: make(chan *arpPacket, 64),
+	}
+}
+
+// Claim starts using addr, probing it first when configured to. A nil
+// address stops answering for the current one.
+func (c *ARPClient) Claim(addr net.IP) {
+	select {
+	case c.claims <- addr:
+	default:
+		logger.Warn("ARP claim queue full for %s, dropping %s", c.cfg.ClientMAC, addr)
+	}
+}
+
+// deliver hands a received ARP packet to the client
+func (c *ARPClient) deliver(p *arpPacket) {
+	select {
+	case c.packets <- p:
+	default:
+	}
+}
+
+// Run executes the ARP client until the context is cancelled
+func (c *ARPClient) Run(ctx context.Context) {
+	c.raw.HandleARP(c.cfg.ClientMAC, c.deliver)
+	defer c.raw.RemoveARP(c.cfg.ClientMAC)
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	if c.cfg.Address != nil {
+		resetTimer(timer, c.claim(c.cfg.Address))
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case addr := <-c.claims:
+			if wait := c.claim(addr); wait >= 0 {
+				resetTimer(timer, wait)
+			}
+		case p := <-c.packets:
+			if c.handle(p) {
+				timer.Stop()
+			}
+		case <-timer.C:
+			if wait := c.handleTimeout(); wait > 0 {
+				resetTimer(timer, wait)
+			}
+		}
+	}
+}
+
+// claim switches to a new address and returns the time to the first
+// probe or announcement, or -1 when there is nothing to schedule
+func (c *ARPClient) claim(addr net.IP) time.Duration {
+	addr = addr.To4()
+	if addr != nil && addr.Equal(c.addr) && c.state != ARPIdle {
+		return -1
+	}
+	c.addr, c.sent = addr, 0
+	if addr == nil || addr.IsUnspecified() {
+		c.addr = nil
+		c.setState(ARPIdle)
+		return -1
+	}
+	if c.cfg.Probe {
+		c.setState(ARPProbing)
+		return randomDuration(0, arpProbeWait)
+	}
+	c.setState(ARPAnnouncing)
+	return 0
+}
+
+// handleTimeout sends the next probe, announcement or gratuitous ARP and
+// returns the time to wait before the next one
+func (c *ARPClient) handleTimeout() time.Duration {
+	switch c.state {
+	case ARPProbing:
+		if c.sent == arpProbeNum {
+			c.sent = 0
+			c.setState(ARPAnnouncing)
+			return c.handleTimeout()
+		}
+		c.sendProbe()
+		c.sent++
+		if c.sent == arpProbeNum {
+			return arpAnnounceWait
+		}
+		return randomDuration(arpProbeMin, arpProbeMax)
+
+	case ARPAnnouncing:
+		c.sendAnnouncement()
+		c.sent++
+		if c.sent < arpAnnounceNum {
+			return arpAnnounceInterval
+		}
+		c.setState(ARPBound)
+		logger.Info("ARP: %s is using %s", c.cfg.ClientMAC, c.addr)
+		return c.cfg.Gratuitous
+
+	case ARPBound:
+		c.sendAnnouncement()
+		return c.cfg.Gratuitous
+	}
+	return 0
+}
+
+// handle processes a received ARP packet and reports whether the claimed
+// address was given up
+func (c *ARPClient) handle(p *arpPacket) bool {
+	if c.addr == nil || bytes.Equal(p.SenderMAC, c.cfg.ClientMAC) {
+		// Our own frames are looped back by the raw socket
+		return false
+	}
+
+	switch c.state {
+	case ARPProbing:
+		// Any use of the address, or another host probing for it, is a
+		// conflict (RFC 5227 section 2.1.1)
+		if p.SenderIP.Equal(c.addr) ||
+			(p.Op == arpRequest && p.SenderIP.IsUnspecified() && p.TargetIP.Equal(c.addr)) {
+			c.conflict(p.SenderMAC)
+			return true
+		}
+
+	case ARPAnnouncing, ARPBound:
+		if p.SenderIP.Equal(c.addr) {
+			// Defend the address once, give it up on a second conflict
+			// (RFC 5227 section 2.4 (b))
+			if time.Since(c.lastDefend) < arpDefendInterval {
+				c.conflict(p.SenderMAC)
+				return true
+			}
+			logger.Warn("ARP: %s claims %s, defending it", p.SenderMAC, c.addr)
+			c.lastDefend = time.Now()
+			c.sendAnnouncement()
+			return false
+		}
+		if p.Op == arpRequest && p.TargetIP.Equal(c.addr) && !p.SenderIP.IsUnspecified() {
+			c.send(arpReply, p.SenderMAC, c.addr, p.SenderMAC, p.SenderIP)
+		}
+	}
+	return false
+}
+
+// conflict gives up the claimed address and reports it
+func (c *ARPClient) conflict(owner net.HardwareAddr) {
+	addr := c.addr
+	logger.Warn("ARP: %s is already used by %s", addr, owner)
+	c.addr = nil
+	c.setState(ARPIdle)
+	if c.OnConflict != nil {
+		c.OnConflict(addr)
+	}
+}
+
+// sendProbe asks whether anyone uses the claimed address, from 0.0.0.0
+func (c *ARPClient) sendProbe() {
+	c.send(arpRequest, ethernetBroadcast, net.IPv4zero, nil, c.addr)
+}
+
+// sendAnnouncement broadcasts the claimed address as both sender and target
+func (c *ARPClient) sendAnnouncement() {
+	c.send(arpRequest, ethernetBroadcast, c.addr, nil, c.addr)
+}
+
+// send builds and transmits an ARP packet from the device MAC
+func (c *ARPClient) send(op uint16, dst net.HardwareAddr, senderIP net.IP, targetMAC net.HardwareAddr, targetIP net.IP) {
+	if targetMAC == nil {
+		targetMAC = make(net.HardwareAddr, 6)
+	}
+	p := &arpPacket{
+		Op:        op,
+		SenderMAC: c.cfg.ClientMAC,
+		SenderIP:  senderIP,
+		TargetMAC: targetMAC,
+		TargetIP:  targetIP,
+	}
+	payload, _ := p.MarshalBinary()
+	if err := c.raw.writeFrame(c.cfg.ClientMAC, dst, c.cfg.SrcMac, ethernet.EtherTypeARP, payload); err != nil {
+		logger.Error("Failed to send ARP for %s: %v", c.cfg.ClientMAC, err)
+		metrics.IncrementErrors()
+	}
+}
+
+func (c *ARPClient) setState(state ARPState) {
+	if c.state != state {
+		logger.Debug("ARP %s: %s -> %s", c.cfg.ClientMAC, c.state, state)
+		c.state = state
+	}
+}
+
+// randomDuration returns a uniformly random duration in [min, max)
+func randomDuration(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(int64(max-min)))
+	return min + time.Duration(n.Int64())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// TestARPPacketRoundTrip tests that ARP packets are parsed the way they
+// are encoded
+func TestARPPacketRoundTrip(t *testing.T) {
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	p := &arpPacket{
+		Op:        arpRequest,
+		SenderMAC: mac,
+		SenderIP:  net.IPv4zero.To4(),
+		TargetMAC: make(net.HardwareAddr, 6),
+		TargetIP:  net.ParseIP("10.10.1.22").To4(),
+	}
+	b, _ := p.MarshalBinary()
+	if len(b) != arpPacketLen {
+		t.Fatalf("unexpected ARP packet length %d", len(b))
+	}
+
+	got, ok := parseARP(b)
+	if !ok || got.Op != p.Op || !bytes.Equal(got.SenderMAC, mac) ||
+		!got.SenderIP.Equal(p.SenderIP) || !got.TargetIP.Equal(p.TargetIP) {
+		t.Errorf("round trip mismatch: %+v", got)
+	}
+
+	b[1] = 6 // Not Ethernet
+	if _, ok := parseARP(b); ok {
+		t.Error("expected a non-Ethernet ARP packet to be rejected")
+	}
+}
+
+// TestARPProbeConflict tests that another host using or probing for the
+// claimed address is reported as a conflict while probing
+func TestARPProbeConflict(t *testing.T) {
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	other, _ := net.ParseMAC("00:11:22:33:44:55")
+	addr := net.ParseIP("10.10.1.22")
+
+	for name, p := range map[string]*arpPacket{
+		"reply":   {Op: arpReply, SenderMAC: other, SenderIP: addr.To4(), TargetIP: net.IPv4zero},
+		"probe":   {Op: arpRequest, SenderMAC: other, SenderIP: net.IPv4zero, TargetIP: addr.To4()},
+		"own":     {Op: arpRequest, SenderMAC: mac, SenderIP: addr.To4(), TargetIP: addr.To4()},
+		"another": {Op: arpRequest, SenderMAC: other, SenderIP: net.ParseIP("10.10.1.1"), TargetIP: net.ParseIP("10.10.1.2")},
+	} {
+		var reported net.IP
+		c := NewARPClient(&ARP{ClientMAC: mac, Probe: true}, nil)
+		c.OnConflict = func(ip net.IP) { reported = ip }
+		c.claim(addr)
+
+		gaveUp := c.handle(p)
+		want := name == "reply" || name == "probe"
+		if gaveUp != want || (reported != nil) != want {
+			t.Errorf("%s: gave up %v, reported %v, want %v", name, gaveUp, reported, want)
+		}
+		if want && (c.state != ARPIdle || !reported.Equal(addr)) {
+			t.Errorf("%s: unexpected state %s after conflict on %s", name, c.state, reported)
+		}
+	}
+}
@@ -2,16 +2,15 @@ package main
 
 import (
 	"fmt"
-	"net"
 	"os"
 
 	"gopkg.in/ini.v1"
 )
 
 type Authentication struct {
-	Enabled          bool   // Enable/Disable Radius Accounting
-	ServerIP         net.IP // Radius Accounting server IP
-	Secret           string // Radius Accounting secret
+	Enabled          bool          // Enable/Disable Radius Authentication
+	Servers          RadiusServers // Radius Authentication servers
+	Secret           string        // Radius Authentication secret, the default of the servers
 	UserName         string
 	CallingStationId string
 	CalledStationId  string
@@ -21,6 +20,23 @@ type Authentication struct {
 	NASIdentifier    string
 	NASPortId        string
 	NASIPAddress     string
+	Attributes       RadiusAttributes // Dictionary attributes of the section
+
+	// MAC authentication
+	AuthType     string // pap or chap
+	UserPassword string // Password, the User-Name by default
+	MACFormat    string // Example address giving the User-Name format
+
+	MessageAuthenticator bool // Sign requests and require signed responses
+
+	// 802.1X supplicant, MAC authentication when EAPMethod is empty
+	EAPMethod         string // md5, peap or tls
+	Identity          string // Inner identity, the device MAC address by default
+	AnonymousIdentity string // Outer identity sent in clear, Identity when empty
+	Password          string // EAP-MD5 and MSCHAPv2 password
+	CACert            string // PEM file of the CA checking the server certificate
+	ClientCert        string // PEM client certificate of EAP-TLS
+	ClientKey         string // PEM private key of the client certificate
 }
 
 func (a *Authentication) ReadRadiusAuthenticationConfig(config *Config) {
@@ -48,12 +64,16 @@ func (a *Authentication) ReadRadiusAuthenticationConfig(config *Config) {
 		a.Enabled = false
 	}
 
-	server := cfg.Section("authentication").Key("server").String()
-	a.ServerIP = net.ParseIP(server)
-
 	secret := cfg.Section("authentication").Key("secret").String()
 	a.Secret = secret
 
+	server := cfg.Section("authentication").Key("server").String()
+	a.Servers.DeadTime = defaultRadiusDeadTime
+	a.Servers.Servers, err = parseRadiusServerList(server, RadiusServer{Secret: secret, Timeout: defaultRadiusTimeout, Retries: defaultRadiusRetries}, radiusAuthPort)
+	if err != nil {
+		fmt.Printf("Invalid authentication server: %v\n", err)
+	}
+
 	username := cfg.Section("authentication").Key("User-Name").String()
 	a.UserName = username
 
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc3576"
+)
+
+// CoA holds the configuration of the Dynamic Authorization server
+// (RFC 5176), which takes CoA and Disconnect requests for the simulated
+// sessions like a NAS does
+type CoA struct {
+	Enabled bool   // Enable/Disable the CoA server
+	Listen  string // Address and UDP port to listen on
+	Secret  string // Secret shared with the Dynamic Authorization client
+}
+
+// errorCauseMultipleSessionSelectionUnsupported is the Error-Cause of a
+// request matching several sessions (RFC 5176 3.6), unknown to rfc3576
+const errorCauseMultipleSessionSelectionUnsupported rfc3576.ErrorCause = 508
+
+// deviceRegistry indexes the started devices by MAC address and by the
+// Acct-Session-Id of their running session
+type deviceRegistry struct {
+	mu        sync.RWMutex
+	byMAC     map[string]*Device
+	bySession map[string][]*Device // Several devices when configured with the same ID
+}
+
+// nasSessions holds the devices the CoA server can act on
+var nasSessions = newDeviceRegistry()
+
+func newDeviceRegistry() *deviceRegistry {
+	return &deviceRegistry{byMAC: make(map[string]*Device), bySession: make(map[string][]*Device)}
+}
+
+// Add registers a started device
+func (r *deviceRegistry) Add(dev *Device) {
+	r.mu.Lock()
+	r.byMAC[dev.ClientMAC.String()] = dev
+	r.mu.Unlock()
+
+	if dev.session != nil {
+		dev.session.watch(func(old, new string) { r.moveSession(dev, old, new) })
+	}
+}
+
+// moveSession indexes a device under the Acct-Session-Id of its new
+// session, or under none when new is empty
+func (r *deviceRegistry) moveSession(dev *Device, old, new string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if old != "" {
+		var others []*Device
+		for _, d := range r.bySession[old] {
+			if d != dev {
+				others = append(others, d)
+			}
+		}
+		if len(others) == 0 {
+			delete(r.bySession, old)
+		} else {
+			r.bySession[old] = others
+		}
+	}
+	if new != "" {
+		r.bySession[new] = append(r.bySession[new], dev)
+	}
+}
+
+// find returns the device a request is about, or the Error-Cause to answer
+// with. The device is identified by its Acct-Session-Id, Calling-Station-Id
+// or else User-Name; all of the first two present must match (RFC 5176 3).
+func (r *deviceRegistry) find(p *radius.Packet) (*Device, rfc3576.ErrorCause) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var dev *Device
+	if sessionID := rfc2866.AcctSessionID_GetString(p); sessionID != "" {
+		switch devices := r.bySession[sessionID]; len(devices) {
+		case 0:
+			return nil, rfc3576.ErrorCause_Value_SessionContextNotFound
+		case 1:
+			dev = devices[0]
+		default:
+			return nil, errorCauseMultipleSessionSelectionUnsupported
+		}
+	}
+
+	id := rfc2865.CallingStationID_GetString(p)
+	if id == "" && dev == nil {
+		id = rfc2865.UserName_GetString(p)
+	}
+	if id == "" {
+		if dev == nil {
+			return nil, rfc3576.ErrorCause_Value_MissingAttribute
+		}
+		return dev, 0
+	}
+	mac, err := parseHex(id)
+	if err != nil || len(mac) != 6 {
+		return nil, rfc3576.ErrorCause_Value_SessionContextNotFound
+	}
+	byMAC, ok := r.byMAC[net.HardwareAddr(mac).String()]
+	if !ok || (dev != nil && byMAC != dev) {
+		return nil, rfc3576.ErrorCause_Value_SessionContextNotFound
+	}
+	return byMAC, 0
+}
+
+// CoAServer answers the CoA and Disconnect requests for the registered
+// devices
+type CoAServer struct {
+	cfg      *CoA
+	registry *deviceRegistry
+}
+
+// NewCoAServer creates a CoA server acting on the devices of registry
+func NewCoAServer(cfg *CoA, registry *deviceRegistry) *CoAServer {
+	return &CoAServer{cfg: cfg, registry: registry}
+}
+
+// Run serves requests until the context is cancelled
+func (s *CoAServer) Run(ctx context.Context) {
+	conn, err := net.ListenPacket("udp", s.cfg.Listen)
+	if err != nil {
+		logger.Error("CoA server cannot listen on %s: %v", s.cfg.Listen, err)
+		return
+	}
+
+	server := &radius.PacketServer{
+		Handler:      s,
+		SecretSource: radius.StaticSecretSource([]byte(s.cfg.Secret)),
+	}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	logger.Info("CoA server listening on %s", conn.LocalAddr())
+	if err := server.Serve(conn); err != nil && err != radius.ErrServerShutdown {
+		logger.Error("CoA server stopped: %v", err)
+	}
+}
+
+// ServeRADIUS answers a request, then applies it to the device: a CoA
+// makes it reauthenticate, a Disconnect ends its session first
+func (s *CoAServer) ServeRADIUS(w radius.ResponseWriter, r *radius.Request) {
+	var ack, nak radius.Code
+	switch r.Code {
+	case radius.CodeCoARequest:
+		ack, nak = radius.CodeCoAACK, radius.CodeCoANAK
+	case radius.CodeDisconnectRequest:
+		ack, nak = radius.CodeDisconnectACK, radius.CodeDisconnectNAK
+	default:
+		logger.Warn("CoA server: ignoring %s from %s", r.Code, r.RemoteAddr)
+		return
+	}
+
+	dev, cause := s.registry.find(r.Packet)
+	if dev == nil {
+		logger.Warn("%s from %s: %s", r.Code, r.RemoteAddr, cause)
+		response := r.Response(nak)
+		rfc3576.ErrorCause_Set(response, cause)
+		w.Write(response)
+		return
+	}
+	w.Write(r.Response(ack))
+	logger.Info("%s from %s for %s", r.Code, r.RemoteAddr, dev.Name)
+
+	if r.Code == radius.CodeDisconnectRequest {
+		dev.Disconnect(rfc2866.AcctTerminateCause_Value_AdminReset.String())
+		return
+	}
+	if hasSubscriberCommand(decodeAccessAccept(r.Packet).AVPairs, "bounce-host-port") {
+		// The port goes down and up: the device gets a new lease too
+		if dev.dhcp != nil {
+			dev.dhcp.Restart()
+		}
+	}
+	dev.Reauthenticate()
+}
+
+// hasSubscriberCommand reports whether a Cisco "subscriber:command" AV pair
+// asks for the given command
+func hasSubscriberCommand(pairs []string, command string) bool {
+	for _, pair := range pairs {
+		name, value, _ := strings.Cut(pair, "=")
+		if strings.HasSuffix(strings.ToLower(name), "command") && strings.EqualFold(value, command) {
+			return true
+		}
+	}
+	return false
+}
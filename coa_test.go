@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc3576"
+)
+
+// captureResponseWriter keeps the response of a RADIUS handler
+type captureResponseWriter struct{ response *radius.Packet }
+
+func (w *captureResponseWriter) Write(p *radius.Packet) error {
+	w.response = p
+	return nil
+}
+
+// TestCoAServer tests session matching, the ACK/NAK answers and the
+// reauthentication they trigger
+func TestCoAServer(t *testing.T) {
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	session := NewAccountingSession(&Accounting{CallingStationId: mac.String()}, true)
+	session.begin()
+	dev := &Device{Name: "camera", ClientMAC: mac, session: session, reauth: make(chan struct{}, 1)}
+
+	registry := newDeviceRegistry()
+	registry.Add(dev)
+	s := NewCoAServer(&CoA{Secret: "secret"}, registry)
+
+	serve := func(code radius.Code, set func(p *radius.Packet)) *radius.Packet {
+		p := radius.New(code, []byte("secret"))
+		set(p)
+		w := &captureResponseWriter{}
+		s.ServeRADIUS(w, &radius.Request{Packet: p})
+		return w.response
+	}
+	reauthenticated := func() bool {
+		select {
+		case <-dev.reauth:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Calling-Station-Id in the dashed upper case format of most NACs
+	response := serve(radius.CodeCoARequest, func(p *radius.Packet) {
+		rfc2865.CallingStationID_SetString(p, "90-6C-AC-64-95-C1")
+	})
+	if response.Code != radius.CodeCoAACK || !reauthenticated() {
+		t.Errorf("CoA by Calling-Station-Id: got %s, reauthenticated %v", response.Code, reauthenticated())
+	}
+
+	response = serve(radius.CodeCoARequest, func(p *radius.Packet) {
+		rfc2866.AcctSessionID_SetString(p, session.SessionID())
+	})
+	if response.Code != radius.CodeCoAACK || !reauthenticated() {
+		t.Errorf("CoA by Acct-Session-Id: got %s", response.Code)
+	}
+
+	response = serve(radius.CodeDisconnectRequest, func(p *radius.Packet) {
+		rfc2865.CallingStationID_SetString(p, "90:6c:ac:64:95:c2")
+	})
+	if response.Code != radius.CodeDisconnectNAK || rfc3576.ErrorCause_Get(response) != rfc3576.ErrorCause_Value_SessionContextNotFound {
+		t.Errorf("Disconnect for an unknown device: got %s %s", response.Code, rfc3576.ErrorCause_Get(response))
+	}
+
+	response = serve(radius.CodeDisconnectRequest, func(p *radius.Packet) {})
+	if rfc3576.ErrorCause_Get(response) != rfc3576.ErrorCause_Value_MissingAttribute || reauthenticated() {
+		t.Errorf("Disconnect without identifier: got %s", rfc3576.ErrorCause_Get(response))
+	}
+
+	// Every identification attribute must match the session
+	response = serve(radius.CodeCoARequest, func(p *radius.Packet) {
+		rfc2866.AcctSessionID_SetString(p, session.SessionID())
+		rfc2865.CallingStationID_SetString(p, "90-6C-AC-64-95-C1")
+	})
+	if response.Code != radius.CodeCoAACK || !reauthenticated() {
+		t.Errorf("CoA by Acct-Session-Id and Calling-Station-Id: got %s", response.Code)
+	}
+	other, _ := net.ParseMAC("90:6c:ac:64:95:c2")
+	registry.Add(&Device{Name: "printer", ClientMAC: other, reauth: make(chan struct{}, 1)})
+	response = serve(radius.CodeDisconnectRequest, func(p *radius.Packet) {
+		rfc2866.AcctSessionID_SetString(p, session.SessionID())
+		rfc2865.CallingStationID_SetString(p, other.String())
+	})
+	if response.Code != radius.CodeDisconnectNAK || rfc3576.ErrorCause_Get(response) != rfc3576.ErrorCause_Value_SessionContextNotFound {
+		t.Errorf("Disconnect for the session of another device: got %s %s", response.Code, rfc3576.ErrorCause_Get(response))
+	}
+
+	// A session ID configured alike on two devices selects neither
+	cfg := &Accounting{CallingStationId: "90:6c:ac:64:95:c3", AcctSessionId: session.SessionID()}
+	clone := NewAccountingSession(cfg, true)
+	registry.Add(&Device{Name: "clone", ClientMAC: net.HardwareAddr{0x90, 0x6c, 0xac, 0x64, 0x95, 0xc3}, session: clone})
+	clone.begin()
+	response = serve(radius.CodeDisconnectRequest, func(p *radius.Packet) {
+		rfc2866.AcctSessionID_SetString(p, session.SessionID())
+	})
+	if response.Code != radius.CodeDisconnectNAK || rfc3576.ErrorCause_Get(response) != errorCauseMultipleSessionSelectionUnsupported || reauthenticated() {
+		t.Errorf("Disconnect for an ambiguous session: got %s %s", response.Code, rfc3576.ErrorCause_Get(response))
+	}
+
+	// An ended session is no longer found
+	clone.end()
+	id := session.SessionID()
+	session.end()
+	response = serve(radius.CodeDisconnectRequest, func(p *radius.Packet) {
+		rfc2866.AcctSessionID_SetString(p, id)
+	})
+	if rfc3576.ErrorCause_Get(response) != rfc3576.ErrorCause_Value_SessionContextNotFound {
+		t.Errorf("Disconnect for an ended session: got %s %s", response.Code, rfc3576.ErrorCause_Get(response))
+	}
+}
+
+// TestCoADisconnect tests that a Disconnect-Request ends the session with
+// an Accounting-Stop for Admin-Reset, after which the device authenticates
+// again and starts a new session
+func TestCoADisconnect(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	accepted := make(chan struct{}, 10)
+	records := make(chan accountingRecord, 10)
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte("secret")),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			if r.Code == radius.CodeAccessRequest {
+				accepted <- struct{}{}
+				w.Write(r.Response(radius.CodeAccessAccept))
+				return
+			}
+			records <- accountingRecord{
+				status:    rfc2866.AcctStatusType_Get(r.Packet),
+				sessionID: rfc2866.AcctSessionID_GetString(r.Packet),
+				cause:     rfc2866.AcctTerminateCause_Get(r.Packet),
+			}
+			w.Write(r.Response(radius.CodeAccountingResponse))
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	servers := RadiusServers{
+		Servers: []RadiusServer{{Address: conn.LocalAddr().String(), Secret: "secret", Timeout: time.Second}},
+		health:  newRadiusHealth(),
+	}
+	dev := &Device{
+		Name:      "camera",
+		ClientMAC: mac,
+		Authentication: Authentication{
+			Enabled:          true,
+			Servers:          servers,
+			Secret:           "secret",
+			UserName:         "906cac6495c1",
+			CallingStationId: mac.String(),
+			AuthType:         "pap",
+		},
+		Accounting: Accounting{
+			Enabled:          true,
+			Servers:          servers,
+			Secret:           "secret",
+			CallingStationId: mac.String(),
+			InterimInterval:  time.Hour,
+			PacketSize:       500,
+			TerminateCause:   "User-Request",
+			StatusType:       rfc2866.AcctStatusType_Value_Start,
+		},
+		reauth: make(chan struct{}, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dev.session = NewAccountingSession(&dev.Accounting, true)
+	go dev.session.Run(ctx)
+	defer dev.session.Stop()
+	go dev.runAuthentication(ctx, dev.session)
+
+	registry := newDeviceRegistry()
+	registry.Add(dev)
+	s := NewCoAServer(&CoA{Secret: "secret"}, registry)
+
+	next := func() accountingRecord {
+		t.Helper()
+		select {
+		case r := <-records:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("no accounting request")
+			return accountingRecord{}
+		}
+	}
+
+	start := next()
+	if start.status != rfc2866.AcctStatusType_Value_Start || dev.session.SessionID() != start.sessionID {
+		t.Fatalf("unexpected first request %+v, session %s", start, dev.session.SessionID())
+	}
+
+	p := radius.New(radius.CodeDisconnectRequest, []byte("secret"))
+	rfc2866.AcctSessionID_SetString(p, start.sessionID)
+	w := &captureResponseWriter{}
+	s.ServeRADIUS(w, &radius.Request{Packet: p})
+	if w.response.Code != radius.CodeDisconnectACK {
+		t.Fatalf("Disconnect answered with %s", w.response.Code)
+	}
+
+	stop := next()
+	if stop.status != rfc2866.AcctStatusType_Value_Stop || stop.sessionID != start.sessionID ||
+		stop.cause != rfc2866.AcctTerminateCause_Value_AdminReset {
+		t.Errorf("Disconnect did not stop the session with Admin-Reset: %+v", stop)
+	}
+	restart := next()
+	if restart.status != rfc2866.AcctStatusType_Value_Start || restart.sessionID == start.sessionID {
+		t.Errorf("no new session after the Disconnect: %+v", restart)
+	}
+	if n := len(accepted); n != 2 {
+		t.Errorf("%d Access-Requests, expected a reauthentication after the Disconnect", n)
+	}
+}
@@ -14,8 +14,10 @@ import (
 type ConfigManager struct {
 	mu     sync.RWMutex
 	cfg    *ini.File
+	own    *ini.File // Device file of an overlay, without the inherited settings
 	cache  map[string]interface{}
 	loaded bool
+	file   string
 }
 
 var configManager = &ConfigManager{
@@ -38,6 +40,7 @@ func (cm *ConfigManager) LoadConfig(configFile string) error {
 
 	cm.cfg = cfg
 	cm.loaded = true
+	cm.file = configFile
 
 	// Pre-load critical configuration into cache
 	cm.preloadCache()
@@ -46,6 +49,38 @@ func (cm *ConfigManager) LoadConfig(configFile string) error {
 	return nil
 }
 
+// Overlay loads a device configuration file on top of the loaded
+// configuration. Settings of the device file win, everything it leaves
+// out is inherited.
+func (cm *ConfigManager) Overlay(deviceFile string) (*ConfigManager, error) {
+	cm.mu.RLock()
+	baseFile := cm.file
+	cm.mu.RUnlock()
+
+	if err := SafeConfigRead(deviceFile); err != nil {
+		return nil, err
+	}
+
+	cfg, err := ini.Load(baseFile, deviceFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device config file: %v", err)
+	}
+	own, err := ini.Load(deviceFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device config file: %v", err)
+	}
+
+	device := &ConfigManager{
+		cfg:    cfg,
+		own:    own,
+		cache:  make(map[string]interface{}),
+		loaded: true,
+		file:   deviceFile,
+	}
+	device.preloadCache()
+	return device, nil
+}
+
 // preloadCache loads frequently accessed config values into memory
 func (cm *ConfigManager) preloadCache() {
 	// Cache network interface
@@ -150,6 +185,23 @@ func (cm *ConfigManager) GetString(section, key, defaultVal string) string {
 	return val
 }
 
+// GetOwnString gets a string value set by the device file of an overlay,
+// or by the main configuration file, but not inherited from it
+func (cm *ConfigManager) GetOwnString(section, key string) string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if !cm.loaded {
+		return ""
+	}
+
+	file := cm.own
+	if file == nil {
+		file = cm.cfg
+	}
+	return file.Section(section).Key(key).String()
+}
+
 // GetInt safely gets an integer value with validation
 func (cm *ConfigManager) GetInt(section, key string, defaultVal, min, max int) int {
 	cm.mu.RLock()
@@ -201,6 +253,28 @@ func (cm *ConfigManager) GetIP(section, key string, defaultIP net.IP) net.IP {
 	return ip
 }
 
+// GetIPList safely parses a comma-separated list of IP addresses,
+// skipping invalid entries
+func (cm *ConfigManager) GetIPList(section, key string) []net.IP {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if !cm.loaded {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, val := range cm.cfg.Section(section).Key(key).Strings(",") {
+		ip := net.ParseIP(val)
+		if ip == nil {
+			logger.Warn("Invalid IP address '%s' in %s.%s, skipping", val, section, key)
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
 // GetMAC safely parses a MAC address
 func (cm *ConfigManager) GetMAC(section, key string, defaultMAC net.HardwareAddr) net.HardwareAddr {
 	cm.mu.RLock()
@@ -251,3 +325,15 @@ func (cm *ConfigManager) GetDuration(section, key string, defaultDuration time.D
 	logger.Warn("Invalid duration '%s' for %s.%s, using default %v", val, section, key, defaultDuration)
 	return defaultDuration
 }
+
+// GetKeys returns the key names of a section, in file order
+func (cm *ConfigManager) GetKeys(section string) []string {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if !cm.loaded {
+		return nil
+	}
+
+	return cm.cfg.Section(section).KeyStrings()
+}
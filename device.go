@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// Device is a simulated device: its MAC address and the configuration of
+// every protocol it runs
+type Device struct {
+	Name      string
+	ClientMAC net.HardwareAddr
+
+	VLAN           VLAN
+	DHCP           Interface
+	DHCPv6         DHCPv6
+	ND             IPv6ND
+	ARP            ARP
+	UPnP           Upnp
+	Accounting     Accounting
+	Authentication Authentication
+	Wireless       Wireless
+	IPFIX          IpFix
+
+	raw     *RawClient         // Socket the device sends on, set by Start
+	dhcp    *DHCPClient        // DHCP client, restarted on VLAN changes
+	session *AccountingSession // Accounting session, ended on Disconnect
+	reauth  chan struct{}      // Asks for an Access-Request now
+}
+
+// NewDevice reads the configuration of a device sending from ifi
+func NewDevice(name string, cm *ConfigManager, ifi *net.Interface) *Device {
+	return newDevice(name, cm.GetClientMAC(), cm, ifi)
+}
+
+// newDevice reads the configuration of a device with the given MAC
+func newDevice(name string, mac net.HardwareAddr, cm *ConfigManager, ifi *net.Interface) *Device {
+	dev := &Device{Name: name, ClientMAC: mac}
+
+	dev.VLAN.readVlanConfigOptimized(cm)
+
+	dev.DHCP.intNet = ifi
+	dev.DHCP.ClientMAC = dev.ClientMAC
+	dev.DHCP.readDhcpConfigOptimized(cm)
+
+	dev.DHCPv6.intNet = ifi
+	dev.DHCPv6.ClientMAC = dev.ClientMAC
+	dev.DHCPv6.readDhcpv6ConfigOptimized(cm)
+
+	dev.ND.ClientMAC = dev.ClientMAC
+	dev.ND.readIPv6ConfigOptimized(cm)
+
+	dev.ARP.ClientMAC = dev.ClientMAC
+	dev.ARP.readArpConfigOptimized(cm)
+	if dev.ARP.Address == nil && dev.DHCP.Enabled && dev.DHCP.Inform {
+		// Statically addressed devices own their ciaddr
+		dev.ARP.Address = dev.DHCP.CiAddr.To4()
+	}
+
+	dev.UPnP.readUpnpConfigOptimized(cm)
+	dev.UPnP.intNet = ifi
+
+	dev.Accounting.ReadRadiusAccountingConfigOptimized(cm)
+	dev.Authentication.ReadRadiusAuthenticationConfigOptimized(cm)
+	dev.setRadiusIdentity(cm)
+
+	dev.Wireless.readWirelessConfigOptimized(cm)
+
+	dev.IPFIX.readIpFixConfigOptimized(cm)
+	dev.IPFIX.DeviceMAC = dev.ClientMAC.String()
+
+	return dev
+}
+
+// setRadiusIdentity identifies the device by its MAC in RADIUS requests,
+// and in EAP unless an identity is configured. The accounting User-Name
+// and Acct-Session-Id are only taken from the configuration when the file
+// of the device sets them, those of the main configuration belong to
+// another device.
+func (dev *Device) setRadiusIdentity(cm *ConfigManager) {
+	dev.Accounting.CallingStationId = dev.ClientMAC.String()
+	dev.Authentication.CallingStationId = dev.ClientMAC.String()
+	dev.Authentication.UserName = formatMAC(dev.ClientMAC, dev.Authentication.MACFormat)
+	dev.Authentication.Identity = cm.GetString("authentication", "eap_identity", dev.Authentication.UserName)
+
+	dev.Accounting.UserName = cm.GetOwnString("accounting", "User-Name")
+	if dev.Accounting.UserName == "" {
+		dev.Accounting.UserName = dev.Authentication.UserName
+	}
+	dev.Accounting.AcctSessionId = cm.GetOwnString("accounting", "Acct-Session-Id")
+}
+
+// withMAC copies a device read from cm for another MAC address. Only the
+// settings derived from the MAC are read again, without logging, so that
+// thousands of devices share one reading of the configuration.
+func (dev *Device) withMAC(name string, mac net.HardwareAddr, cm *ConfigManager) *Device {
+	w := &dev.Wireless
+	c := &Device{
+		Name:           name,
+		ClientMAC:      mac,
+		VLAN:           dev.VLAN,
+		DHCP:           dev.DHCP,
+		DHCPv6:         dev.DHCPv6,
+		ND:             dev.ND,
+		ARP:            dev.ARP,
+		UPnP:           dev.UPnP,
+		Accounting:     dev.Accounting,
+		Authentication: dev.Authentication,
+		Wireless: Wireless{
+			Enabled:        w.Enabled,
+			SSID:           w.SSID,
+			APs:            w.APs,
+			RoamInterval:   w.RoamInterval,
+			RoamAccounting: w.RoamAccounting,
+			RoamCause:      w.RoamCause,
+		},
+		IPFIX: dev.IPFIX,
+	}
+
+	c.DHCP.ClientMAC = mac
+	c.DHCP.readMACSettingsOptimized(cm)
+	c.DHCPv6.ClientMAC = mac
+	c.DHCPv6.readMACSettingsOptimized(cm)
+	c.ND.ClientMAC = mac
+	c.ND.readMACSettingsOptimized(cm)
+	c.ARP.ClientMAC = mac
+	c.ARP.readMACSettingsOptimized(cm)
+	c.setRadiusIdentity(cm)
+	// The accounting identity of the template is its own
+	c.Accounting.UserName = c.Authentication.UserName
+	c.Accounting.AcctSessionId = ""
+	c.IPFIX.DeviceMAC = mac.String()
+	return c
+}
+
+// loadDevices creates a device for every *.ini file of dir, each one
+// overlaid on the base configuration
+func loadDevices(base *ConfigManager, dir string, ifi *net.Interface) ([]*Device, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.ini"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no device configuration (*.ini) found in %s", dir)
+	}
+
+	var devices []*Device
+	macs := map[string]string{}
+	for _, file := range files {
+		cm, err := base.Overlay(file)
+		if err != nil {
+			return nil, err
+		}
+		dev := NewDevice(strings.TrimSuffix(filepath.Base(file), ".ini"), cm, ifi)
+		if other, exists := macs[dev.ClientMAC.String()]; exists {
+			return nil, fmt.Errorf("devices %s and %s both use MAC %s", other, dev.Name, dev.ClientMAC)
+		}
+		macs[dev.ClientMAC.String()] = dev.Name
+		devices = append(devices, dev)
+	}
+	return devices, nil
+}
+
+// needsRawSocket reports whether the device runs a layer 2 protocol
+func (dev *Device) needsRawSocket() bool {
+	return dev.DHCP.Enabled || dev.DHCPv6.Enabled || dev.ND.Enabled || dev.ARP.Enabled
+}
+
+// Start runs the enabled protocols of the device until the context is
+// cancelled. raw is the socket shared by all devices.
+func (dev *Device) Start(ctx context.Context, raw *RawClient, shutdown *GracefulShutdown) {
+	logger.Info("Starting device %s (%s)", dev.Name, dev.ClientMAC)
+
+	dev.raw = raw
+	dev.reauth = make(chan struct{}, 1)
+	if raw != nil {
+		raw.SetVLAN(dev.ClientMAC, dev.VLAN)
+	}
+
+	var arpClient *ARPClient
+	if dev.ARP.Enabled {
+		fmt.Printf("%s: ARP is enabled\n", dev.Name)
+
+		arpClient = NewARPClient(&dev.ARP, raw)
+		go arpClient.Run(ctx)
+	}
+
+	if dev.DHCP.Enabled {
+		fmt.Printf("%s: DHCP Discovery is enabled\n", dev.Name)
+
+		// Add options
+		var options = Options{}
+
+		// Read options from json file, an invalid entry only loses itself
+		dhcpOptions, err := options.ReadOptions(dev.DHCP.Options)
+		if err != nil {
+			logger.Error("%s: invalid DHCP options, sending the valid ones: %v", dev.Name, err)
+		}
+
+		dhcpClient := NewDHCPClient(&dev.DHCP, raw, dhcpOptions)
+		dev.dhcp = dhcpClient
+		if arpClient != nil {
+			dhcpClient.UseARP(arpClient)
+		}
+		shutdown.Register(dhcpClient.Stop)
+		// Run once the users of the lease are known, below
+	}
+
+	var ndClient *NDClient
+	if dev.ND.Enabled {
+		fmt.Printf("%s: IPv6 Neighbor Discovery is enabled\n", dev.Name)
+
+		ndClient = NewNDClient(&dev.ND, raw)
+		go ndClient.Run(ctx)
+	}
+
+	if dev.DHCPv6.Enabled {
+		fmt.Printf("%s: DHCPv6 is enabled\n", dev.Name)
+
+		dhcpv6Client := NewDHCPv6Client(&dev.DHCPv6, raw)
+		dhcpv6Client.nd = ndClient
+		shutdown.Register(dhcpv6Client.Stop)
+		go dhcpv6Client.Run(ctx)
+	}
+
+	if dev.UPnP.Enabled {
+		fmt.Printf("%s: UPnP Discovery is enabled\n", dev.Name)
+		go dev.runUPnP(ctx)
+	}
+
+	var session *AccountingSession
+	if dev.Accounting.Enabled {
+		fmt.Printf("%s: Radius Accounting is enabled\n", dev.Name)
+
+		// The session starts once the device is authenticated
+		session = NewAccountingSession(&dev.Accounting, dev.Authentication.Enabled)
+		if dev.Wireless.Enabled {
+			session.wireless = &dev.Wireless
+		}
+		dev.session = session
+		shutdown.Register(session.Stop)
+		go session.Run(ctx)
+	}
+
+	if dev.Authentication.Enabled {
+		fmt.Printf("%s: Radius Authentication is enabled\n", dev.Name)
+		go dev.runAuthentication(ctx, session)
+	}
+
+	if dev.Wireless.Enabled {
+		ap := dev.Wireless.AP()
+		fmt.Printf("%s: Wireless client of %s\n", dev.Name, dev.Wireless.calledStationID(ap))
+		if dev.Wireless.RoamInterval > 0 && len(dev.Wireless.APs) > 1 {
+			go dev.runRoaming(ctx)
+		}
+	}
+
+	var leased chan net.IP
+	if dev.IPFIX.Enabled && dev.IPFIX.fromLease && dev.dhcp != nil {
+		leased = make(chan net.IP, 1)
+	}
+	if dev.dhcp != nil {
+		// The lease is the address of the device for accounting and IPFIX
+		dev.dhcp.OnBind = func(addr net.IP) {
+			if session != nil {
+				session.SetAddress(addr)
+			}
+			if leased != nil {
+				select {
+				case <-leased:
+				default:
+				}
+				leased <- addr
+			}
+		}
+		go dev.dhcp.Run(ctx)
+	}
+
+	if dev.IPFIX.Enabled {
+		fmt.Printf("%s: IPFIX is enabled\n", dev.Name)
+		go dev.runIPFIX(ctx, leased)
+	}
+
+	nasSessions.Add(dev)
+}
+
+// Reauthenticate sends an Access-Request now rather than at the next
+// interval
+func (dev *Device) Reauthenticate() {
+	select {
+	case dev.reauth <- struct{}{}:
+	default:
+	}
+}
+
+// Disconnect ends the session of the device with an Accounting-Stop, after
+// which the device authenticates again
+func (dev *Device) Disconnect(cause string) {
+	if dev.session != nil {
+		dev.session.Disconnect(cause)
+	}
+	dev.Reauthenticate()
+}
+
+// runUPnP sends an SSDP search every 30 seconds
+func (dev *Device) runUPnP(ctx context.Context) {
+	u := &dev.UPnP
+	for {
+		u.discover(time.Second * 10)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second * 30):
+		}
+	}
+}
+
+// runRoaming moves the device to the next access point every roam
+// interval. The accounting session reports the roam; without fast roaming
+// the device authenticates again on the new AP.
+func (dev *Device) runRoaming(ctx context.Context) {
+	w := &dev.Wireless
+	ticker := time.NewTicker(w.RoamInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if dev.session != nil {
+			dev.session.Roam()
+		} else {
+			w.roam()
+		}
+		logger.Info("%s: roamed to %s", dev.Name, w.calledStationID(w.AP()))
+		if w.RoamAccounting == roamStopStart {
+			dev.Reauthenticate()
+		}
+	}
+}
+
+// authInterval is the time between Access-Requests when the server sets
+// no Session-Timeout
+const authInterval = 30 * time.Second
+
+// runAuthentication sends a RADIUS Access-Request every authInterval, or
+// at the Session-Timeout of the last Access-Accept, and starts the
+// accounting session, if any, once accepted
+func (dev *Device) runAuthentication(ctx context.Context, session *AccountingSession) {
+	auth := &dev.Authentication
+
+	userName := auth.UserName
+	if auth.EAPMethod != "" {
+		userName = auth.outerIdentity()
+	}
+
+	// Configured attributes first, the device identity takes precedence
+	newRequest := func(secret []byte) *radius.Packet {
+		packet := radius.New(radius.CodeAccessRequest, secret)
+		if err := auth.Attributes.Apply(packet); err != nil {
+			fmt.Printf("Error setting RADIUS attributes: %s\n", err)
+		}
+		rfc2865.UserName_SetString(packet, userName)
+		rfc2865.CallingStationID_SetString(packet, auth.CallingStationId)
+		if dev.Wireless.Enabled {
+			if err := dev.Wireless.apply(packet); err != nil {
+				fmt.Printf("Error setting the access point attributes: %s\n", err)
+			}
+		}
+		return packet
+	}
+
+	// MAC authentication sends one request, failing over between servers.
+	// EAP runs a conversation of several requests with the same server.
+	var supplicant *eapSupplicant
+	var server *RadiusServer
+	if auth.EAPMethod != "" {
+		supplicant = &eapSupplicant{
+			auth: auth,
+			newRequest: func() *radius.Packet {
+				p := newRequest([]byte(server.Secret))
+				p.Del(rfc2865.UserPassword_Type)
+				return p
+			},
+			exchange: func(ctx context.Context, p *radius.Packet) (*radius.Packet, error) {
+				return auth.Servers.ExchangeWith(ctx, server, p)
+			},
+		}
+	}
+
+	for {
+		wait := authInterval
+		var response *radius.Packet
+		var err error
+		if supplicant != nil {
+			if server = auth.Servers.Pick(); server == nil {
+				err = fmt.Errorf("no RADIUS server configured")
+			} else {
+				response, err = supplicant.Authenticate(ctx)
+			}
+		} else {
+			response, err = dev.authenticateMAB(ctx, newRequest)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Printf("Error during RADIUS authentication: %s\n", err)
+		} else {
+			switch response.Code {
+			case radius.CodeAccessAccept:
+				accept := decodeAccessAccept(response)
+				fmt.Printf("%s: Authentication successful: %s\n", dev.Name, accept)
+				dev.authorize(accept)
+				if session != nil {
+					session.Authenticated()
+				}
+				if accept.SessionTimeout > 0 {
+					// Reauthenticate when the session expires
+					wait = accept.SessionTimeout
+				}
+			case radius.CodeAccessReject:
+				messages, _ := rfc2865.ReplyMessage_GetStrings(response)
+				fmt.Printf("%s: Authentication rejected %q\n", dev.Name, messages)
+			default:
+				fmt.Printf("Received unexpected response code: %s\n", response.Code)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-dev.reauth:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// authenticateMAB sends a MAC authentication request built by newRequest.
+// With message_authenticator, the request is signed and the response must
+// be.
+func (dev *Device) authenticateMAB(ctx context.Context, newRequest func(secret []byte) *radius.Packet) (*radius.Packet, error) {
+	auth := &dev.Authentication
+	request, response, err := auth.Servers.Exchange(ctx, func(secret []byte) (*radius.Packet, error) {
+		packet := newRequest(secret)
+		if err := auth.setMABCredentials(packet); err != nil {
+			return nil, err
+		}
+		if auth.MessageAuthenticator {
+			if err := setMessageAuthenticator(packet); err != nil {
+				return nil, err
+			}
+		}
+		return packet, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !verifyMessageAuthenticator(response, request.Authenticator, auth.MessageAuthenticator) {
+		return nil, fmt.Errorf("missing or invalid Message-Authenticator in %s", response.Code)
+	}
+	return response, nil
+}
+
+// authorize enforces an Access-Accept: a VLAN assignment moves the device
+// frames to the new VLAN and restarts DHCP there
+func (dev *Device) authorize(accept *AccessAccept) {
+	id, ok := accept.VLAN()
+	if !ok {
+		if accept.TunnelGroupID != "" {
+			logger.Warn("%s: cannot apply VLAN %q, only numeric 802 VLAN IDs are supported", dev.Name, accept.TunnelGroupID)
+		}
+		return
+	}
+	if id == dev.VLAN.ID || dev.raw == nil {
+		return
+	}
+
+	logger.Info("%s: moving from VLAN %s to VLAN %d", dev.Name, dev.VLAN, id)
+	dev.VLAN.ID = id
+	dev.raw.SetVLAN(dev.ClientMAC, dev.VLAN)
+	if dev.dhcp != nil {
+		dev.dhcp.Restart()
+	}
+}
+
+// runIPFIX exports the configured traffic every 10 seconds. With leased,
+// the export waits for a DHCP lease and the flows of DeviceIP are those of
+// the leased address.
+func (dev *Device) runIPFIX(ctx context.Context, leased <-chan net.IP) {
+	i := &dev.IPFIX
+	traffic, err := i.readIpFixTraffic(i.Traffic)
+	if err != nil {
+		fmt.Printf("Error reading IPFIX traffic: %s", err)
+		return
+	}
+	if leased != nil {
+		select {
+		case <-ctx.Done():
+			return
+		case addr := <-leased:
+			traffic = withDeviceIP(traffic, i.DeviceIP, addr)
+			i.DeviceIP = addr
+		}
+	}
+	exporter, err := ipfixExporters.get(i)
+	if err != nil {
+		fmt.Printf("Error starting the IPFIX exporter: %s\n", err)
+		return
+	}
+	for {
+		records := make([][]byte, len(traffic))
+		for n, t := range traffic {
+			records[n] = i.generateIPFIXRecord(t)
+		}
+		if err := exporter.Export(records); err != nil {
+			fmt.Printf("Error sending IPFIX records: %s\n", err)
+			metrics.IncrementErrors()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case addr := <-leased:
+			// A new lease moves the flows to the new address
+			traffic = withDeviceIP(traffic, i.DeviceIP, addr)
+			i.DeviceIP = addr
+		case <-time.After(time.Second * 10): // Adjust the interval as needed
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+func writeConfig(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testConfigManager loads a configuration of the given content
+func testConfigManager(t *testing.T, content string) *ConfigManager {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.ini")
+	writeConfig(t, path, content)
+
+	cm := &ConfigManager{cache: make(map[string]interface{})}
+	if err := cm.LoadConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	return cm
+}
+
+// TestLoadDevices tests that device files override the main configuration
+// and inherit everything else
+func TestLoadDevices(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "config.ini")
+	writeConfig(t, base, "[general]\nclientmac=90:6c:ac:64:95:c1\n[dhcp]\nenabled=true\nrenew=30\n"+
+		"[accounting]\nUser-Name = 1CC0E1408AA1\nAcct-Session-Id = 4DD66FF4-1CC0E1408AA1-0000914612\n")
+
+	devices := filepath.Join(dir, "devices")
+	os.Mkdir(devices, 0o755)
+	writeConfig(t, filepath.Join(devices, "camera.ini"), "[general]\nclientmac=90:6c:ac:64:95:c2\n")
+	writeConfig(t, filepath.Join(devices, "printer.ini"), "[general]\nclientmac=90:6c:ac:64:95:c3\nvlan=20\n[dhcp]\nrenew=60\n[accounting]\nUser-Name = printer\n")
+
+	ifi := &net.Interface{Name: "test0"}
+	cm := &ConfigManager{cache: make(map[string]interface{})}
+	if err := cm.LoadConfig(base); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := loadDevices(cm, devices, ifi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Name != "camera" || got[1].Name != "printer" {
+		t.Fatalf("unexpected devices %v", got)
+	}
+
+	camera, printer := got[0], got[1]
+	if camera.ClientMAC.String() != "90:6c:ac:64:95:c2" || !camera.DHCP.Enabled || camera.DHCP.Renew != 30*time.Second {
+		t.Errorf("camera did not inherit the main configuration: %s %v %v", camera.ClientMAC, camera.DHCP.Enabled, camera.DHCP.Renew)
+	}
+	if printer.DHCP.Renew != 60*time.Second || printer.VLAN.ID != 20 || camera.VLAN.ID != 0 {
+		t.Errorf("printer overrides not applied: renew %v, vlan %d", printer.DHCP.Renew, printer.VLAN.ID)
+	}
+	if printer.DHCP.ClientMAC.String() != "90:6c:ac:64:95:c3" || printer.Authentication.UserName != "90:6c:ac:64:95:c3" {
+		t.Errorf("printer MAC not propagated: %s %s", printer.DHCP.ClientMAC, printer.Authentication.UserName)
+	}
+
+	// The accounting identity of the main configuration is not inherited
+	if camera.Accounting.UserName != "90:6c:ac:64:95:c2" || camera.Accounting.AcctSessionId != "" ||
+		printer.Accounting.UserName != "printer" || printer.Accounting.AcctSessionId != "" {
+		t.Errorf("accounting identity of camera %s %q, printer %s %q", camera.Accounting.UserName,
+			camera.Accounting.AcctSessionId, printer.Accounting.UserName, printer.Accounting.AcctSessionId)
+	}
+	if main := NewDevice("main", cm, ifi); main.Accounting.UserName != "1CC0E1408AA1" ||
+		main.Accounting.AcctSessionId != "4DD66FF4-1CC0E1408AA1-0000914612" {
+		t.Errorf("accounting identity of the main device %s %q", main.Accounting.UserName, main.Accounting.AcctSessionId)
+	}
+
+	writeConfig(t, filepath.Join(devices, "clone.ini"), "[general]\nclientmac=90:6c:ac:64:95:c2\n")
+	if _, err := loadDevices(cm, devices, ifi); err == nil || !strings.Contains(err.Error(), "both use MAC") {
+		t.Errorf("expected a duplicate MAC error, got %v", err)
+	}
+}
+
+// TestDeviceStartInvalidOptions tests that an invalid DHCP option entry
+// does not keep the device from sending the valid ones
+func TestDeviceStartInvalidOptions(t *testing.T) {
+	c, conn := testDHCPClient()
+	dev := &Device{Name: "camera", ClientMAC: c.iface.ClientMAC, DHCP: *c.iface}
+	dev.DHCP.Enabled = true
+	dev.DHCP.Options = `[{"option": 12, "type": "string", "value": "camera"}, {"option": 3, "type": "ipaddr", "value": "bogus"}]`
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shutdown := NewGracefulShutdown()
+	dev.Start(ctx, c.raw, shutdown)
+	time.Sleep(100 * time.Millisecond)
+	shutdown.Shutdown()
+
+	_, options, ok := sentDHCPType(t, conn, dhcp4.Discover)
+	if !ok {
+		t.Fatal("no DHCPDISCOVER sent")
+	}
+	if string(options[dhcp4.OptionHostName]) != "camera" {
+		t.Errorf("host name %q, expected the valid option", options[dhcp4.OptionHostName])
+	}
+}
@@ -1,13 +1,12 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"strconv"
-	"strings"
 	"time"
 
 	"github.com/krolaw/dhcp4"
@@ -26,13 +25,19 @@ type Interface struct {
 	SrcMac    net.HardwareAddr // Source MAC (Ethernet Header)
 	CiAddr    net.IP           // Client IP (Requesting IP)
 	Options   string
+
+	Inform            bool     // Statically addressed, only send DHCPINFORM
+	ReleaseOnShutdown bool     // Send DHCPRELEASE on graceful shutdown
+	Conflicts         []net.IP // Addresses simulated as already in use (DHCPDECLINE)
+	RelayAgentInfo    []byte   // Encoded option 82 added to every request
 }
 
 // Options Struct
 type Options struct {
-	Option dhcp4.OptionCode `json:"option"`
-	Value  string           `json:"value"`
-	Type   string           `json:"type"`
+	Option     dhcp4.OptionCode `json:"option"`
+	Value      string           `json:"value"`
+	Type       string           `json:"type"`
+	Enterprise uint32           `json:"enterprise,omitempty"` // IANA enterprise number for options 124/125
 }
 
 // Creates a request packet that a Client would send to a server.
@@ -53,45 +58,36 @@ func RequestPacket(mt dhcp4.MessageType, chAddr net.HardwareAddr, giAddr net.IP,
 	return p
 }
 
-func (a *Options) ReadOptions(body string) []dhcp4.Option {
+// ReadOptions decodes the JSON option list and encodes every entry with
+// the encoder for its type. Invalid entries are skipped and reported in
+// the returned error.
+func (a *Options) ReadOptions(body string) ([]dhcp4.Option, error) {
 
 	DHCPOptions := []Options{}
 	var dhcpOptions = []dhcp4.Option{}
 
 	err := json.Unmarshal([]byte(body), &DHCPOptions)
 	if err != nil {
-		fmt.Printf("Error : %s", err)
-		panic(err)
+		return nil, fmt.Errorf("invalid DHCP options JSON: %v", err)
 	}
+
+	var errs []error
 	for _, option := range DHCPOptions {
-		var dhcpOption = dhcp4.Option{}
-		var Value interface{}
-		switch option.Type {
-		case "ipaddr":
-			Value = net.ParseIP(option.Value)
-			dhcpOption.Code = option.Option
-			dhcpOption.Value = Value.(net.IP).To4()
-		case "string":
-			Value = option.Value
-			dhcpOption.Code = option.Option
-			dhcpOption.Value = []byte(Value.(string))
-		case "int":
-			Value = option.Value
-			val, _ := strconv.Atoi(Value.(string))
-			bs := make([]byte, 4)
-			binary.BigEndian.PutUint32(bs, uint32(val))
-			dhcpOption.Code = option.Option
-			dhcpOption.Value = bs
-		case "bytes":
-			dhcpOption.Code = option.Option
-			for _, value := range strings.Split(option.Value, ",") {
-				val, _ := strconv.Atoi(value)
-				dhcpOption.Value = append(dhcpOption.Value, byte(val))
-			}
+		dhcpOption, err := encodeOption(option)
+		if err != nil {
+			errs = append(errs, err)
+			continue
 		}
 		dhcpOptions = append(dhcpOptions, dhcpOption)
 	}
-	return dhcpOptions
+
+	dhcpOptions = mergeEnterpriseOptions(dhcpOptions)
+	for _, o := range dhcpOptions {
+		if len(o.Value) > 255 {
+			errs = append(errs, fmt.Errorf("option %d: merged value is %d bytes, maximum is 255", o.Code, len(o.Value)))
+		}
+	}
+	return dhcpOptions, errors.Join(errs...)
 }
 
 func (d *Interface) readDhcpConfig(config *Config) {
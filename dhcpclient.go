@@ -0,0 +1,665 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// DHCPState is a client state from the RFC 2131 state diagram
+type DHCPState int
+
+const (
+	StateInit DHCPState = iota
+	StateSelecting
+	StateRequesting
+	StateBound
+	StateRenewing
+	StateRebinding
+	StateInitReboot
+	StateRebooting
+	StateInforming
+)
+
+func (s DHCPState) String() string {
+	switch s {
+	case StateInit:
+		return "INIT"
+	case StateSelecting:
+		return "SELECTING"
+	case StateRequesting:
+		return "REQUESTING"
+	case StateBound:
+		return "BOUND"
+	case StateRenewing:
+		return "RENEWING"
+	case StateRebinding:
+		return "REBINDING"
+	case StateInitReboot:
+		return "INIT-REBOOT"
+	case StateRebooting:
+		return "REBOOTING"
+	case StateInforming:
+		return "INFORMING"
+	}
+	return "UNKNOWN"
+}
+
+const (
+	dhcpServerPort = 67
+	dhcpClientPort = 68
+
+	// Retransmission limits (RFC 2131 section 4.1)
+	dhcpMaxRetries     = 4
+	dhcpInitialBackoff = 4 * time.Second
+	dhcpMaxBackoff     = 64 * time.Second
+	dhcpMinRenewWait   = 60 * time.Second
+
+	// Minimum wait after a DHCPDECLINE before restarting (RFC 2131 section 3.1)
+	dhcpDeclineWait = 10 * time.Second
+)
+
+// Lease holds the address and timers handed out by the DHCP server
+type Lease struct {
+	Address  net.IP
+	ServerID net.IP
+	Duration time.Duration
+	T1       time.Duration
+	T2       time.Duration
+	Acquired time.Time
+	Options  dhcp4.Options
+}
+
+// renewAt returns the time the client must enter RENEWING
+func (l *Lease) renewAt() time.Time { return l.Acquired.Add(l.T1) }
+
+// rebindAt returns the time the client must enter REBINDING
+func (l *Lease) rebindAt() time.Time { return l.Acquired.Add(l.T2) }
+
+// expiresAt returns the time the lease is lost
+func (l *Lease) expiresAt() time.Time { return l.Acquired.Add(l.Duration) }
+
+// DHCPClient drives a simulated device through the DHCP client lifecycle
+type DHCPClient struct {
+	iface   *Interface
+	raw     *RawClient
+	options []dhcp4.Option
+	arp     *ARPClient // Probes and defends the leased address, if set
+
+	// OnBind is called from the client goroutine with the address of
+	// every lease bound or renewed
+	OnBind func(net.IP)
+
+	state     DHCPState
+	xid       []byte
+	attempt   int
+	offer     dhcp4.Packet
+	lease     *Lease
+	replies   chan dhcp4.Packet
+	conflicts chan net.IP
+	restart   chan struct{}
+	lastSent  time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewDHCPClient creates a DHCP client for the configured interface
+func NewDHCPClient(d *Interface, raw *RawClient, options []dhcp4.Option) *DHCPClient {
+	return &DHCPClient{
+		iface:     d,
+		raw:       raw,
+		options:   options,
+		state:     StateInit,
+		replies:   make(chan dhcp4.Packet, 16),
+		conflicts: make(chan net.IP, 1),
+		restart:   make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// UseARP makes the client claim its leases through arp and decline the
+// addresses found in use by the ARP probes
+func (c *DHCPClient) UseARP(arp *ARPClient) {
+	c.arp = arp
+	arp.OnConflict = func(addr net.IP) {
+		select {
+		case c.conflicts <- addr:
+		default:
+		}
+	}
+}
+
+// Restart makes the client start over as on a new network, e.g. after the
+// device was moved to another VLAN
+func (c *DHCPClient) Restart() {
+	select {
+	case c.restart <- struct{}{}:
+	default:
+	}
+}
+
+// State returns the current client state
+func (c *DHCPClient) State() DHCPState {
+	return c.state
+}
+
+// deliver hands a server reply to the state machine, dropping it if the
+// client is not keeping up
+func (c *DHCPClient) deliver(p dhcp4.Packet) {
+	select {
+	case c.replies <- p:
+	default:
+		logger.Warn("DHCP reply queue full for %s, dropping packet", c.iface.ClientMAC)
+	}
+}
+
+// Stop shuts the client down gracefully, releasing the lease first when
+// configured to. It is meant to be registered with GracefulShutdown.
+func (c *DHCPClient) Stop() error {
+	select {
+	case c.stop <- struct{}{}:
+		<-c.done
+	case <-c.done:
+	}
+	return nil
+}
+
+// Run executes the DHCP state machine until the context is cancelled or
+// the client is stopped
+func (c *DHCPClient) Run(ctx context.Context) {
+	defer close(c.done)
+
+	switch {
+	case c.iface.Inform:
+		// Statically addressed devices only ask for configuration
+		c.state = StateInforming
+	case c.iface.CiAddr != nil && !c.iface.CiAddr.Equal(net.IPv4zero):
+		// A configured ciaddr is treated as a previously allocated address
+		c.state = StateInitReboot
+	}
+
+	c.raw.HandleDHCP(c.iface.ClientMAC, c.deliver)
+	defer c.raw.RemoveDHCP(c.iface.ClientMAC)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			if c.iface.ReleaseOnShutdown {
+				c.release()
+			}
+			return
+		case reply := <-c.replies:
+			if wait, handled := c.handleReply(reply); handled {
+				resetTimer(timer, wait)
+			}
+		case addr := <-c.conflicts:
+			if c.lease != nil && c.lease.Address.Equal(addr) {
+				c.decline(addr, c.lease.ServerID)
+				resetTimer(timer, dhcpDeclineWait)
+			}
+		case <-c.restart:
+			// The lease belongs to the previous network, discover a new one
+			if c.state != StateInforming {
+				c.dropLease()
+				c.setState(StateInit)
+			}
+			resetTimer(timer, 0)
+		case <-timer.C:
+			resetTimer(timer, c.handleTimeout())
+		}
+	}
+}
+
+// handleTimeout performs the action due in the current state and returns
+// the time to wait before the next timeout
+func (c *DHCPClient) handleTimeout() time.Duration {
+	switch c.state {
+	case StateInit:
+		c.newTransaction()
+		c.setState(StateSelecting)
+		c.sendDiscover()
+		return retransmitDelay(c.attempt)
+
+	case StateSelecting:
+		c.attempt++
+		if c.attempt > dhcpMaxRetries {
+			c.setState(StateInit)
+			return 0
+		}
+		c.sendDiscover()
+		return retransmitDelay(c.attempt)
+
+	case StateRequesting:
+		c.attempt++
+		if c.attempt > dhcpMaxRetries {
+			logger.Warn("No answer to DHCPREQUEST for %s, restarting discovery", c.offer.YIAddr())
+			c.setState(StateInit)
+			return 0
+		}
+		c.sendRequest(c.offer.YIAddr(), serverIdentifier(c.offer.ParseOptions()), nil)
+		return retransmitDelay(c.attempt)
+
+	case StateInitReboot:
+		c.newTransaction()
+		c.setState(StateRebooting)
+		c.sendRequest(c.iface.CiAddr, nil, nil)
+		return retransmitDelay(c.attempt)
+
+	case StateRebooting:
+		c.attempt++
+		if c.attempt > dhcpMaxRetries {
+			c.setState(StateInit)
+			return 0
+		}
+		c.sendRequest(c.iface.CiAddr, nil, nil)
+		return retransmitDelay(c.attempt)
+
+	case StateBound:
+		c.newTransaction()
+		c.setState(StateRenewing)
+		c.sendRequest(nil, nil, c.lease.Address)
+		return renewWait(c.lease.rebindAt())
+
+	case StateRenewing:
+		if !time.Now().Before(c.lease.rebindAt()) {
+			c.newTransaction()
+			c.setState(StateRebinding)
+		}
+		c.sendRequest(nil, nil, c.lease.Address)
+		if c.state == StateRebinding {
+			return renewWait(c.lease.expiresAt())
+		}
+		return renewWait(c.lease.rebindAt())
+
+	case StateRebinding:
+		if !time.Now().Before(c.lease.expiresAt()) {
+			logger.Warn("DHCP lease for %s expired", c.lease.Address)
+			c.dropLease()
+			c.setState(StateInit)
+			return 0
+		}
+		c.sendRequest(nil, nil, c.lease.Address)
+		return renewWait(c.lease.expiresAt())
+
+	case StateInforming:
+		c.newTransaction()
+		c.send(dhcp4.Inform, c.iface.CiAddr, nil, c.iface.ServerIP != nil && !c.iface.ServerIP.IsUnspecified())
+		return c.iface.Renew
+	}
+	return c.iface.Renew
+}
+
+// handleReply processes a server reply and reports whether it changed the
+// state, along with the time to wait before the next timeout
+func (c *DHCPClient) handleReply(p dhcp4.Packet) (time.Duration, bool) {
+	if len(p) < 240 || p.OpCode() != dhcp4.BootReply {
+		return 0, false
+	}
+	if c.xid == nil || !bytes.Equal(p.XId(), c.xid) {
+		return 0, false
+	}
+	if !bytes.Equal(p.CHAddr(), c.iface.ClientMAC) {
+		return 0, false
+	}
+
+	options := p.ParseOptions()
+	msgType := messageType(options)
+	metrics.IncrementDHCPReply()
+	reportDHCPReply(p, options)
+
+	switch c.state {
+	case StateSelecting:
+		if msgType != dhcp4.Offer {
+			return 0, false
+		}
+		c.offer = p
+		c.attempt = 0
+		c.setState(StateRequesting)
+		c.sendRequest(p.YIAddr(), serverIdentifier(options), nil)
+		return retransmitDelay(c.attempt), true
+
+	case StateRequesting, StateRebooting, StateRenewing, StateRebinding:
+		switch msgType {
+		case dhcp4.ACK:
+			if c.iface.conflicts(p.YIAddr()) {
+				c.decline(p.YIAddr(), serverIdentifier(options))
+				return dhcpDeclineWait, true
+			}
+			c.bind(p, options)
+			return time.Until(c.lease.renewAt()), true
+		case dhcp4.NAK:
+			logger.Warn("DHCPNAK from %s in state %s", serverIdentifier(options), c.state)
+			c.dropLease()
+			c.setState(StateInit)
+			return 0, true
+		}
+
+	case StateInforming:
+		if msgType == dhcp4.ACK {
+			// Nothing to bind, the options were reported above
+			c.xid = nil
+			return c.iface.Renew, true
+		}
+	}
+	return 0, false
+}
+
+// bind records the lease carried by an ACK and enters BOUND
+func (c *DHCPClient) bind(p dhcp4.Packet, options dhcp4.Options) {
+	lease := &Lease{
+		Address:  append(net.IP(nil), p.YIAddr().To4()...),
+		ServerID: serverIdentifier(options),
+		Acquired: c.lastSent,
+		Options:  options,
+	}
+
+	lease.Duration = optionSeconds(options, dhcp4.OptionIPAddressLeaseTime)
+	if lease.Duration == 0 {
+		// No lease time from the server, fall back to the configured renewal
+		lease.Duration = 2 * c.iface.Renew
+	}
+	lease.T1 = optionSeconds(options, dhcp4.OptionRenewalTimeValue)
+	if lease.T1 == 0 {
+		lease.T1 = lease.Duration / 2
+	}
+	lease.T2 = optionSeconds(options, dhcp4.OptionRebindingTimeValue)
+	if lease.T2 == 0 {
+		lease.T2 = lease.Duration * 7 / 8
+	}
+
+	c.lease = lease
+	c.attempt = 0
+	c.setState(StateBound)
+	metrics.IncrementDHCPLease()
+	if c.arp != nil {
+		c.arp.Claim(lease.Address)
+	}
+	if c.OnBind != nil {
+		c.OnBind(lease.Address)
+	}
+	logger.Info("DHCPACK: %s bound to %s (lease %v, T1 %v, T2 %v)",
+		c.iface.ClientMAC, lease.Address, lease.Duration, lease.T1, lease.T2)
+}
+
+// dropLease forgets the current lease and stops answering ARP for it
+func (c *DHCPClient) dropLease() {
+	c.lease = nil
+	if c.arp != nil {
+		c.arp.Claim(nil)
+	}
+}
+
+// decline tells the server an acknowledged address is already in use and
+// returns to INIT
+func (c *DHCPClient) decline(addr net.IP, serverID net.IP) {
+	logger.Warn("Address %s is in use, sending DHCPDECLINE", addr)
+	extra := []dhcp4.Option{{Code: dhcp4.OptionRequestedIPAddress, Value: addr.To4()}}
+	if serverID != nil {
+		extra = append(extra, dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: serverID.To4()})
+	}
+	c.send(dhcp4.Decline, nil, extra, false)
+	c.dropLease()
+	c.setState(StateInit)
+}
+
+// release gives the current lease back to the server
+func (c *DHCPClient) release() {
+	if c.lease == nil {
+		return
+	}
+	logger.Info("Releasing %s for %s", c.lease.Address, c.iface.ClientMAC)
+	c.newTransaction()
+	var extra []dhcp4.Option
+	if c.lease.ServerID != nil {
+		extra = append(extra, dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: c.lease.ServerID.To4()})
+	}
+	c.send(dhcp4.Release, c.lease.Address, extra, true)
+	c.dropLease()
+	c.setState(StateInit)
+}
+
+// sendDiscover broadcasts a DHCPDISCOVER for the current transaction
+func (c *DHCPClient) sendDiscover() {
+	c.send(dhcp4.Discover, nil, nil, false)
+}
+
+// sendRequest sends a DHCPREQUEST. requestedIP and serverID are set when
+// selecting or rebooting; ciaddr is set when renewing or rebinding.
+func (c *DHCPClient) sendRequest(requestedIP net.IP, serverID net.IP, ciaddr net.IP) {
+	var extra []dhcp4.Option
+	if requestedIP != nil {
+		extra = append(extra, dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: requestedIP.To4()})
+	}
+	if serverID != nil {
+		extra = append(extra, dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: serverID.To4()})
+	}
+	c.send(dhcp4.Request, ciaddr, extra, c.state == StateRenewing)
+}
+
+// send builds and transmits a client message for the current transaction. Unicast messages go
+// straight to the server, everything else is broadcast unless the
+// simulator is acting as a relay agent.
+func (c *DHCPClient) send(mt dhcp4.MessageType, ciaddr net.IP, extra []dhcp4.Option, unicast bool) {
+	d := c.iface
+
+	options := append([]dhcp4.Option{}, extra...)
+	for _, o := range c.options {
+		// DECLINE and RELEASE only carry the client identifier (RFC 2131 table 5)
+		if (mt == dhcp4.Decline || mt == dhcp4.Release) && o.Code != dhcp4.OptionClientIdentifier {
+			continue
+		}
+		options = append(options, o)
+	}
+	if len(d.RelayAgentInfo) > 0 {
+		// Relay agents append option 82 after the client's options
+		options = append(options, dhcp4.Option{Code: dhcp4.OptionRelayAgentInformation, Value: d.RelayAgentInfo})
+	}
+	packet := RequestPacket(mt, d.ClientMAC, d.GiAddr, ciaddr, c.xid, isBroadcastMAC(d.DstMac), options)
+
+	srcIP, dstIP := net.IPv4zero, net.IPv4bcast
+	srcPort, dstPort := dhcpClientPort, dhcpServerPort
+	switch {
+	case d.relay():
+		// Relay agents talk to the server from server port to server port
+		srcIP, dstIP = d.GiAddr, d.ServerIP
+		srcPort = dhcpServerPort
+	case unicast:
+		srcIP, dstIP = ciaddr, d.ServerIP
+		if c.lease != nil && c.lease.ServerID != nil {
+			dstIP = c.lease.ServerID
+		}
+	}
+
+	c.lastSent = time.Now()
+	if err := c.raw.sendDHCP(d.ClientMAC, d.DstMac, d.SrcMac, packet, dstIP, srcIP, srcPort, dstPort); err != nil {
+		logger.Error("Failed to send DHCP%s for %s: %v", messageTypeName(mt), d.ClientMAC, err)
+		metrics.IncrementErrors()
+		return
+	}
+	metrics.IncrementDHCP()
+	logger.Debug("Sent DHCP%s xid=%x state=%s", messageTypeName(mt), c.xid, c.state)
+}
+
+// newTransaction starts a new exchange with a fresh transaction ID
+func (c *DHCPClient) newTransaction() {
+	c.xid = make([]byte, 4)
+	rand.Read(c.xid)
+	c.attempt = 0
+}
+
+func (c *DHCPClient) setState(s DHCPState) {
+	if c.state != s {
+		logger.Debug("DHCP %s: %s -> %s", c.iface.ClientMAC, c.state, s)
+	}
+	c.state = s
+}
+
+// conflicts reports whether addr is configured as already in use on the
+// simulated network
+func (d *Interface) conflicts(addr net.IP) bool {
+	for _, ip := range d.Conflicts {
+		if ip.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// relay reports whether the simulator is acting as a relay agent
+func (d *Interface) relay() bool {
+	return d.GiAddr != nil && !d.GiAddr.Equal(net.IPv4zero)
+}
+
+// retransmitDelay returns the RFC 2131 exponential backoff for an attempt,
+// randomized by +/- one second
+func retransmitDelay(attempt int) time.Duration {
+	delay := dhcpInitialBackoff << uint(attempt)
+	if delay > dhcpMaxBackoff {
+		delay = dhcpMaxBackoff
+	}
+	jitter, _ := rand.Int(rand.Reader, big.NewInt(2001))
+	return delay + time.Duration(jitter.Int64()-1000)*time.Millisecond
+}
+
+// renewWait returns how long to wait in RENEWING or REBINDING: half the
+// remaining time to the deadline, down to a minimum of 60 seconds
+func renewWait(deadline time.Time) time.Duration {
+	remaining := time.Until(deadline)
+	wait := remaining / 2
+	if wait < dhcpMinRenewWait {
+		wait = dhcpMinRenewWait
+	}
+	if remaining > 0 && wait > remaining {
+		wait = remaining
+	}
+	return wait
+}
+
+// resetTimer stops, drains and re-arms a timer
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	if d < 0 {
+		d = 0
+	}
+	t.Reset(d)
+}
+
+func messageType(options dhcp4.Options) dhcp4.MessageType {
+	if v, ok := options[dhcp4.OptionDHCPMessageType]; ok && len(v) == 1 {
+		return dhcp4.MessageType(v[0])
+	}
+	return 0
+}
+
+func messageTypeName(mt dhcp4.MessageType) string {
+	switch mt {
+	case dhcp4.Discover:
+		return "DISCOVER"
+	case dhcp4.Offer:
+		return "OFFER"
+	case dhcp4.Request:
+		return "REQUEST"
+	case dhcp4.Decline:
+		return "DECLINE"
+	case dhcp4.ACK:
+		return "ACK"
+	case dhcp4.NAK:
+		return "NAK"
+	case dhcp4.Release:
+		return "RELEASE"
+	case dhcp4.Inform:
+		return "INFORM"
+	}
+	return mt.String()
+}
+
+func serverIdentifier(options dhcp4.Options) net.IP {
+	if v, ok := options[dhcp4.OptionServerIdentifier]; ok && len(v) == 4 {
+		return net.IP(v)
+	}
+	return nil
+}
+
+func optionSeconds(options dhcp4.Options, code dhcp4.OptionCode) time.Duration {
+	if v, ok := options[code]; ok && len(v) == 4 {
+		return time.Duration(binary.BigEndian.Uint32(v)) * time.Second
+	}
+	return 0
+}
+
+// reportDHCPReply logs the address, lease and options carried by a reply
+func reportDHCPReply(p dhcp4.Packet, options dhcp4.Options) {
+	logger.Info("DHCP%s xid=%x for %s: address %s, server %s, lease %v",
+		messageTypeName(messageType(options)), p.XId(), p.CHAddr(), p.YIAddr(),
+		serverIdentifier(options), optionSeconds(options, dhcp4.OptionIPAddressLeaseTime))
+
+	codes := make([]int, 0, len(options))
+	for code := range options {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	fields := make([]string, 0, len(codes))
+	for _, code := range codes {
+		fields = append(fields, fmt.Sprintf("%d(%s)=%s",
+			code, dhcp4.OptionCode(code), formatDHCPOption(dhcp4.OptionCode(code), options[dhcp4.OptionCode(code)])))
+	}
+	logger.Info("DHCP options: %s", strings.Join(fields, " "))
+}
+
+// formatDHCPOption renders an option value according to its usual type
+func formatDHCPOption(code dhcp4.OptionCode, value []byte) string {
+	switch code {
+	case dhcp4.OptionSubnetMask, dhcp4.OptionRouter, dhcp4.OptionDomainNameServer,
+		dhcp4.OptionTimeServer, dhcp4.OptionNameServer, dhcp4.OptionLogServer,
+		dhcp4.OptionBroadcastAddress, dhcp4.OptionServerIdentifier,
+		dhcp4.OptionRequestedIPAddress, dhcp4.OptionNetworkTimeProtocolServers,
+		dhcp4.OptionNetBIOSOverTCPIPNameServer:
+		if len(value)%4 == 0 && len(value) > 0 {
+			ips := make([]string, 0, len(value)/4)
+			for i := 0; i < len(value); i += 4 {
+				ips = append(ips, net.IP(value[i:i+4]).String())
+			}
+			return strings.Join(ips, ",")
+		}
+	case dhcp4.OptionIPAddressLeaseTime, dhcp4.OptionRenewalTimeValue, dhcp4.OptionRebindingTimeValue:
+		if len(value) == 4 {
+			return (time.Duration(binary.BigEndian.Uint32(value)) * time.Second).String()
+		}
+	case dhcp4.OptionDHCPMessageType:
+		if len(value) == 1 {
+			return messageTypeName(dhcp4.MessageType(value[0]))
+		}
+	case dhcp4.OptionHostName, dhcp4.OptionDomainName, dhcp4.OptionMessage,
+		dhcp4.OptionVendorClassIdentifier, dhcp4.OptionTFTPServerName, dhcp4.OptionBootFileName:
+		return fmt.Sprintf("%q", string(value))
+	}
+	return fmt.Sprintf("%x", value)
+}
+
+func isBroadcastMAC(mac net.HardwareAddr) bool {
+	return bytes.Equal(mac, ethernetBroadcast)
+}
+
+var ethernetBroadcast = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+	"github.com/mdlayher/ethernet"
+)
+
+var (
+	testDHCPServer = net.ParseIP("10.10.1.1").To4()
+	testDHCPOffer  = net.ParseIP("10.10.1.22").To4()
+)
+
+// newTestRawClient returns a raw client writing its frames to conn
+func newTestRawClient(conn net.PacketConn) *RawClient {
+	return &RawClient{
+		ifi:    &net.Interface{Name: "test0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}},
+		p:      conn,
+		dhcp:   make(map[string]func(dhcp4.Packet)),
+		dhcpv6: make(map[string]func(*dhcpv6Message)),
+		icmpv6: make(map[string]icmpv6Handler),
+		arp:    make(map[string]func(*arpPacket)),
+		vlans:  make(map[string]VLAN),
+	}
+}
+
+// testDHCPClient returns a client of a broadcasting device and the
+// connection capturing the messages it sends
+func testDHCPClient() (*DHCPClient, *capturePacketConn) {
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	iface := &Interface{
+		ServerIP:  testDHCPServer,
+		DstMac:    ethernetBroadcast,
+		Renew:     time.Hour,
+		ClientMAC: mac,
+		GiAddr:    net.IPv4zero,
+		SrcMac:    mac,
+		CiAddr:    net.IPv4zero,
+	}
+	conn := &capturePacketConn{}
+	return NewDHCPClient(iface, newTestRawClient(conn), nil), conn
+}
+
+// sentDHCP decodes the last DHCP message the client sent
+func sentDHCP(t *testing.T, conn *capturePacketConn) (dhcp4.Packet, dhcp4.Options) {
+	t.Helper()
+	if len(conn.frames) == 0 {
+		t.Fatal("no DHCP message sent")
+	}
+	return decodeDHCPFrame(t, conn.frames[len(conn.frames)-1])
+}
+
+// sentDHCPType decodes the last message of type mt the client sent, if any
+func sentDHCPType(t *testing.T, conn *capturePacketConn, mt dhcp4.MessageType) (dhcp4.Packet, dhcp4.Options, bool) {
+	t.Helper()
+	for n := len(conn.frames) - 1; n >= 0; n-- {
+		if p, options := decodeDHCPFrame(t, conn.frames[n]); messageType(options) == mt {
+			return p, options, true
+		}
+	}
+	return nil, nil, false
+}
+
+func decodeDHCPFrame(t *testing.T, frame []byte) (dhcp4.Packet, dhcp4.Options) {
+	t.Helper()
+	var f ethernet.Frame
+	if err := f.UnmarshalBinary(frame); err != nil {
+		t.Fatalf("invalid frame: %v", err)
+	}
+	_, _, _, dstPort, payload, ok := parseUDP(f.Payload)
+	if !ok || dstPort != dhcpServerPort {
+		t.Fatalf("not a DHCP message to the server: % x", f.Payload)
+	}
+	p := dhcp4.Packet(payload)
+	return p, p.ParseOptions()
+}
+
+// serverReply returns the reply of the test server to the last message
+// the client sent
+func serverReply(t *testing.T, conn *capturePacketConn, mt dhcp4.MessageType, lease time.Duration, options ...dhcp4.Option) dhcp4.Packet {
+	t.Helper()
+	req, _ := sentDHCP(t, conn)
+	return dhcp4.ReplyPacket(req, mt, testDHCPServer, testDHCPOffer, lease, options)
+}
+
+// driveDHCPClient takes a new client to state through the exchanges of a
+// server offering testDHCPOffer for an hour
+func driveDHCPClient(t *testing.T, c *DHCPClient, conn *capturePacketConn, state DHCPState) {
+	t.Helper()
+	steps := []func(){
+		func() { c.handleTimeout() },
+		func() { c.handleReply(serverReply(t, conn, dhcp4.Offer, 0)) },
+		func() { c.handleReply(serverReply(t, conn, dhcp4.ACK, time.Hour)) },
+		func() { c.handleTimeout() },
+		func() {
+			// T2 is over while renewing
+			c.lease.Acquired = time.Now().Add(-c.lease.T2 - time.Second)
+			c.handleTimeout()
+		},
+	}
+	for _, step := range steps {
+		if c.state == state {
+			return
+		}
+		step()
+	}
+	if c.state != state {
+		t.Fatalf("client in state %s, expected %s", c.state, state)
+	}
+}
+
+// TestDHCPClientStateMachine tests the RFC 2131 transitions on server
+// replies and timeouts
+func TestDHCPClientStateMachine(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		start DHCPState
+		event func(t *testing.T, c *DHCPClient, conn *capturePacketConn)
+		want  DHCPState
+		lease bool
+		check func(t *testing.T, c *DHCPClient, conn *capturePacketConn)
+	}{{
+		name:  "offer",
+		start: StateSelecting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.handleReply(serverReply(t, conn, dhcp4.Offer, time.Hour))
+		},
+		want: StateRequesting,
+		check: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			p, options := sentDHCP(t, conn)
+			if messageType(options) != dhcp4.Request || !p.CIAddr().Equal(net.IPv4zero) {
+				t.Errorf("sent DHCP%s with ciaddr %s, expected a REQUEST", messageTypeName(messageType(options)), p.CIAddr())
+			}
+			if !net.IP(options[dhcp4.OptionRequestedIPAddress]).Equal(testDHCPOffer) ||
+				!net.IP(options[dhcp4.OptionServerIdentifier]).Equal(testDHCPServer) {
+				t.Errorf("requested address %v, server identifier %v", options[dhcp4.OptionRequestedIPAddress], options[dhcp4.OptionServerIdentifier])
+			}
+		},
+	}, {
+		name:  "ack with default timers",
+		start: StateRequesting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.handleReply(serverReply(t, conn, dhcp4.ACK, time.Hour))
+		},
+		want:  StateBound,
+		lease: true,
+		check: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			l := c.lease
+			if !l.Address.Equal(testDHCPOffer) || !l.ServerID.Equal(testDHCPServer) || l.Duration != time.Hour {
+				t.Errorf("lease of %s from %s for %v", l.Address, l.ServerID, l.Duration)
+			}
+			if l.T1 != 30*time.Minute || l.T2 != 52*time.Minute+30*time.Second {
+				t.Errorf("T1 %v, T2 %v, expected half and 7/8 of the lease", l.T1, l.T2)
+			}
+		},
+	}, {
+		name:  "ack with timers",
+		start: StateRequesting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.handleReply(serverReply(t, conn, dhcp4.ACK, time.Hour,
+				dhcp4.Option{Code: dhcp4.OptionRenewalTimeValue, Value: dhcp4.OptionsLeaseTime(20 * time.Minute)},
+				dhcp4.Option{Code: dhcp4.OptionRebindingTimeValue, Value: dhcp4.OptionsLeaseTime(40 * time.Minute)}))
+		},
+		want:  StateBound,
+		lease: true,
+		check: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			if c.lease.T1 != 20*time.Minute || c.lease.T2 != 40*time.Minute {
+				t.Errorf("T1 %v, T2 %v, expected the server timers", c.lease.T1, c.lease.T2)
+			}
+		},
+	}, {
+		name:  "nak while requesting",
+		start: StateRequesting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.handleReply(serverReply(t, conn, dhcp4.NAK, 0))
+		},
+		want: StateInit,
+	}, {
+		name:  "nak while renewing",
+		start: StateRenewing,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.handleReply(serverReply(t, conn, dhcp4.NAK, 0))
+		},
+		want: StateInit,
+	}, {
+		name:  "wrong xid",
+		start: StateRequesting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			p := serverReply(t, conn, dhcp4.ACK, time.Hour)
+			p.SetXId([]byte{0xde, 0xad, 0xbe, 0xef})
+			c.handleReply(p)
+		},
+		want: StateRequesting,
+	}, {
+		name:  "wrong chaddr",
+		start: StateRequesting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			p := serverReply(t, conn, dhcp4.ACK, time.Hour)
+			p.SetCHAddr(net.HardwareAddr{0x90, 0x6c, 0xac, 0x64, 0x95, 0xc2})
+			c.handleReply(p)
+		},
+		want: StateRequesting,
+	}, {
+		name:  "renew on T1",
+		start: StateBound,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.handleTimeout()
+		},
+		want:  StateRenewing,
+		lease: true,
+		check: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			if p, options := sentDHCP(t, conn); messageType(options) != dhcp4.Request || !p.CIAddr().Equal(testDHCPOffer) {
+				t.Errorf("sent DHCP%s with ciaddr %s, expected a REQUEST from the lease", messageTypeName(messageType(options)), p.CIAddr())
+			}
+		},
+	}, {
+		name:  "rebinding past expiry",
+		start: StateRebinding,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			c.lease.Acquired = time.Now().Add(-c.lease.Duration - time.Second)
+			c.handleTimeout()
+		},
+		want: StateInit,
+	}, {
+		name:  "selecting retries",
+		start: StateSelecting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			for n := 0; n < dhcpMaxRetries; n++ {
+				if c.handleTimeout(); c.state != StateSelecting {
+					t.Fatalf("gave up after %d retransmissions", n+1)
+				}
+			}
+			c.handleTimeout()
+		},
+		want: StateInit,
+	}, {
+		name:  "requesting retries",
+		start: StateRequesting,
+		event: func(t *testing.T, c *DHCPClient, conn *capturePacketConn) {
+			for n := 0; n < dhcpMaxRetries; n++ {
+				if c.handleTimeout(); c.state != StateRequesting {
+					t.Fatalf("gave up after %d retransmissions", n+1)
+				}
+			}
+			c.handleTimeout()
+		},
+		want: StateInit,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, conn := testDHCPClient()
+			driveDHCPClient(t, c, conn, tc.start)
+			tc.event(t, c, conn)
+			if c.state != tc.want || (c.lease != nil) != tc.lease {
+				t.Fatalf("state %s with lease %v, expected %s with lease %v", c.state, c.lease != nil, tc.want, tc.lease)
+			}
+			if tc.check != nil {
+				tc.check(t, c, conn)
+			}
+		})
+	}
+}
+
+// TestDHCPDecline tests that an acknowledged address found in use is
+// declined before discovering again
+func TestDHCPDecline(t *testing.T) {
+	c, conn := testDHCPClient()
+	c.iface.Conflicts = []net.IP{testDHCPOffer}
+	driveDHCPClient(t, c, conn, StateRequesting)
+
+	wait, handled := c.handleReply(serverReply(t, conn, dhcp4.ACK, time.Hour))
+	if !handled || wait != dhcpDeclineWait {
+		t.Errorf("handled %v, waiting %v before restarting, expected %v", handled, wait, dhcpDeclineWait)
+	}
+	if c.state != StateInit || c.lease != nil {
+		t.Errorf("state %s with lease %v after declining", c.state, c.lease)
+	}
+
+	p, options := sentDHCP(t, conn)
+	if messageType(options) != dhcp4.Decline || !p.CIAddr().Equal(net.IPv4zero) {
+		t.Fatalf("sent DHCP%s with ciaddr %s, expected a DECLINE", messageTypeName(messageType(options)), p.CIAddr())
+	}
+	if !net.IP(options[dhcp4.OptionRequestedIPAddress]).Equal(testDHCPOffer) ||
+		!net.IP(options[dhcp4.OptionServerIdentifier]).Equal(testDHCPServer) {
+		t.Errorf("declined address %v, server identifier %v", options[dhcp4.OptionRequestedIPAddress], options[dhcp4.OptionServerIdentifier])
+	}
+}
+
+// TestDHCPConflict tests that an ARP conflict on the leased address is
+// declined by the running client
+func TestDHCPConflict(t *testing.T) {
+	c, conn := testDHCPClient()
+	driveDHCPClient(t, c, conn, StateBound)
+	go c.Run(context.Background())
+
+	// The second report is taken once the loop received the first one,
+	// which it handles before the stop
+	c.conflicts <- testDHCPOffer
+	c.conflicts <- testDHCPOffer
+	c.Stop()
+
+	if c.state != StateInit || c.lease != nil {
+		t.Errorf("state %s with lease %v after the conflict", c.state, c.lease)
+	}
+	_, options, ok := sentDHCPType(t, conn, dhcp4.Decline)
+	if !ok {
+		t.Fatal("no DHCPDECLINE sent")
+	}
+	if !net.IP(options[dhcp4.OptionRequestedIPAddress]).Equal(testDHCPOffer) ||
+		!net.IP(options[dhcp4.OptionServerIdentifier]).Equal(testDHCPServer) {
+		t.Errorf("declined address %v, server identifier %v", options[dhcp4.OptionRequestedIPAddress], options[dhcp4.OptionServerIdentifier])
+	}
+}
+
+// TestDHCPReleaseOnShutdown tests that stopping the client releases its
+// lease only when configured to
+func TestDHCPReleaseOnShutdown(t *testing.T) {
+	for _, release := range []bool{true, false} {
+		c, conn := testDHCPClient()
+		c.iface.ReleaseOnShutdown = release
+		driveDHCPClient(t, c, conn, StateBound)
+		go c.Run(context.Background())
+		c.Stop()
+
+		p, options, sent := sentDHCPType(t, conn, dhcp4.Release)
+		if sent != release {
+			t.Errorf("release_on_shutdown %v: DHCPRELEASE sent %v", release, sent)
+			continue
+		}
+		if !release {
+			continue
+		}
+		if !p.CIAddr().Equal(testDHCPOffer) || !net.IP(options[dhcp4.OptionServerIdentifier]).Equal(testDHCPServer) {
+			t.Errorf("released %s to %v", p.CIAddr(), options[dhcp4.OptionServerIdentifier])
+		}
+		if c.lease != nil {
+			t.Error("lease kept after the release")
+		}
+	}
+}
+
+// TestDHCPInform tests that statically addressed devices get their
+// configuration without binding a lease
+func TestDHCPInform(t *testing.T) {
+	c, conn := testDHCPClient()
+	c.iface.Inform = true
+	c.iface.CiAddr = net.ParseIP("10.10.1.50").To4()
+	c.state = StateInforming
+
+	c.handleTimeout()
+	p, options := sentDHCP(t, conn)
+	if messageType(options) != dhcp4.Inform || !p.CIAddr().Equal(c.iface.CiAddr) {
+		t.Fatalf("sent DHCP%s with ciaddr %s, expected an INFORM", messageTypeName(messageType(options)), p.CIAddr())
+	}
+
+	ack := serverReply(t, conn, dhcp4.ACK, time.Hour)
+	wait, handled := c.handleReply(ack)
+	if !handled || wait != c.iface.Renew {
+		t.Errorf("handled %v, next INFORM in %v", handled, wait)
+	}
+	if c.state != StateInforming || c.lease != nil {
+		t.Errorf("state %s with lease %v after the ACK", c.state, c.lease)
+	}
+	if _, handled := c.handleReply(ack); handled {
+		t.Error("ACK handled twice")
+	}
+}
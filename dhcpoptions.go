@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// optionEncoder turns the textual value of an Options entry into the
+// option payload
+type optionEncoder func(option Options) ([]byte, error)
+
+// optionEncoders maps the "type" of an Options entry to its encoder
+var optionEncoders = map[string]optionEncoder{
+	"ipaddr":   encodeIPAddr,
+	"ips":      encodeIPList,
+	"string":   encodeString,
+	"int":      encodeInt,
+	"uint8":    encodeUint(8),
+	"uint16":   encodeUint(16),
+	"uint32":   encodeUint(32),
+	"bytes":    encodeBytes,
+	"hex":      encodeHex,
+	"domains":  encodeDomainSearch,
+	"routes":   encodeClasslessRoutes,
+	"clientid": encodeClientID,
+	"vivc":     encodeVIVendorClass,
+	"vivso":    encodeVIVendorSpecific,
+}
+
+// encodeOption encodes a single Options entry
+func encodeOption(option Options) (dhcp4.Option, error) {
+	encoder, ok := optionEncoders[option.Type]
+	if !ok {
+		return dhcp4.Option{}, fmt.Errorf("option %d: unknown type %q", option.Option, option.Type)
+	}
+	value, err := encoder(option)
+	if err != nil {
+		return dhcp4.Option{}, fmt.Errorf("option %d (%s): %v", option.Option, option.Type, err)
+	}
+	if len(value) > 255 {
+		return dhcp4.Option{}, fmt.Errorf("option %d (%s): encoded value is %d bytes, maximum is 255", option.Option, option.Type, len(value))
+	}
+	return dhcp4.Option{Code: option.Option, Value: value}, nil
+}
+
+func encodeIPAddr(option Options) ([]byte, error) {
+	ip := net.ParseIP(strings.TrimSpace(option.Value)).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %q", option.Value)
+	}
+	return ip, nil
+}
+
+// encodeIPList encodes a comma-separated list of IPv4 addresses
+func encodeIPList(option Options) ([]byte, error) {
+	var value []byte
+	for _, s := range splitList(option.Value) {
+		ip := net.ParseIP(s).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		value = append(value, ip...)
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("empty address list")
+	}
+	return value, nil
+}
+
+func encodeString(option Options) ([]byte, error) {
+	return []byte(option.Value), nil
+}
+
+// encodeInt encodes a signed 32-bit integer, as used by option 2
+func encodeInt(option Options) ([]byte, error) {
+	val, err := strconv.ParseInt(strings.TrimSpace(option.Value), 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid 32-bit integer %q", option.Value)
+	}
+	bs := make([]byte, 4)
+	binary.BigEndian.PutUint32(bs, uint32(val))
+	return bs, nil
+}
+
+// encodeUint returns an encoder for unsigned integers of the given size
+func encodeUint(bits int) optionEncoder {
+	return func(option Options) ([]byte, error) {
+		val, err := strconv.ParseUint(strings.TrimSpace(option.Value), 0, bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %d-bit unsigned integer %q", bits, option.Value)
+		}
+		bs := make([]byte, 8)
+		binary.BigEndian.PutUint64(bs, val)
+		return bs[8-bits/8:], nil
+	}
+}
+
+// encodeBytes encodes a comma-separated list of decimal byte values
+func encodeBytes(option Options) ([]byte, error) {
+	var value []byte
+	for _, s := range splitList(option.Value) {
+		val, err := strconv.ParseUint(s, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid byte value %q", s)
+		}
+		value = append(value, byte(val))
+	}
+	return value, nil
+}
+
+// encodeHex encodes a hex string, optionally prefixed with 0x and
+// separated by ':', '-', '.' or spaces
+func encodeHex(option Options) ([]byte, error) {
+	return parseHex(option.Value)
+}
+
+// encodeDomainSearch encodes a comma-separated list of domains as an
+// RFC 3397 domain search list (option 119), without name compression
+func encodeDomainSearch(option Options) ([]byte, error) {
+	var value []byte
+	for _, domain := range splitList(option.Value) {
+		name, err := encodeDomainName(domain)
+		if err != nil {
+			return nil, err
+		}
+		value = append(value, name...)
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("empty domain list")
+	}
+	return value, nil
+}
+
+// encodeDomainName encodes a domain name in RFC 1035 label format
+func encodeDomainName(domain string) ([]byte, error) {
+	var name []byte
+	for _, label := range strings.Split(strings.TrimSuffix(domain, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid domain name %q", domain)
+		}
+		name = append(name, byte(len(label)))
+		name = append(name, label...)
+	}
+	return append(name, 0), nil
+}
+
+// encodeClasslessRoutes encodes a comma-separated list of
+// "destination/prefix gateway" routes as RFC 3442 classless static
+// routes (option 121)
+func encodeClasslessRoutes(option Options) ([]byte, error) {
+	var value []byte
+	for _, route := range splitList(option.Value) {
+		fields := strings.Fields(route)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid route %q, expected \"destination/prefix gateway\"", route)
+		}
+		_, dst, err := net.ParseCIDR(fields[0])
+		if err != nil || dst.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid route destination %q", fields[0])
+		}
+		gw := net.ParseIP(fields[1]).To4()
+		if gw == nil {
+			return nil, fmt.Errorf("invalid route gateway %q", fields[1])
+		}
+		ones, _ := dst.Mask.Size()
+		value = append(value, byte(ones))
+		value = append(value, dst.IP.To4()[:(ones+7)/8]...)
+		value = append(value, gw...)
+	}
+	if len(value) == 0 {
+		return nil, fmt.Errorf("empty route list")
+	}
+	return value, nil
+}
+
+// encodeClientID encodes a client identifier (option 61). A MAC address
+// is sent with hardware type 1 (Ethernet), "type:hex" sets an explicit
+// type, and any other value is sent as type 0 followed by the text.
+func encodeClientID(option Options) ([]byte, error) {
+	value := strings.TrimSpace(option.Value)
+	if mac, err := net.ParseMAC(value); err == nil {
+		return append([]byte{1}, mac...), nil
+	}
+	if idType, data, ok := strings.Cut(value, ":"); ok && len(idType) <= 3 {
+		if t, err := strconv.ParseUint(idType, 10, 8); err == nil {
+			id, err := parseHex(data)
+			if err != nil {
+				return nil, err
+			}
+			return append([]byte{byte(t)}, id...), nil
+		}
+	}
+	if value == "" {
+		return nil, fmt.Errorf("empty client identifier")
+	}
+	return append([]byte{0}, value...), nil
+}
+
+// encodeVIVendorClass encodes a V-I vendor class (option 124): the
+// enterprise number followed by the comma-separated vendor class data
+func encodeVIVendorClass(option Options) ([]byte, error) {
+	var data []byte
+	for _, class := range splitList(option.Value) {
+		if len(class) > 255 {
+			return nil, fmt.Errorf("vendor class data %q too long", class)
+		}
+		data = append(data, byte(len(class)))
+		data = append(data, class...)
+	}
+	return enterpriseBlock(option.Enterprise, data)
+}
+
+// encodeVIVendorSpecific encodes V-I vendor-specific information
+// (option 125): the enterprise number followed by comma-separated
+// "code=value" sub-options
+func encodeVIVendorSpecific(option Options) ([]byte, error) {
+	var data []byte
+	for _, sub := range splitList(option.Value) {
+		code, val, ok := strings.Cut(sub, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid sub-option %q, expected code=value", sub)
+		}
+		c, err := strconv.ParseUint(strings.TrimSpace(code), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sub-option code %q", code)
+		}
+		if len(val) > 255 {
+			return nil, fmt.Errorf("sub-option %d value too long", c)
+		}
+		data = append(data, byte(c), byte(len(val)))
+		data = append(data, val...)
+	}
+	return enterpriseBlock(option.Enterprise, data)
+}
+
+// enterpriseBlock prefixes data with an enterprise number and its length
+func enterpriseBlock(enterprise uint32, data []byte) ([]byte, error) {
+	if enterprise == 0 {
+		return nil, fmt.Errorf("missing enterprise number")
+	}
+	if len(data) > 255 {
+		return nil, fmt.Errorf("enterprise %d data is %d bytes, maximum is 255", enterprise, len(data))
+	}
+	block := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(block, enterprise)
+	block[4] = byte(len(data))
+	return append(block, data...), nil
+}
+
+// mergeEnterpriseOptions concatenates repeated V-I vendor options (124 and
+// 125) so that several enterprises share a single option
+func mergeEnterpriseOptions(options []dhcp4.Option) []dhcp4.Option {
+	merged := make([]dhcp4.Option, 0, len(options))
+	index := map[dhcp4.OptionCode]int{}
+	for _, o := range options {
+		if o.Code == optionVIVendorClass || o.Code == optionVIVendorSpecific {
+			if i, ok := index[o.Code]; ok {
+				merged[i].Value = append(merged[i].Value, o.Value...)
+				continue
+			}
+			index[o.Code] = len(merged)
+		}
+		merged = append(merged, o)
+	}
+	return merged
+}
+
+const (
+	optionVIVendorClass    dhcp4.OptionCode = 124
+	optionVIVendorSpecific dhcp4.OptionCode = 125
+)
+
+// Relay agent information sub-options (RFC 3046)
+const (
+	relaySubOptionCircuitID = 1
+	relaySubOptionRemoteID  = 2
+)
+
+// encodeRelayAgentInfo builds the option 82 payload from Circuit-ID and
+// Remote-ID values. Values prefixed with "hex:" are sent as raw bytes,
+// anything else as text; empty values are left out.
+func encodeRelayAgentInfo(circuitID, remoteID string) ([]byte, error) {
+	var value []byte
+	for _, sub := range []struct {
+		code  byte
+		value string
+	}{
+		{relaySubOptionCircuitID, circuitID},
+		{relaySubOptionRemoteID, remoteID},
+	} {
+		if sub.value == "" {
+			continue
+		}
+		data := []byte(sub.value)
+		if h, ok := strings.CutPrefix(sub.value, "hex:"); ok {
+			var err error
+			if data, err = parseHex(h); err != nil {
+				return nil, fmt.Errorf("sub-option %d: %v", sub.code, err)
+			}
+		}
+		if len(data) == 0 || len(data) > 255 {
+			return nil, fmt.Errorf("sub-option %d: invalid length %d", sub.code, len(data))
+		}
+		value = append(value, sub.code, byte(len(data)))
+		value = append(value, data...)
+	}
+	if len(value) > 255 {
+		return nil, fmt.Errorf("relay agent information is %d bytes, maximum is 255", len(value))
+	}
+	return value, nil
+}
+
+// expandTemplate replaces {name} placeholders with the given variables
+func expandTemplate(tpl string, vars map[string]string) string {
+	pairs := make([]string, 0, 2*len(vars))
+	for name, value := range vars {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(tpl)
+}
+
+// parseHex decodes a hex string, ignoring a 0x or 0X prefix and separators
+func parseHex(s string) ([]byte, error) {
+	clean, _ := cutHexPrefix(strings.TrimSpace(s))
+	clean = strings.NewReplacer(":", "", "-", "", ".", "", " ", "").Replace(clean)
+	b, err := hex.DecodeString(clean)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex string %q", s)
+	}
+	return b, nil
+}
+
+// cutHexPrefix returns s without its 0x or 0X prefix, and whether it had
+// one
+func cutHexPrefix(s string) (string, bool) {
+	if len(s) >= 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		return s[2:], true
+	}
+	return s, false
+}
+
+// splitList splits a comma-separated list, trimming spaces and dropping
+// empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// TestEncodeOption tests the typed DHCP option encoders
+func TestEncodeOption(t *testing.T) {
+	tests := []struct {
+		name   string
+		option Options
+		want   []byte
+	}{
+		{"string", Options{Option: 12, Type: "string", Value: "wyzecam"}, []byte("wyzecam")},
+		{"bytes", Options{Option: 55, Type: "bytes", Value: "1, 3,6"}, []byte{1, 3, 6}},
+		{"int", Options{Option: 2, Type: "int", Value: "-3600"}, []byte{0xff, 0xff, 0xf1, 0xf0}},
+		{"uint8", Options{Option: 46, Type: "uint8", Value: "8"}, []byte{8}},
+		{"uint16", Options{Option: 57, Type: "uint16", Value: "1500"}, []byte{0x05, 0xdc}},
+		{"uint32", Options{Option: 51, Type: "uint32", Value: "0x10000"}, []byte{0, 1, 0, 0}},
+		{"hex", Options{Option: 43, Type: "hex", Value: "01:04:c0:a8:01:01"}, []byte{1, 4, 192, 168, 1, 1}},
+		{"hex prefix", Options{Option: 43, Type: "hex", Value: "0X0A01"}, []byte{0x0a, 0x01}},
+		{"ipaddr", Options{Option: 50, Type: "ipaddr", Value: "10.10.1.22"}, []byte{10, 10, 1, 22}},
+		{"ips", Options{Option: 6, Type: "ips", Value: "8.8.8.8, 1.1.1.1"}, []byte{8, 8, 8, 8, 1, 1, 1, 1}},
+		{"domains", Options{Option: 119, Type: "domains", Value: "eng.example.com,example.com"},
+			[]byte("\x03eng\x07example\x03com\x00\x07example\x03com\x00")},
+		{"routes", Options{Option: 121, Type: "routes", Value: "10.0.0.0/8 10.10.1.1, 0.0.0.0/0 10.10.1.254"},
+			[]byte{8, 10, 10, 10, 1, 1, 0, 10, 10, 1, 254}},
+		{"clientid mac", Options{Option: 61, Type: "clientid", Value: "f0:6d:ab:74:f5:a2"},
+			[]byte{1, 0xf0, 0x6d, 0xab, 0x74, 0xf5, 0xa2}},
+		{"clientid typed", Options{Option: 61, Type: "clientid", Value: "255:00010203"}, []byte{255, 0, 1, 2, 3}},
+		{"clientid text", Options{Option: 61, Type: "clientid", Value: "printer-1"}, append([]byte{0}, "printer-1"...)},
+		{"vivc", Options{Option: 124, Type: "vivc", Enterprise: 3561, Value: "dslforum"},
+			append([]byte{0, 0, 0x0d, 0xe9, 9, 8}, "dslforum"...)},
+		{"vivso", Options{Option: 125, Type: "vivso", Enterprise: 253, Value: "1=XRX"},
+			[]byte{0, 0, 0, 253, 5, 1, 3, 'X', 'R', 'X'}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encodeOption(tt.option)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Code != tt.option.Option || !bytes.Equal(got.Value, tt.want) {
+				t.Errorf("got %d %x, want %d %x", got.Code, got.Value, tt.option.Option, tt.want)
+			}
+		})
+	}
+}
+
+// TestEncodeOptionErrors tests that invalid entries are reported
+func TestEncodeOptionErrors(t *testing.T) {
+	invalid := []Options{
+		{Option: 1, Type: "ipaddr", Value: "not-an-ip"},
+		{Option: 55, Type: "bytes", Value: "1,300"},
+		{Option: 57, Type: "uint16", Value: "70000"},
+		{Option: 43, Type: "hex", Value: "zz"},
+		{Option: 121, Type: "routes", Value: "10.0.0.0/8"},
+		{Option: 125, Type: "vivso", Value: "1=missing-enterprise"},
+		{Option: 99, Type: "unknown", Value: "x"},
+	}
+
+	for _, option := range invalid {
+		if _, err := encodeOption(option); err == nil {
+			t.Errorf("expected error for %+v", option)
+		}
+	}
+}
+
+// TestReadOptionsMergesEnterprises tests that repeated V-I options share
+// one option and that errors do not drop valid entries
+func TestReadOptionsMergesEnterprises(t *testing.T) {
+	var o Options
+	options, err := o.ReadOptions(`[
+		{"option": 125, "type": "vivso", "enterprise": 9, "value": "1=a"},
+		{"option": 12, "type": "string", "value": "host"},
+		{"option": 125, "type": "vivso", "enterprise": 253, "value": "2=b"},
+		{"option": 3, "type": "ipaddr", "value": "bogus"}
+	]`)
+	if err == nil {
+		t.Error("expected an error for the invalid router option")
+	}
+	if len(options) != 2 {
+		t.Fatalf("expected 2 options, got %d", len(options))
+	}
+	if options[0].Code != dhcp4.OptionCode(125) || len(options[0].Value) != 16 {
+		t.Errorf("expected merged option 125 of 16 bytes, got %d %x", options[0].Code, options[0].Value)
+	}
+}
+
+// TestEncodeRelayAgentInfo tests option 82 generation from templates
+func TestEncodeRelayAgentInfo(t *testing.T) {
+	vars := map[string]string{"nas_identifier": "Cisco_9300", "nas_port": "24"}
+	circuitID := expandTemplate("{nas_identifier}:{nas_port}", vars)
+	if circuitID != "Cisco_9300:24" {
+		t.Fatalf("unexpected expansion %q", circuitID)
+	}
+
+	got, err := encodeRelayAgentInfo(circuitID, "hex:0011aabbccdd")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := append([]byte{1, 13}, "Cisco_9300:24"...)
+	want = append(want, 2, 6, 0x00, 0x11, 0xaa, 0xbb, 0xcc, 0xdd)
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+
+	if got, _ := encodeRelayAgentInfo("", ""); len(got) != 0 {
+		t.Errorf("expected no option 82 without sub-options, got %x", got)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// DHCPv6 message types (RFC 8415 section 7.3)
+const (
+	dhcpv6Solicit     = 1
+	dhcpv6Advertise   = 2
+	dhcpv6Request     = 3
+	dhcpv6Confirm     = 4
+	dhcpv6Renew       = 5
+	dhcpv6Rebind      = 6
+	dhcpv6Reply       = 7
+	dhcpv6Release     = 8
+	dhcpv6Decline     = 9
+	dhcpv6Reconfigure = 10
+	dhcpv6InfoRequest = 11
+	dhcpv6RelayForw   = 12
+	dhcpv6RelayRepl   = 13
+)
+
+// DHCPv6 option codes
+const (
+	dhcpv6OptClientID    = 1
+	dhcpv6OptServerID    = 2
+	dhcpv6OptIANA        = 3
+	dhcpv6OptIAAddr      = 5
+	dhcpv6OptORO         = 6
+	dhcpv6OptElapsedTime = 8
+	dhcpv6OptRelayMsg    = 9
+	dhcpv6OptStatusCode  = 13
+	dhcpv6OptRapidCommit = 14
+	dhcpv6OptVendorClass = 16
+	dhcpv6OptInterfaceID = 18
+	dhcpv6OptDNSServers  = 23
+	dhcpv6OptIAPD        = 25
+	dhcpv6OptIAPrefix    = 26
+)
+
+// DHCPv6 status codes
+const (
+	dhcpv6StatusSuccess   = 0
+	dhcpv6StatusNoAddrs   = 2
+	dhcpv6StatusNoBinding = 3
+	dhcpv6StatusNoPrefix  = 6
+)
+
+// DUID types (RFC 8415 section 11)
+const (
+	duidLLT = 1
+	duidEN  = 2
+	duidLL  = 3
+)
+
+const (
+	dhcpv6ClientPort = 546
+	dhcpv6ServerPort = 547
+)
+
+// All_DHCP_Relay_Agents_and_Servers (RFC 8415 section 7.1)
+var dhcpv6Multicast = net.ParseIP("ff02::1:2")
+
+// duidEpoch is the reference time of DUID-LLT timestamps
+var duidEpoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// DHCPv6 holds the DHCPv6 client configuration of a simulated device
+type DHCPv6 struct {
+	Enabled   bool // Enable/Disable DHCPv6
+	intNet    *net.Interface
+	ClientMAC net.HardwareAddr // Device Client MAC
+	SrcMac    net.HardwareAddr // Source MAC (Ethernet Header)
+	DstMac    net.HardwareAddr // Destination MAC (Ethernet Header)
+
+	DUID        []byte        // Client DUID
+	IANA        bool          // Request a non-temporary address
+	IAPD        bool          // Request a delegated prefix
+	IAID        uint32        // Identity association ID
+	ORO         []uint16      // Option request list (option 6)
+	VendorClass []byte        // Encoded vendor class (option 16)
+	RapidCommit bool          // Ask for a two-message exchange
+	Renew       time.Duration // Fallback renewal time
+
+	ReleaseOnShutdown bool // Send RELEASE on graceful shutdown
+
+	Relay       bool   // Wrap messages in Relay-forward
+	ServerIP    net.IP // Server address in relay mode
+	RelayIP     net.IP // Relay source address
+	LinkAddress net.IP // link-address of the Relay-forward
+	InterfaceID []byte // Interface-ID (option 18) of the Relay-forward
+}
+
+// dhcpv6Option is a single DHCPv6 option
+type dhcpv6Option struct {
+	Code uint16
+	Data []byte
+}
+
+// dhcpv6Message is a DHCPv6 client/server message
+type dhcpv6Message struct {
+	Type    byte
+	XID     [3]byte
+	Options []dhcpv6Option
+}
+
+// MarshalBinary encodes the message in wire format
+func (m *dhcpv6Message) MarshalBinary() []byte {
+	b := []byte{m.Type, m.XID[0], m.XID[1], m.XID[2]}
+	return append(b, marshalDHCPv6Options(m.Options)...)
+}
+
+// parseDHCPv6Message decodes a client/server message
+func parseDHCPv6Message(b []byte) (*dhcpv6Message, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("DHCPv6 message too short")
+	}
+	options, err := parseDHCPv6Options(b[4:])
+	if err != nil {
+		return nil, err
+	}
+	m := &dhcpv6Message{Type: b[0], Options: options}
+	copy(m.XID[:], b[1:4])
+	return m, nil
+}
+
+// Option returns the data of the first option with the given code
+func (m *dhcpv6Message) Option(code uint16) []byte {
+	return findDHCPv6Option(m.Options, code)
+}
+
+func marshalDHCPv6Options(options []dhcpv6Option) []byte {
+	var b []byte
+	for _, o := range options {
+		b = binary.BigEndian.AppendUint16(b, o.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	return b
+}
+
+func parseDHCPv6Options(b []byte) ([]dhcpv6Option, error) {
+	var options []dhcpv6Option
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, fmt.Errorf("truncated DHCPv6 option header")
+		}
+		code := binary.BigEndian.Uint16(b[0:2])
+		length := int(binary.BigEndian.Uint16(b[2:4]))
+		if len(b) < 4+length {
+			return nil, fmt.Errorf("truncated DHCPv6 option %d", code)
+		}
+		options = append(options, dhcpv6Option{Code: code, Data: b[4 : 4+length]})
+		b = b[4+length:]
+	}
+	return options, nil
+}
+
+func findDHCPv6Option(options []dhcpv6Option, code uint16) []byte {
+	for _, o := range options {
+		if o.Code == code {
+			return o.Data
+		}
+	}
+	return nil
+}
+
+// newDUID builds a DUID of the given type ("llt", "ll" or "en") for mac.
+// DUID-EN uses the enterprise number and the hex identifier.
+func newDUID(kind string, mac net.HardwareAddr, enterprise uint32, identifier string) ([]byte, error) {
+	switch kind {
+	case "", "ll":
+		duid := []byte{0, duidLL, 0, 1}
+		return append(duid, mac...), nil
+	case "llt":
+		duid := []byte{0, duidLLT, 0, 1}
+		duid = binary.BigEndian.AppendUint32(duid, uint32(time.Since(duidEpoch)/time.Second))
+		return append(duid, mac...), nil
+	case "en":
+		if enterprise == 0 {
+			return nil, fmt.Errorf("DUID-EN requires an enterprise number")
+		}
+		id, err := parseHex(identifier)
+		if err != nil || len(id) == 0 {
+			id = mac
+		}
+		duid := []byte{0, duidEN}
+		duid = binary.BigEndian.AppendUint32(duid, enterprise)
+		return append(duid, id...), nil
+	}
+	return nil, fmt.Errorf("unknown DUID type %q", kind)
+}
+
+// encodeDHCPv6VendorClass builds a vendor class option (16): the
+// enterprise number followed by length-prefixed vendor class data
+func encodeDHCPv6VendorClass(enterprise uint32, classes []string) []byte {
+	if enterprise == 0 || len(classes) == 0 {
+		return nil
+	}
+	b := binary.BigEndian.AppendUint32(nil, enterprise)
+	for _, class := range classes {
+		b = binary.BigEndian.AppendUint16(b, uint16(len(class)))
+		b = append(b, class...)
+	}
+	return b
+}
+
+// parseORO parses a comma-separated list of option codes
+func parseORO(s string) ([]uint16, error) {
+	var oro []uint16
+	for _, item := range splitList(s) {
+		code, err := strconv.ParseUint(item, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid option code %q", item)
+		}
+		oro = append(oro, uint16(code))
+	}
+	return oro, nil
+}
+
+// dhcpv6IA is an identity association (IA_NA or IA_PD) from a server
+type dhcpv6IA struct {
+	Code      uint16
+	IAID      uint32
+	T1, T2    time.Duration
+	Addresses []net.IP     // IA_NA addresses
+	Prefixes  []*net.IPNet // IA_PD prefixes
+	Lifetime  time.Duration
+	Status    uint16
+}
+
+// parseDHCPv6IA decodes an IA_NA or IA_PD option
+func parseDHCPv6IA(code uint16, b []byte) (*dhcpv6IA, error) {
+	if len(b) < 12 {
+		return nil, fmt.Errorf("IA option %d too short", code)
+	}
+	ia := &dhcpv6IA{
+		Code: code,
+		IAID: binary.BigEndian.Uint32(b[0:4]),
+		T1:   time.Duration(binary.BigEndian.Uint32(b[4:8])) * time.Second,
+		T2:   time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Second,
+	}
+	options, err := parseDHCPv6Options(b[12:])
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range options {
+		switch o.Code {
+		case dhcpv6OptIAAddr:
+			if len(o.Data) < 24 {
+				continue
+			}
+			ia.Addresses = append(ia.Addresses, net.IP(append([]byte(nil), o.Data[0:16]...)))
+			ia.setLifetime(binary.BigEndian.Uint32(o.Data[20:24]))
+		case dhcpv6OptIAPrefix:
+			if len(o.Data) < 25 {
+				continue
+			}
+			prefix := &net.IPNet{
+				IP:   net.IP(append([]byte(nil), o.Data[9:25]...)),
+				Mask: net.CIDRMask(int(o.Data[8]), 128),
+			}
+			ia.Prefixes = append(ia.Prefixes, prefix)
+			ia.setLifetime(binary.BigEndian.Uint32(o.Data[4:8]))
+		case dhcpv6OptStatusCode:
+			if len(o.Data) >= 2 {
+				ia.Status = binary.BigEndian.Uint16(o.Data[0:2])
+			}
+		}
+	}
+	return ia, nil
+}
+
+// setLifetime keeps the shortest valid lifetime of the IA's leases
+func (ia *dhcpv6IA) setLifetime(seconds uint32) {
+	lifetime := time.Duration(seconds) * time.Second
+	if ia.Lifetime == 0 || lifetime < ia.Lifetime {
+		ia.Lifetime = lifetime
+	}
+}
+
+// encodeIA builds an IA_NA or IA_PD option, optionally carrying the
+// addresses or prefixes the client currently holds
+func encodeIA(code uint16, iaid uint32, held *dhcpv6IA) dhcpv6Option {
+	b := binary.BigEndian.AppendUint32(nil, iaid)
+	b = binary.BigEndian.AppendUint32(b, 0) // T1, server decides
+	b = binary.BigEndian.AppendUint32(b, 0) // T2, server decides
+	if held != nil {
+		var sub []dhcpv6Option
+		for _, addr := range held.Addresses {
+			data := append([]byte(nil), addr.To16()...)
+			data = append(data, make([]byte, 8)...) // lifetimes, server decides
+			sub = append(sub, dhcpv6Option{Code: dhcpv6OptIAAddr, Data: data})
+		}
+		for _, prefix := range held.Prefixes {
+			ones, _ := prefix.Mask.Size()
+			data := make([]byte, 8, 25)
+			data = append(data, byte(ones))
+			data = append(data, prefix.IP.To16()...)
+			sub = append(sub, dhcpv6Option{Code: dhcpv6OptIAPrefix, Data: data})
+		}
+		b = append(b, marshalDHCPv6Options(sub)...)
+	}
+	return dhcpv6Option{Code: code, Data: b}
+}
+
+// encodeRelayForward wraps a client message in a Relay-forward message
+func encodeRelayForward(msg []byte, linkAddr, peerAddr net.IP, interfaceID []byte) []byte {
+	b := []byte{dhcpv6RelayForw, 0} // hop-count 0
+	b = append(b, linkAddr.To16()...)
+	b = append(b, peerAddr.To16()...)
+	options := []dhcpv6Option{{Code: dhcpv6OptRelayMsg, Data: msg}}
+	if len(interfaceID) > 0 {
+		options = append(options, dhcpv6Option{Code: dhcpv6OptInterfaceID, Data: interfaceID})
+	}
+	return append(b, marshalDHCPv6Options(options)...)
+}
+
+// unwrapRelayReply returns the innermost message of a Relay-reply, or b
+// itself when it is a plain client/server message
+func unwrapRelayReply(b []byte) ([]byte, error) {
+	for len(b) > 0 && b[0] == dhcpv6RelayRepl {
+		if len(b) < 34 {
+			return nil, fmt.Errorf("Relay-reply too short")
+		}
+		options, err := parseDHCPv6Options(b[34:])
+		if err != nil {
+			return nil, err
+		}
+		b = findDHCPv6Option(options, dhcpv6OptRelayMsg)
+	}
+	return b, nil
+}
+
+// linkLocalAddr returns the EUI-64 based link-local address of mac
+func linkLocalAddr(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, 16)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:], eui64(mac))
+	return ip
+}
+
+// eui64 returns the modified EUI-64 interface identifier of mac
+func eui64(mac net.HardwareAddr) []byte {
+	id := []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]}
+	return id
+}
+
+// multicastMAC returns the Ethernet address of an IPv6 multicast group
+func multicastMAC(ip net.IP) net.HardwareAddr {
+	ip = ip.To16()
+	return net.HardwareAddr{0x33, 0x33, ip[12], ip[13], ip[14], ip[15]}
+}
+
+// isDHCPv6Reply reports whether a message type is sent by servers
+func isDHCPv6Reply(t byte) bool {
+	return t == dhcpv6Advertise || t == dhcpv6Reply || t == dhcpv6Reconfigure
+}
+
+func dhcpv6TypeName(t byte) string {
+	names := map[byte]string{
+		dhcpv6Solicit: "SOLICIT", dhcpv6Advertise: "ADVERTISE", dhcpv6Request: "REQUEST",
+		dhcpv6Confirm: "CONFIRM", dhcpv6Renew: "RENEW", dhcpv6Rebind: "REBIND",
+		dhcpv6Reply: "REPLY", dhcpv6Release: "RELEASE", dhcpv6Decline: "DECLINE",
+		dhcpv6Reconfigure: "RECONFIGURE", dhcpv6InfoRequest: "INFORMATION-REQUEST",
+		dhcpv6RelayForw: "RELAY-FORW", dhcpv6RelayRepl: "RELAY-REPL",
+	}
+	if name, ok := names[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", t)
+}
+
+// sameDUID reports whether a Client ID option matches duid
+func sameDUID(clientID, duid []byte) bool {
+	return len(clientID) > 0 && bytes.Equal(clientID, duid)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestNewDUID tests DUID-LL, DUID-LLT and DUID-EN generation
+func TestNewDUID(t *testing.T) {
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+
+	ll, err := newDUID("ll", mac, 0, "")
+	if err != nil || !bytes.Equal(ll, []byte{0, 3, 0, 1, 0x90, 0x6c, 0xac, 0x64, 0x95, 0xc1}) {
+		t.Errorf("unexpected DUID-LL %x (%v)", ll, err)
+	}
+
+	llt, err := newDUID("llt", mac, 0, "")
+	if err != nil || len(llt) != 14 || llt[1] != duidLLT || !bytes.Equal(llt[8:], mac) {
+		t.Errorf("unexpected DUID-LLT %x (%v)", llt, err)
+	}
+
+	en, err := newDUID("en", mac, 9, "0a0b")
+	if err != nil || !bytes.Equal(en, []byte{0, 2, 0, 0, 0, 9, 0x0a, 0x0b}) {
+		t.Errorf("unexpected DUID-EN %x (%v)", en, err)
+	}
+
+	if _, err := newDUID("en", mac, 0, ""); err == nil {
+		t.Error("expected an error for DUID-EN without enterprise number")
+	}
+}
+
+// TestDHCPv6IARoundTrip tests that held leases are encoded the way they
+// are parsed
+func TestDHCPv6IARoundTrip(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:100::/56")
+	held := &dhcpv6IA{
+		Addresses: []net.IP{net.ParseIP("2001:db8::10")},
+		Prefixes:  []*net.IPNet{prefix},
+	}
+
+	o := encodeIA(dhcpv6OptIANA, 42, held)
+	ia, err := parseDHCPv6IA(o.Code, o.Data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ia.IAID != 42 || len(ia.Addresses) != 1 || !ia.Addresses[0].Equal(held.Addresses[0]) {
+		t.Errorf("unexpected addresses %+v", ia)
+	}
+	if len(ia.Prefixes) != 1 || ia.Prefixes[0].String() != "2001:db8:100::/56" {
+		t.Errorf("unexpected prefixes %+v", ia.Prefixes)
+	}
+}
+
+// TestDHCPv6RelayUnwrap tests that Relay-reply messages are unwrapped to
+// the client message they carry
+func TestDHCPv6RelayUnwrap(t *testing.T) {
+	inner := (&dhcpv6Message{Type: dhcpv6Reply, XID: [3]byte{1, 2, 3}}).MarshalBinary()
+
+	forward := encodeRelayForward(inner, net.IPv6unspecified, linkLocalAddr(net.HardwareAddr{0, 1, 2, 3, 4, 5}), []byte("Gi1/0/1"))
+	if forward[0] != dhcpv6RelayForw {
+		t.Fatalf("unexpected relay message type %d", forward[0])
+	}
+
+	reply := append([]byte(nil), forward...)
+	reply[0] = dhcpv6RelayRepl
+	got, err := unwrapRelayReply(reply)
+	if err != nil || !bytes.Equal(got, inner) {
+		t.Errorf("got %x (%v), want %x", got, err, inner)
+	}
+}
+
+// TestJitter tests that retransmission timeouts stay within 10%
+func TestJitter(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		if d := jitter(10 * time.Second); d < 9*time.Second || d > 11*time.Second {
+			t.Fatalf("jitter out of range: %v", d)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+)
+
+// DHCPv6State is a DHCPv6 client state
+type DHCPv6State int
+
+const (
+	DHCPv6Soliciting DHCPv6State = iota
+	DHCPv6Requesting
+	DHCPv6Bound
+	DHCPv6Renewing
+	DHCPv6Rebinding
+)
+
+func (s DHCPv6State) String() string {
+	switch s {
+	case DHCPv6Soliciting:
+		return "SOLICITING"
+	case DHCPv6Requesting:
+		return "REQUESTING"
+	case DHCPv6Bound:
+		return "BOUND"
+	case DHCPv6Renewing:
+		return "RENEWING"
+	case DHCPv6Rebinding:
+		return "REBINDING"
+	}
+	return "UNKNOWN"
+}
+
+// Transmission parameters (RFC 8415 section 7.6)
+const (
+	dhcpv6SolTimeout = 1 * time.Second
+	dhcpv6SolMaxRT   = 3600 * time.Second
+	dhcpv6ReqTimeout = 1 * time.Second
+	dhcpv6ReqMaxRT   = 30 * time.Second
+	dhcpv6ReqMaxRC   = 10
+	dhcpv6RenTimeout = 10 * time.Second
+	dhcpv6RenMaxRT   = 600 * time.Second
+	dhcpv6RebTimeout = 10 * time.Second
+	dhcpv6RebMaxRT   = 600 * time.Second
+)
+
+// DHCPv6Client drives a simulated device through SOLICIT, ADVERTISE,
+// REQUEST and REPLY, then renews and rebinds its leases
+type DHCPv6Client struct {
+	cfg *DHCPv6
+	raw *RawClient
+	nd  *NDClient // Runs DAD on and answers for the leased addresses, if set
+
+	state   DHCPv6State
+	xid     [3]byte
+	started time.Time
+	attempt int
+	rt      time.Duration
+
+	serverID []byte
+	iana     *dhcpv6IA
+	iapd     *dhcpv6IA
+	bound    time.Time
+	t1, t2   time.Duration
+	lifetime time.Duration
+
+	replies chan *dhcpv6Message
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// NewDHCPv6Client creates a DHCPv6 client for the configured device
+func NewDHCPv6Client(cfg *DHCPv6, raw *RawClient) *DHCPv6Client {
+	return &DHCPv6Client{
+		cfg:     cfg,
+		raw:     raw,
+		state:   DHCPv6Soliciting,
+		replies: make(chan *dhcpv6Message, 16),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// deliver hands a server reply to the state machine, dropping it if the
+// client is not keeping up
+func (c *DHCPv6Client) deliver(m *dhcpv6Message) {
+	select {
+	case c.replies <- m:
+	default:
+		logger.Warn("DHCPv6 reply queue full for %s, dropping packet", c.cfg.ClientMAC)
+	}
+}
+
+// Stop shuts the client down gracefully, releasing its leases first when
+// configured to. It is meant to be registered with GracefulShutdown.
+func (c *DHCPv6Client) Stop() error {
+	select {
+	case c.stop <- struct{}{}:
+		<-c.done
+	case <-c.done:
+	}
+	return nil
+}
+
+// Run executes the DHCPv6 state machine until the context is cancelled or
+// the client is stopped
+func (c *DHCPv6Client) Run(ctx context.Context) {
+	defer close(c.done)
+
+	c.raw.HandleDHCPv6(c.cfg.DUID, c.deliver)
+	defer c.raw.RemoveDHCPv6(c.cfg.DUID)
+
+	c.solicit()
+	timer := time.NewTimer(c.rt)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.stop:
+			if c.cfg.ReleaseOnShutdown {
+				c.release()
+			}
+			return
+		case reply := <-c.replies:
+			if wait, handled := c.handleReply(reply); handled {
+				resetTimer(timer, wait)
+			}
+		case <-timer.C:
+			resetTimer(timer, c.handleTimeout())
+		}
+	}
+}
+
+// handleTimeout retransmits or moves on to the next state, returning the
+// time to wait before the next timeout
+func (c *DHCPv6Client) handleTimeout() time.Duration {
+	switch c.state {
+	case DHCPv6Soliciting:
+		c.retransmit(dhcpv6SolMaxRT)
+		c.send(dhcpv6Solicit)
+
+	case DHCPv6Requesting:
+		if c.attempt >= dhcpv6ReqMaxRC {
+			logger.Warn("No REPLY to DHCPv6 REQUEST for %s, soliciting again", c.cfg.ClientMAC)
+			c.solicit()
+			return c.rt
+		}
+		c.retransmit(dhcpv6ReqMaxRT)
+		c.send(dhcpv6Request)
+
+	case DHCPv6Bound:
+		c.newTransaction(DHCPv6Renewing, dhcpv6RenTimeout)
+		c.send(dhcpv6Renew)
+		return c.capWait(c.bound.Add(c.t2))
+
+	case DHCPv6Renewing:
+		if !time.Now().Before(c.bound.Add(c.t2)) {
+			c.newTransaction(DHCPv6Rebinding, dhcpv6RebTimeout)
+			c.send(dhcpv6Rebind)
+			return c.capWait(c.bound.Add(c.lifetime))
+		}
+		c.retransmit(dhcpv6RenMaxRT)
+		c.send(dhcpv6Renew)
+		return c.capWait(c.bound.Add(c.t2))
+
+	case DHCPv6Rebinding:
+		if !time.Now().Before(c.bound.Add(c.lifetime)) {
+			logger.Warn("DHCPv6 leases for %s expired", c.cfg.ClientMAC)
+			c.solicit()
+			return c.rt
+		}
+		c.retransmit(dhcpv6RebMaxRT)
+		c.send(dhcpv6Rebind)
+		return c.capWait(c.bound.Add(c.lifetime))
+	}
+	return c.rt
+}
+
+// handleReply processes an ADVERTISE or REPLY and reports whether it
+// changed the state, along with the time to wait before the next timeout
+func (c *DHCPv6Client) handleReply(m *dhcpv6Message) (time.Duration, bool) {
+	if m.XID != c.xid || !sameDUID(m.Option(dhcpv6OptClientID), c.cfg.DUID) {
+		return 0, false
+	}
+	metrics.IncrementDHCPReply()
+	iana, iapd := c.parseIAs(m)
+	reportDHCPv6Reply(m, iana, iapd)
+
+	switch c.state {
+	case DHCPv6Soliciting:
+		if m.Type == dhcpv6Reply && c.cfg.RapidCommit && m.Option(dhcpv6OptRapidCommit) != nil {
+			return c.bind(m, iana, iapd)
+		}
+		if m.Type != dhcpv6Advertise || !c.usable(iana, iapd) {
+			return 0, false
+		}
+		c.serverID = append([]byte(nil), m.Option(dhcpv6OptServerID)...)
+		c.iana, c.iapd = iana, iapd
+		c.newTransaction(DHCPv6Requesting, dhcpv6ReqTimeout)
+		c.send(dhcpv6Request)
+		return c.rt, true
+
+	case DHCPv6Requesting, DHCPv6Renewing, DHCPv6Rebinding:
+		if m.Type != dhcpv6Reply {
+			return 0, false
+		}
+		if !c.usable(iana, iapd) {
+			logger.Warn("DHCPv6 REPLY for %s carries no usable lease, soliciting again", c.cfg.ClientMAC)
+			c.solicit()
+			return c.rt, true
+		}
+		return c.bind(m, iana, iapd)
+	}
+	return 0, false
+}
+
+// bind records the leases of a REPLY and enters BOUND
+func (c *DHCPv6Client) bind(m *dhcpv6Message, iana, iapd *dhcpv6IA) (time.Duration, bool) {
+	c.serverID = append([]byte(nil), m.Option(dhcpv6OptServerID)...)
+	c.iana, c.iapd = iana, iapd
+	c.bound = c.started
+
+	c.t1, c.t2, c.lifetime = 0, 0, 0
+	for _, ia := range []*dhcpv6IA{iana, iapd} {
+		if ia == nil {
+			continue
+		}
+		if ia.T1 > 0 && (c.t1 == 0 || ia.T1 < c.t1) {
+			c.t1 = ia.T1
+		}
+		if ia.T2 > 0 && (c.t2 == 0 || ia.T2 < c.t2) {
+			c.t2 = ia.T2
+		}
+		if ia.Lifetime > 0 && (c.lifetime == 0 || ia.Lifetime < c.lifetime) {
+			c.lifetime = ia.Lifetime
+		}
+	}
+	if c.lifetime == 0 {
+		c.lifetime = 2 * c.cfg.Renew
+	}
+	if c.t1 == 0 {
+		c.t1 = c.lifetime / 2
+	}
+	if c.t2 == 0 {
+		c.t2 = c.lifetime * 4 / 5
+	}
+
+	if c.nd != nil && iana != nil && !c.cfg.Relay {
+		for _, addr := range iana.Addresses {
+			c.nd.AddAddress(addr)
+		}
+	}
+
+	c.state = DHCPv6Bound
+	logger.Info("DHCPv6 %s bound (T1 %v, T2 %v, valid %v)", c.cfg.ClientMAC, c.t1, c.t2, c.lifetime)
+	return time.Until(c.bound.Add(c.t1)), true
+}
+
+// release gives the current leases back to the server
+func (c *DHCPv6Client) release() {
+	if c.state < DHCPv6Bound {
+		return
+	}
+	logger.Info("Releasing DHCPv6 leases for %s", c.cfg.ClientMAC)
+	c.newTransaction(DHCPv6Soliciting, dhcpv6SolTimeout)
+	c.send(dhcpv6Release)
+}
+
+// solicit starts a new SOLICIT exchange, forgetting any lease
+func (c *DHCPv6Client) solicit() {
+	c.serverID, c.iana, c.iapd = nil, nil, nil
+	c.newTransaction(DHCPv6Soliciting, dhcpv6SolTimeout)
+	c.send(dhcpv6Solicit)
+}
+
+// send builds a client message for the current transaction and sends it
+// to the servers, directly or through the simulated relay
+func (c *DHCPv6Client) send(msgType byte) {
+	cfg := c.cfg
+
+	elapsed := time.Since(c.started) / (10 * time.Millisecond)
+	if elapsed > 0xffff {
+		elapsed = 0xffff
+	}
+	m := &dhcpv6Message{Type: msgType, XID: c.xid}
+	m.Options = append(m.Options,
+		dhcpv6Option{Code: dhcpv6OptClientID, Data: cfg.DUID},
+		dhcpv6Option{Code: dhcpv6OptElapsedTime, Data: binary.BigEndian.AppendUint16(nil, uint16(elapsed))},
+	)
+	if msgType != dhcpv6Solicit && msgType != dhcpv6Rebind && c.serverID != nil {
+		m.Options = append(m.Options, dhcpv6Option{Code: dhcpv6OptServerID, Data: c.serverID})
+	}
+	if msgType == dhcpv6Solicit && cfg.RapidCommit {
+		m.Options = append(m.Options, dhcpv6Option{Code: dhcpv6OptRapidCommit})
+	}
+	if cfg.IANA {
+		m.Options = append(m.Options, encodeIA(dhcpv6OptIANA, cfg.IAID, c.iana))
+	}
+	if cfg.IAPD {
+		m.Options = append(m.Options, encodeIA(dhcpv6OptIAPD, cfg.IAID, c.iapd))
+	}
+	if msgType != dhcpv6Release {
+		if len(cfg.ORO) > 0 {
+			var oro []byte
+			for _, code := range cfg.ORO {
+				oro = binary.BigEndian.AppendUint16(oro, code)
+			}
+			m.Options = append(m.Options, dhcpv6Option{Code: dhcpv6OptORO, Data: oro})
+		}
+		if len(cfg.VendorClass) > 0 {
+			m.Options = append(m.Options, dhcpv6Option{Code: dhcpv6OptVendorClass, Data: cfg.VendorClass})
+		}
+	}
+
+	payload := m.MarshalBinary()
+	linkLocal := linkLocalAddr(cfg.ClientMAC)
+	dstIP, srcIP := dhcpv6Multicast, linkLocal
+	srcPort := dhcpv6ClientPort
+	if cfg.Relay {
+		payload = encodeRelayForward(payload, cfg.LinkAddress, linkLocal, cfg.InterfaceID)
+		dstIP, srcIP = cfg.ServerIP, cfg.RelayIP
+		srcPort = dhcpv6ServerPort
+	}
+
+	if err := c.raw.sendUDP6(cfg.ClientMAC, cfg.DstMac, cfg.SrcMac, payload, dstIP, srcIP, srcPort, dhcpv6ServerPort); err != nil {
+		logger.Error("Failed to send DHCPv6 %s for %s: %v", dhcpv6TypeName(msgType), cfg.ClientMAC, err)
+		metrics.IncrementErrors()
+		return
+	}
+	metrics.IncrementDHCP()
+	logger.Debug("Sent DHCPv6 %s xid=%x state=%s", dhcpv6TypeName(msgType), c.xid, c.state)
+}
+
+// newTransaction starts a new exchange in state s with a fresh
+// transaction ID and initial retransmission timeout irt
+func (c *DHCPv6Client) newTransaction(s DHCPv6State, irt time.Duration) {
+	rand.Read(c.xid[:])
+	c.started = time.Now()
+	c.attempt = 0
+	c.rt = jitter(irt)
+	if c.state != s {
+		logger.Debug("DHCPv6 %s: %s -> %s", c.cfg.ClientMAC, c.state, s)
+	}
+	c.state = s
+}
+
+// retransmit doubles the retransmission timeout up to mrt (RFC 8415
+// section 15)
+func (c *DHCPv6Client) retransmit(mrt time.Duration) {
+	c.attempt++
+	c.rt = jitter(2 * c.rt)
+	if c.rt > mrt {
+		c.rt = jitter(mrt)
+	}
+}
+
+// capWait bounds the retransmission timeout by a state deadline
+func (c *DHCPv6Client) capWait(deadline time.Time) time.Duration {
+	if remaining := time.Until(deadline); remaining < c.rt {
+		return remaining
+	}
+	return c.rt
+}
+
+// parseIAs extracts the IA_NA and IA_PD matching our IAID
+func (c *DHCPv6Client) parseIAs(m *dhcpv6Message) (iana, iapd *dhcpv6IA) {
+	for _, o := range m.Options {
+		if o.Code != dhcpv6OptIANA && o.Code != dhcpv6OptIAPD {
+			continue
+		}
+		ia, err := parseDHCPv6IA(o.Code, o.Data)
+		if err != nil || ia.IAID != c.cfg.IAID {
+			continue
+		}
+		if o.Code == dhcpv6OptIANA {
+			iana = ia
+		} else {
+			iapd = ia
+		}
+	}
+	return iana, iapd
+}
+
+// usable reports whether the server granted every identity association
+// the client asked for
+func (c *DHCPv6Client) usable(iana, iapd *dhcpv6IA) bool {
+	if c.cfg.IANA && (iana == nil || len(iana.Addresses) == 0) {
+		return false
+	}
+	if c.cfg.IAPD && (iapd == nil || len(iapd.Prefixes) == 0) {
+		return false
+	}
+	return c.cfg.IANA || c.cfg.IAPD
+}
+
+// jitter randomizes d by +/- 10% (RFC 8415 section 15)
+func jitter(d time.Duration) time.Duration {
+	tenth := int64(d / 10)
+	if tenth <= 0 {
+		return d
+	}
+	n, _ := rand.Int(rand.Reader, big.NewInt(2*tenth+1))
+	return d + time.Duration(n.Int64()-tenth)
+}
+
+// reportDHCPv6Reply logs the leases and options carried by a reply
+func reportDHCPv6Reply(m *dhcpv6Message, iana, iapd *dhcpv6IA) {
+	var leases []string
+	if iana != nil {
+		for _, addr := range iana.Addresses {
+			leases = append(leases, addr.String())
+		}
+	}
+	if iapd != nil {
+		for _, prefix := range iapd.Prefixes {
+			leases = append(leases, prefix.String())
+		}
+	}
+
+	var codes []string
+	for _, o := range m.Options {
+		codes = append(codes, dhcpv6OptionName(o))
+	}
+	logger.Info("DHCPv6 %s xid=%x from server %x: leases [%s], options %s",
+		dhcpv6TypeName(m.Type), m.XID, m.Option(dhcpv6OptServerID),
+		strings.Join(leases, ", "), strings.Join(codes, " "))
+}
+
+// dhcpv6OptionName renders an option for logging
+func dhcpv6OptionName(o dhcpv6Option) string {
+	switch {
+	case o.Code == dhcpv6OptDNSServers && len(o.Data)%16 == 0:
+		var servers []string
+		for i := 0; i < len(o.Data); i += 16 {
+			servers = append(servers, net.IP(o.Data[i:i+16]).String())
+		}
+		return "dns=" + strings.Join(servers, ",")
+	case o.Code == dhcpv6OptStatusCode && len(o.Data) >= 2:
+		return fmt.Sprintf("status=%d(%s)", binary.BigEndian.Uint16(o.Data[0:2]), o.Data[2:])
+	}
+	return fmt.Sprintf("opt%d", o.Code)
+}
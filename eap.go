@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// EAP codes (RFC 3748 4)
+const (
+	eapRequest  = 1
+	eapResponse = 2
+	eapSuccess  = 3
+	eapFailure  = 4
+)
+
+// EAP method types
+const (
+	eapTypeIdentity     = 1
+	eapTypeNotification = 2
+	eapTypeNak          = 3
+	eapTypeMD5          = 4
+	eapTypeTLS          = 13
+	eapTypePEAP         = 25
+	eapTypeMSCHAPv2     = 26
+	eapTypeExtensions   = 33
+)
+
+// eapMethods maps the eap configuration values to the method types
+var eapMethods = map[string]byte{
+	"md5":  eapTypeMD5,
+	"peap": eapTypePEAP,
+	"tls":  eapTypeTLS,
+}
+
+// errEAPDone is returned once the server ended the conversation with an
+// Access-Accept or Access-Reject
+var errEAPDone = errors.New("EAP conversation ended")
+
+// eapPacket is an EAP packet. Success and Failure carry no type.
+type eapPacket struct {
+	Code byte
+	ID   byte
+	Type byte
+	Data []byte
+}
+
+func parseEAP(b []byte) (*eapPacket, error) {
+	if len(b) < 4 {
+		return nil, fmt.Errorf("EAP packet too short (%d bytes)", len(b))
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < 4 || length > len(b) {
+		return nil, fmt.Errorf("invalid EAP length %d for %d bytes", length, len(b))
+	}
+	p := &eapPacket{Code: b[0], ID: b[1]}
+	if (p.Code == eapRequest || p.Code == eapResponse) && length > 4 {
+		p.Type = b[4]
+		p.Data = b[5:length]
+	}
+	return p, nil
+}
+
+func (p *eapPacket) MarshalBinary() []byte {
+	b := []byte{p.Code, p.ID, 0, 0}
+	if p.Code == eapRequest || p.Code == eapResponse {
+		b = append(b, p.Type)
+		b = append(b, p.Data...)
+	}
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)))
+	return b
+}
+
+// eapSupplicant runs one EAP authentication, carried in EAP-Message
+// attributes of Access-Requests (RFC 3579)
+type eapSupplicant struct {
+	auth *Authentication
+
+	// newRequest builds an Access-Request with the device attributes and
+	// exchange sends it to the server
+	newRequest func() *radius.Packet
+	exchange   func(ctx context.Context, p *radius.Packet) (*radius.Packet, error)
+
+	ctx    context.Context
+	state  []byte         // State of the last Access-Challenge
+	result *radius.Packet // Access-Accept or Access-Reject ending the conversation
+}
+
+// Authenticate runs the configured EAP method and returns the final
+// Access-Accept or Access-Reject
+func (s *eapSupplicant) Authenticate(ctx context.Context) (*radius.Packet, error) {
+	s.ctx, s.state, s.result = ctx, nil, nil
+	method := eapMethods[s.auth.EAPMethod]
+
+	req, err := s.roundTrip(&eapPacket{Code: eapResponse, Type: eapTypeIdentity, Data: []byte(s.auth.outerIdentity())})
+	for err == nil {
+		switch req.Type {
+		case eapTypeIdentity:
+			req, err = s.roundTrip(&eapPacket{Code: eapResponse, ID: req.ID, Type: eapTypeIdentity, Data: []byte(s.auth.outerIdentity())})
+		case eapTypeNotification:
+			req, err = s.roundTrip(&eapPacket{Code: eapResponse, ID: req.ID, Type: eapTypeNotification})
+		case method:
+			switch method {
+			case eapTypeMD5:
+				err = s.md5(req)
+			case eapTypeTLS, eapTypePEAP:
+				err = s.tls(req, method)
+			}
+			if err == nil {
+				err = fmt.Errorf("EAP method ended without an answer from the server")
+			}
+		default:
+			// Legacy Nak: ask for the configured method instead
+			logger.Debug("EAP: server proposed method %d, asking for %d", req.Type, method)
+			req, err = s.roundTrip(&eapPacket{Code: eapResponse, ID: req.ID, Type: eapTypeNak, Data: []byte{method}})
+		}
+	}
+	if errors.Is(err, errEAPDone) {
+		return s.result, nil
+	}
+	return nil, err
+}
+
+// roundTrip sends an EAP response and returns the next EAP request. It
+// returns errEAPDone when the server answers with an Access-Accept or an
+// Access-Reject instead.
+func (s *eapSupplicant) roundTrip(resp *eapPacket) (*eapPacket, error) {
+	p := s.newRequest()
+	if s.state != nil {
+		rfc2865.State_Set(p, s.state)
+	}
+	msg := resp.MarshalBinary()
+	for len(msg) > 0 {
+		n := min(len(msg), 253)
+		p.Add(rfc2869.EAPMessage_Type, msg[:n])
+		msg = msg[n:]
+	}
+	if err := setMessageAuthenticator(p); err != nil {
+		return nil, err
+	}
+
+	reply, err := s.exchange(s.ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	if !verifyMessageAuthenticator(reply, p.Authenticator, true) {
+		return nil, fmt.Errorf("invalid Message-Authenticator in %s", reply.Code)
+	}
+
+	switch reply.Code {
+	case radius.CodeAccessChallenge:
+		s.state = rfc2865.State_Get(reply)
+	case radius.CodeAccessAccept, radius.CodeAccessReject:
+		s.result = reply
+		return nil, errEAPDone
+	default:
+		return nil, fmt.Errorf("unexpected %s", reply.Code)
+	}
+
+	var eap []byte
+	for _, a := range reply.Attributes {
+		if a.Type == rfc2869.EAPMessage_Type {
+			eap = append(eap, a.Attribute...)
+		}
+	}
+	req, err := parseEAP(eap)
+	if err != nil {
+		return nil, err
+	}
+	if req.Code != eapRequest {
+		return nil, fmt.Errorf("unexpected EAP code %d in Access-Challenge", req.Code)
+	}
+	return req, nil
+}
+
+// md5 answers an EAP-MD5 challenge (RFC 3748 5.4)
+func (s *eapSupplicant) md5(req *eapPacket) error {
+	if len(req.Data) < 1 || len(req.Data) < 1+int(req.Data[0]) {
+		return fmt.Errorf("invalid EAP-MD5 challenge")
+	}
+	challenge := req.Data[1 : 1+int(req.Data[0])]
+
+	h := md5.New()
+	h.Write([]byte{req.ID})
+	h.Write([]byte(s.auth.Password))
+	h.Write(challenge)
+	data := append([]byte{md5.Size}, h.Sum(nil)...)
+	data = append(data, s.auth.Identity...)
+
+	_, err := s.roundTrip(&eapPacket{Code: eapResponse, ID: req.ID, Type: eapTypeMD5, Data: data})
+	return err
+}
+
+// outerIdentity is the identity sent in clear, the anonymous one when set
+func (a *Authentication) outerIdentity() string {
+	if a.AnonymousIdentity != "" {
+		return a.AnonymousIdentity
+	}
+	return a.Identity
+}
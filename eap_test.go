@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// fakeEAPServer returns an exchange function answering each EAP response
+// with the request handle returns in an Access-Challenge, or with an
+// Access-Accept when it returns nil. The State of each challenge is its
+// round number.
+func fakeEAPServer(t *testing.T, handle func(resp *eapPacket, state []byte) *eapPacket) func(context.Context, *radius.Packet) (*radius.Packet, error) {
+	round := byte(0)
+	return func(_ context.Context, p *radius.Packet) (*radius.Packet, error) {
+		if !verifyMessageAuthenticator(p, p.Authenticator, true) {
+			t.Errorf("round %d: invalid Message-Authenticator in the request", round)
+		}
+		if _, ok := p.Lookup(rfc2865.UserPassword_Type); ok {
+			t.Errorf("round %d: User-Password sent with EAP", round)
+		}
+		resp, err := parseEAP(rfc2869.EAPMessage_Get(p))
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+
+		req := handle(resp, rfc2865.State_Get(p))
+		var reply *radius.Packet
+		if req == nil {
+			reply = p.Response(radius.CodeAccessAccept)
+			rfc2869.EAPMessage_Set(reply, (&eapPacket{Code: eapSuccess, ID: resp.ID}).MarshalBinary())
+		} else {
+			round++
+			reply = p.Response(radius.CodeAccessChallenge)
+			rfc2865.State_Set(reply, []byte{round})
+			eap := req.MarshalBinary()
+			for len(eap) > 0 {
+				n := min(len(eap), 253)
+				reply.Add(rfc2869.EAPMessage_Type, eap[:n])
+				eap = eap[n:]
+			}
+		}
+
+		// The reply has the request authenticator until it is encoded
+		if err := setMessageAuthenticator(reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply, nil
+	}
+}
+
+func newTestSupplicant(auth *Authentication, exchange func(context.Context, *radius.Packet) (*radius.Packet, error)) *eapSupplicant {
+	return &eapSupplicant{
+		auth: auth,
+		newRequest: func() *radius.Packet {
+			p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+			rfc2865.UserName_SetString(p, auth.outerIdentity())
+			return p
+		},
+		exchange: exchange,
+	}
+}
+
+// TestEAPMD5 tests an EAP-MD5 conversation, with a Nak of the method the
+// server proposes first and the State echoed in each request
+func TestEAPMD5(t *testing.T) {
+	auth := &Authentication{EAPMethod: "md5", Identity: "printer", Password: "s3cret"}
+	challenge := []byte("0123456789abcdef")
+
+	exchange := fakeEAPServer(t, func(resp *eapPacket, state []byte) *eapPacket {
+		switch {
+		case state == nil:
+			if resp.Type != eapTypeIdentity || string(resp.Data) != "printer" {
+				t.Errorf("expected the identity, got type %d %q", resp.Type, resp.Data)
+			}
+			return &eapPacket{Code: eapRequest, ID: 1, Type: eapTypePEAP, Data: []byte{eapTLSStart}}
+		case state[0] == 1:
+			if resp.ID != 1 || resp.Type != eapTypeNak || !bytes.Equal(resp.Data, []byte{eapTypeMD5}) {
+				t.Errorf("expected a Nak for MD5, got %+v", resp)
+			}
+			return &eapPacket{Code: eapRequest, ID: 2, Type: eapTypeMD5, Data: append([]byte{byte(len(challenge))}, challenge...)}
+		case state[0] == 2:
+			expected := md5.Sum(append(append([]byte{2}, "s3cret"...), challenge...))
+			if resp.ID != 2 || resp.Type != eapTypeMD5 || !bytes.Equal(resp.Data[1:17], expected[:]) {
+				t.Errorf("invalid MD5 response %+v", resp)
+			}
+			return nil
+		}
+		t.Fatalf("unexpected State %x", state)
+		return nil
+	})
+
+	result, err := newTestSupplicant(auth, exchange).Authenticate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Code != radius.CodeAccessAccept {
+		t.Errorf("expected an Access-Accept, got %s", result.Code)
+	}
+}
+
+// TestMSCHAPv2 tests the MSCHAPv2 response and authenticator check with
+// the example of RFC 2759 9.2
+func TestMSCHAPv2(t *testing.T) {
+	authChallenge, _ := hex.DecodeString("5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge, _ := hex.DecodeString("21402324255E262A28295F2B3A337C7E")
+	ntResponse, _ := hex.DecodeString("82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")
+
+	resp, err := mschapv2ChallengeResponse(7, authChallenge, peerChallenge, `EXAMPLE\User`, "clientPass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp[0] != eapTypeMSCHAPv2 || resp[1] != mschapv2Response || resp[2] != 7 {
+		t.Errorf("invalid response header % x", resp[:3])
+	}
+	if length := binary.BigEndian.Uint16(resp[3:5]); int(length) != 54+len(`EXAMPLE\User`) {
+		t.Errorf("MS-Length %d", length)
+	}
+	if resp[5] != 49 || !bytes.Equal(resp[6:22], peerChallenge) || !bytes.Equal(resp[30:54], ntResponse) {
+		t.Errorf("invalid response value % x", resp[5:55])
+	}
+	if name := string(resp[55:]); name != `EXAMPLE\User` {
+		t.Errorf("name %q", name)
+	}
+
+	s := &eapSupplicant{auth: &Authentication{Identity: "User", Password: "clientPass"}}
+	challenge := append(append([]byte(nil), authChallenge...), peerChallenge...)
+	success := append([]byte{mschapv2Success, 7, 0, 0}, "S=407A5589115FD0D6209F510FE9C04566932CDA56 M=Welcome"...)
+	resp, _, err = s.mschapv2(success, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resp, []byte{eapTypeMSCHAPv2, mschapv2Success}) {
+		t.Errorf("unexpected answer to success % x", resp)
+	}
+
+	s.auth.Password = "wrong"
+	if _, _, err := s.mschapv2(success, challenge); err == nil {
+		t.Error("authenticator response of another password accepted")
+	}
+}
+
+// TestEAPTLSFragments tests the fragmentation of the TLS data sent and the
+// reassembly of the fragments received
+func TestEAPTLSFragments(t *testing.T) {
+	out := bytes.Repeat([]byte{0xaa}, 2*eapTLSFragments+500)
+	in := bytes.Repeat([]byte{0xbb}, eapTLSFragments+10)
+
+	var received []byte
+	var acks int
+	exchange := fakeEAPServer(t, func(resp *eapPacket, _ []byte) *eapPacket {
+		flags, body := resp.Data[0], resp.Data[1:]
+		if flags&eapTLSLength != 0 {
+			if total := binary.BigEndian.Uint32(body); total != uint32(len(out)) {
+				t.Errorf("TLS message length %d, expected %d", total, len(out))
+			}
+			body = body[4:]
+		}
+		received = append(received, body...)
+
+		switch {
+		case flags&eapTLSMore != 0:
+			// Acknowledge the fragment
+			return &eapPacket{Code: eapRequest, ID: resp.ID + 1, Type: eapTypePEAP, Data: []byte{0}}
+		case len(received) == len(out) && len(body) > 0:
+			first := binary.BigEndian.AppendUint32([]byte{eapTLSLength | eapTLSMore}, uint32(len(in)))
+			return &eapPacket{Code: eapRequest, ID: resp.ID + 1, Type: eapTypePEAP, Data: append(first, in[:eapTLSFragments]...)}
+		default:
+			acks++
+			return &eapPacket{Code: eapRequest, ID: resp.ID + 1, Type: eapTypePEAP, Data: append([]byte{0}, in[eapTLSFragments:]...)}
+		}
+	})
+
+	s := newTestSupplicant(&Authentication{Identity: "printer"}, exchange)
+	s.ctx = context.Background()
+	conn := &eapTLSConn{s: s, method: eapTypePEAP, id: 1}
+	conn.Write(out)
+	if err := conn.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, out) {
+		t.Errorf("server received %d bytes, sent %d", len(received), len(out))
+	}
+	if acks != 1 || !bytes.Equal(conn.in.Bytes(), in) {
+		t.Errorf("reassembled %d bytes after %d acks, expected %d after 1", conn.in.Len(), acks, len(in))
+	}
+}
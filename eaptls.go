@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"layeh.com/radius/rfc2759"
+)
+
+// EAP-TLS flags (RFC 5216 3.1), PEAP uses the low bits for its version
+const (
+	eapTLSLength    = 0x80
+	eapTLSMore      = 0x40
+	eapTLSStart     = 0x20
+	eapTLSFragments = 1000 // TLS data carried by one EAP packet
+)
+
+// MSCHAPv2 opcodes (draft-kamath-pppext-eap-mschapv2)
+const (
+	mschapv2Challenge = 1
+	mschapv2Response  = 2
+	mschapv2Success   = 3
+	mschapv2Failure   = 4
+)
+
+// eapTLVResult is the Result TLV of the PEAP extensions, with the
+// mandatory bit set
+const eapTLVResult = 0x8003
+
+// eapTLSConn carries the TLS records of EAP-TLS or PEAP in EAP packets.
+// Writes are buffered until the next read, which sends them and reads the
+// answer of the server.
+type eapTLSConn struct {
+	s      *eapSupplicant
+	method byte
+	id     byte // Identifier of the last EAP request
+	in     bytes.Buffer
+	out    bytes.Buffer
+}
+
+func (c *eapTLSConn) Read(b []byte) (int, error) {
+	if c.in.Len() == 0 {
+		if err := c.flush(); err != nil {
+			return 0, err
+		}
+	}
+	return c.in.Read(b)
+}
+
+func (c *eapTLSConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+// flush sends the buffered TLS data, an empty response when there is
+// none, then reads the next message of the server
+func (c *eapTLSConn) flush() error {
+	data := c.out.Bytes()
+	total := len(data)
+	c.out.Reset()
+
+	var req *eapPacket
+	var err error
+	for first := true; ; first = false {
+		n := min(len(data), eapTLSFragments)
+		var flags byte
+		var body []byte
+		if n < len(data) {
+			flags |= eapTLSMore
+		}
+		if first && n < total {
+			flags |= eapTLSLength
+			body = binary.BigEndian.AppendUint32(body, uint32(total))
+		}
+		body = append([]byte{flags}, append(body, data[:n]...)...)
+		data = data[n:]
+
+		if req, err = c.send(body); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			break
+		}
+		// The server acknowledges each fragment with an empty request
+		if len(req.Data) > 1 {
+			return fmt.Errorf("EAP: expected a fragment acknowledgement")
+		}
+	}
+
+	for {
+		if len(req.Data) < 1 {
+			return fmt.Errorf("EAP: missing TLS flags")
+		}
+		flags, body := req.Data[0], req.Data[1:]
+		if flags&eapTLSLength != 0 {
+			if len(body) < 4 {
+				return fmt.Errorf("EAP: truncated TLS message length")
+			}
+			body = body[4:]
+		}
+		c.in.Write(body)
+		if flags&eapTLSMore == 0 {
+			return nil
+		}
+		// Acknowledge the fragment to get the next one
+		if req, err = c.send([]byte{0}); err != nil {
+			return err
+		}
+	}
+}
+
+// send sends one EAP-TLS or PEAP response and returns the next request
+func (c *eapTLSConn) send(body []byte) (*eapPacket, error) {
+	req, err := c.s.roundTrip(&eapPacket{Code: eapResponse, ID: c.id, Type: c.method, Data: body})
+	if err != nil {
+		return nil, err
+	}
+	if req.Type != c.method {
+		return nil, fmt.Errorf("EAP: expected method %d, received %d", c.method, req.Type)
+	}
+	c.id = req.ID
+	return req, nil
+}
+
+func (c *eapTLSConn) Close() error                     { return nil }
+func (c *eapTLSConn) LocalAddr() net.Addr              { return nil }
+func (c *eapTLSConn) RemoteAddr() net.Addr             { return nil }
+func (c *eapTLSConn) SetDeadline(time.Time) error      { return nil }
+func (c *eapTLSConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *eapTLSConn) SetWriteDeadline(time.Time) error { return nil }
+
+// tlsConfig builds the TLS configuration of the supplicant. The server
+// certificate is only checked against eap_ca_cert when it is set, its name
+// is not checked, like most supplicants do.
+func (a *Authentication) tlsConfig(method byte) (*tls.Config, error) {
+	cfg := &tls.Config{
+		InsecureSkipVerify: true,
+		MaxVersion:         tls.VersionTLS12,
+	}
+
+	if a.CACert != "" {
+		roots, err := loadCertPool(a.CACert)
+		if err != nil {
+			return nil, err
+		}
+		cfg.VerifyPeerCertificate = verifyCertChain(roots)
+	}
+
+	if method == eapTypeTLS {
+		cert, err := tls.LoadX509KeyPair(a.ClientCert, a.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %v", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// tls runs EAP-TLS (RFC 5216) or PEAPv0 with EAP-MSCHAPv2 inside, from
+// the Start request of the server
+func (s *eapSupplicant) tls(start *eapPacket, method byte) error {
+	if len(start.Data) < 1 || start.Data[0]&eapTLSStart == 0 {
+		return fmt.Errorf("EAP: expected a TLS start")
+	}
+	cfg, err := s.auth.tlsConfig(method)
+	if err != nil {
+		return err
+	}
+
+	conn := &eapTLSConn{s: s, method: method, id: start.ID}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(s.ctx); err != nil {
+		return s.tlsError(err)
+	}
+
+	if method == eapTypeTLS {
+		// Acknowledge the end of the handshake to get the EAP-Success
+		return s.tlsError(conn.flush())
+	}
+	return s.tlsError(s.peap(tlsConn))
+}
+
+// tlsError reports an error of the tunnel, unless the server ended the
+// conversation
+func (s *eapSupplicant) tlsError(err error) error {
+	if err == nil || s.result != nil {
+		return errEAPDone
+	}
+	return err
+}
+
+// peap runs the phase 2 of PEAPv0: the inner EAP packets have no header,
+// except the EAP-TLV ones
+func (s *eapSupplicant) peap(tlsConn *tls.Conn) error {
+	buf := make([]byte, 4096)
+	var challenge []byte
+	for {
+		n, err := tlsConn.Read(buf)
+		if err != nil {
+			return err
+		}
+		inner := buf[:n]
+
+		if len(inner) >= 5 && inner[0] == eapRequest && int(binary.BigEndian.Uint16(inner[2:4])) == len(inner) && inner[4] == eapTypeExtensions {
+			req, err := parseEAP(inner)
+			if err != nil {
+				return err
+			}
+			result := parseTLVResult(req.Data)
+			if result == 0 {
+				return fmt.Errorf("PEAP: no Result TLV")
+			}
+			// Echo the result to get the Access-Accept or Access-Reject
+			tlv := []byte{eapTLVResult >> 8, eapTLVResult & 0xff, 0, 2, byte(result >> 8), byte(result)}
+			resp := &eapPacket{Code: eapResponse, ID: req.ID, Type: eapTypeExtensions, Data: tlv}
+			if _, err := tlsConn.Write(resp.MarshalBinary()); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(inner) < 1 {
+			return fmt.Errorf("PEAP: empty inner packet")
+		}
+
+		var resp []byte
+		switch inner[0] {
+		case eapTypeIdentity:
+			resp = append([]byte{eapTypeIdentity}, s.auth.Identity...)
+		case eapTypeMSCHAPv2:
+			resp, challenge, err = s.mschapv2(inner[1:], challenge)
+			if err != nil {
+				return err
+			}
+		default:
+			resp = []byte{eapTypeNak, eapTypeMSCHAPv2}
+		}
+		if _, err := tlsConn.Write(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// parseTLVResult returns the status of the Result TLV, 1 for success and
+// 2 for failure, or 0 when there is none
+func parseTLVResult(tlvs []byte) uint16 {
+	for len(tlvs) >= 4 {
+		typ := binary.BigEndian.Uint16(tlvs[0:2]) & 0x3fff
+		length := int(binary.BigEndian.Uint16(tlvs[2:4]))
+		if len(tlvs) < 4+length {
+			return 0
+		}
+		if typ == eapTLVResult&0x3fff && length == 2 {
+			return binary.BigEndian.Uint16(tlvs[4:6])
+		}
+		tlvs = tlvs[4+length:]
+	}
+	return 0
+}
+
+// mschapv2 answers an inner EAP-MSCHAPv2 request and returns the header-less
+// response. challenge is the authenticator and peer challenges of the last
+// response, to check the authenticator response of the server.
+func (s *eapSupplicant) mschapv2(data, challenge []byte) ([]byte, []byte, error) {
+	if len(data) < 4 {
+		return nil, nil, fmt.Errorf("MSCHAPv2: truncated request")
+	}
+	opcode, id := data[0], data[1]
+
+	switch opcode {
+	case mschapv2Challenge:
+		if len(data) < 5+16 || data[4] != 16 {
+			return nil, nil, fmt.Errorf("MSCHAPv2: invalid challenge")
+		}
+		peerChallenge := make([]byte, 16)
+		if _, err := rand.Read(peerChallenge); err != nil {
+			return nil, nil, err
+		}
+		authChallenge := data[5:21]
+		resp, err := mschapv2ChallengeResponse(id, authChallenge, peerChallenge, s.auth.Identity, s.auth.Password)
+		if err != nil {
+			return nil, nil, err
+		}
+		return resp, append(append([]byte(nil), authChallenge...), peerChallenge...), nil
+
+	case mschapv2Success:
+		if len(challenge) != 32 {
+			return nil, nil, fmt.Errorf("MSCHAPv2: success without challenge")
+		}
+		user := []byte(mschapv2UserName(s.auth.Identity))
+		nt, err := rfc2759.GenerateNTResponse(challenge[:16], challenge[16:], user, []byte(s.auth.Password))
+		if err != nil {
+			return nil, nil, err
+		}
+		expected, err := rfc2759.GenerateAuthenticatorResponse(challenge[:16], challenge[16:], nt, user, []byte(s.auth.Password))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !strings.HasPrefix(strings.ToUpper(string(data[4:])), expected) {
+			return nil, nil, fmt.Errorf("MSCHAPv2: invalid authenticator response from the server")
+		}
+		return []byte{eapTypeMSCHAPv2, mschapv2Success}, nil, nil
+
+	case mschapv2Failure:
+		logger.Debug("MSCHAPv2 failure: %s", data[4:])
+		return []byte{eapTypeMSCHAPv2, mschapv2Failure}, nil, nil
+	}
+	return nil, nil, fmt.Errorf("MSCHAPv2: unexpected opcode %d", opcode)
+}
+
+// mschapv2ChallengeResponse builds the header-less Response to an
+// MSCHAPv2 Challenge
+func mschapv2ChallengeResponse(id byte, authChallenge, peerChallenge []byte, identity, password string) ([]byte, error) {
+	nt, err := rfc2759.GenerateNTResponse(authChallenge, peerChallenge, []byte(mschapv2UserName(identity)), []byte(password))
+	if err != nil {
+		return nil, err
+	}
+	// Peer challenge, 8 reserved bytes, NT-Response and flags
+	value := make([]byte, 0, 49)
+	value = append(value, peerChallenge...)
+	value = append(value, make([]byte, 8)...)
+	value = append(value, nt...)
+	value = append(value, 0)
+
+	resp := []byte{eapTypeMSCHAPv2, mschapv2Response, id, 0, 0, byte(len(value))}
+	resp = append(resp, value...)
+	resp = append(resp, identity...)
+	binary.BigEndian.PutUint16(resp[3:5], uint16(len(resp)-1))
+	return resp, nil
+}
+
+// mschapv2UserName strips the domain of an identity, MSCHAPv2 hashes the
+// user name alone
+func mschapv2UserName(identity string) string {
+	if i := strings.LastIndex(identity, `\`); i >= 0 {
+		return identity[i+1:]
+	}
+	return identity
+}
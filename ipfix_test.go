@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// decodeIPFIXRecord returns the fields of the first data record of a
+// message by Information Element ID, walking its template
+func decodeIPFIXRecord(t *testing.T, msg []byte) map[uint16][]byte {
+	t.Helper()
+	if binary.BigEndian.Uint16(msg[0:2]) != 10 || int(binary.BigEndian.Uint16(msg[2:4])) != len(msg) {
+		t.Fatalf("invalid IPFIX header % x", msg[:16])
+	}
+	template := msg[16:]
+	if binary.BigEndian.Uint16(template[0:2]) != 2 {
+		t.Fatalf("expected a template set first, got set %d", binary.BigEndian.Uint16(template[0:2]))
+	}
+	setLen := binary.BigEndian.Uint16(template[2:4])
+	count := int(binary.BigEndian.Uint16(template[6:8]))
+
+	type field struct{ id, length uint16 }
+	var fields []field
+	offset := 8
+	for n := 0; n < count; n++ {
+		id, length := binary.BigEndian.Uint16(template[offset:]), binary.BigEndian.Uint16(template[offset+2:])
+		offset += 4
+		if id&0x8000 != 0 {
+			// Enterprise fields are keyed by their number with the bit set
+			offset += 4
+		}
+		fields = append(fields, field{id, length})
+	}
+	if offset != int(setLen) {
+		t.Fatalf("template set length %d, fields end at %d", setLen, offset)
+	}
+
+	data := template[setLen+4:]
+	record := make(map[uint16][]byte)
+	for _, f := range fields {
+		record[f.id] = data[:f.length]
+		data = data[f.length:]
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes left after the data record", len(data))
+	}
+	return record
+}
+
+// testIPFIX returns the IPFIX configuration of a device exporting the
+// template
+func testIPFIX(t *testing.T, template string) *IpFix {
+	t.Helper()
+	tmpl, err := parseIPFIXTemplate(ipfixTemplateID, template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &IpFix{DeviceIP: net.ParseIP("10.10.1.45"), DeviceMAC: "f0:6d:ab:74:f5:a2", Template: tmpl}
+}
+
+// testIPFIXMessage returns the message with the template exporting a flow
+func testIPFIXMessage(i *IpFix, flow Traffic) []byte {
+	e := newIPFIXExporter(nil, i.Template, defaultIPFIXMTU, 0)
+	return e.message(time.Now(), true, [][]byte{i.generateIPFIXRecord(flow)})
+}
+
+func TestIPFIXFlowFields(t *testing.T) {
+	i := testIPFIX(t, "[]")
+	flows, err := i.readIpFixTraffic(`[
+		{"SourceIP": "10.10.1.45", "DestinationIP": "10.10.1.100", "SourcePort": 51515, "DestinationPort": 9100, "Packets": 1500, "Octets": 2048576, "Protocol": "TCP"},
+		{"SourceIP": "10.10.1.1", "DestinationIP": "10.10.1.45", "SourcePort": 161, "DestinationPort": 40000, "Packets": 4, "Protocol": "udp"},
+		{"SourceIP": "10.10.1.45", "DestinationIP": "10.10.1.100", "SourcePort": 1, "DestinationPort": 2, "Packets": 1, "Protocol": "TCP",
+		 "TCPFlags": 2, "Direction": "egress", "ApplicationID": 218103848}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printJob := decodeIPFIXRecord(t, testIPFIXMessage(i, flows[0]))
+	if octets := binary.BigEndian.Uint64(printJob[1]); octets != 2048576 {
+		t.Errorf("octetDeltaCount %d", octets)
+	}
+	if printJob[6][0] != ipfixTCPFlags || printJob[61][0] != ipfixIngress || printJob[4][0] != 6 {
+		t.Errorf("TCP flags %#x, direction %d, protocol %d", printJob[6][0], printJob[61][0], printJob[4][0])
+	}
+	if app := binary.BigEndian.Uint32(printJob[95]); app != 3<<24|9100 {
+		t.Errorf("applicationId %#x, expected IANA port 9100", app)
+	}
+
+	// Octets default from the packets, UDP has no flags and the server
+	// port is the source one
+	snmp := decodeIPFIXRecord(t, testIPFIXMessage(i, flows[1]))
+	if octets := binary.BigEndian.Uint64(snmp[1]); octets != 4*ipfixPacketOctets {
+		t.Errorf("octetDeltaCount %d", octets)
+	}
+	if snmp[6][0] != 0 || snmp[61][0] != ipfixEgress || snmp[4][0] != 17 {
+		t.Errorf("TCP flags %#x, direction %d, protocol %d", snmp[6][0], snmp[61][0], snmp[4][0])
+	}
+	if app := binary.BigEndian.Uint32(snmp[95]); app != 3<<24|161 {
+		t.Errorf("applicationId %#x, expected IANA port 161", app)
+	}
+
+	configured := decodeIPFIXRecord(t, testIPFIXMessage(i, flows[2]))
+	if configured[6][0] != 2 || configured[61][0] != ipfixEgress || binary.BigEndian.Uint32(configured[95]) != 218103848 {
+		t.Errorf("configured fields not exported: flags %#x, direction %d, app %d",
+			configured[6][0], configured[61][0], binary.BigEndian.Uint32(configured[95]))
+	}
+
+	if _, err := i.readIpFixTraffic(`[{"Protocol": "SCTPX"}]`); err == nil {
+		t.Error("unknown protocol accepted")
+	}
+	if _, err := i.readIpFixTraffic(`[{"Protocol": "TCP", "Direction": "up"}]`); err == nil {
+		t.Error("invalid direction accepted")
+	}
+}
+
+// TestIPFIXLeasedAddress tests that the flows of the configured address
+// move to the leased one
+func TestIPFIXLeasedAddress(t *testing.T) {
+	i := testIPFIX(t, "[]")
+	flows, err := i.readIpFixTraffic(`[
+		{"SourceIP": "10.10.1.45", "DestinationIP": "10.10.1.100", "SourcePort": 51515, "DestinationPort": 9100, "Packets": 1},
+		{"SourceIP": "10.10.1.1", "DestinationIP": "10.10.1.45", "SourcePort": 161, "DestinationPort": 40000, "Packets": 1}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease := net.ParseIP("10.10.1.22")
+	leased := withDeviceIP(flows, i.DeviceIP, lease)
+	if !leased[0].SourceIP.Equal(lease) || !leased[0].DestinationIP.Equal(flows[0].DestinationIP) ||
+		!leased[1].DestinationIP.Equal(lease) || !leased[1].SourceIP.Equal(flows[1].SourceIP) {
+		t.Errorf("flows %+v", leased)
+	}
+	if !flows[0].SourceIP.Equal(i.DeviceIP) {
+		t.Error("configured flows changed")
+	}
+
+	i.DeviceIP = lease
+	_, mac, _ := i.getDeviceInfo()
+	src, dst := determineMACAddresses(leased[0], i.DeviceIP, mac)
+	if !bytes.Equal(src, mac) || bytes.Equal(dst, mac) {
+		t.Errorf("MACs %x -> %x", src, dst)
+	}
+}
+
+// TestIPFIXExporter tests the sequence numbers, the template refresh and
+// the packing of the records up to the MTU
+func TestIPFIXExporter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer collector.Close()
+	conn, err := net.Dial("udp", collector.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// receive returns the sequence number, whether the message has the
+	// template and its number of data records
+	receive := func() (sequence uint32, template bool, records int) {
+		t.Helper()
+		b := make([]byte, 65535)
+		collector.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := collector.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := b[:n]
+		if n > defaultIPFIXMTU-ipfixUDPOverhead || int(binary.BigEndian.Uint16(msg[2:4])) != n {
+			t.Fatalf("message of %d bytes, length %d", n, binary.BigEndian.Uint16(msg[2:4]))
+		}
+		for set := msg[ipfixHeaderLength:]; len(set) > 0; {
+			length := binary.BigEndian.Uint16(set[2:4])
+			switch binary.BigEndian.Uint16(set[0:2]) {
+			case ipfixTemplateSetID:
+				template = true
+			case ipfixTemplateID:
+				records = (int(length) - ipfixSetHeaderLength) / 101
+			}
+			set = set[length:]
+		}
+		return binary.BigEndian.Uint32(msg[8:12]), template, records
+	}
+
+	i := testIPFIX(t, "[]")
+	flows, _ := i.readIpFixTraffic(`[{"SourceIP": "10.10.1.45", "DestinationIP": "10.10.1.100", "SourcePort": 51515, "DestinationPort": 9100, "Packets": 10, "Protocol": "TCP"}]`)
+	records := make([][]byte, 30)
+	for n := range records {
+		records[n] = i.generateIPFIXRecord(flows[0])
+	}
+
+	e := newIPFIXExporter(conn, i.Template, defaultIPFIXMTU, time.Minute)
+	if err := e.Export(records); err != nil {
+		t.Fatal(err)
+	}
+	// 1472 bytes hold the template and 13 records, then 14 records
+	expected := []struct {
+		sequence uint32
+		template bool
+		records  int
+	}{{0, true, 13}, {13, false, 14}, {27, false, 3}}
+	for _, want := range expected {
+		if sequence, template, n := receive(); sequence != want.sequence || template != want.template || n != want.records {
+			t.Errorf("got sequence %d, template %v, %d records, expected %+v", sequence, template, n, want)
+		}
+	}
+
+	// The template is sent again once the refresh interval is over
+	e.templateSent = time.Now().Add(-time.Minute)
+	if err := e.Export(records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if sequence, template, n := receive(); sequence != 30 || !template || n != 1 {
+		t.Errorf("got sequence %d, template %v, %d records after the refresh interval", sequence, template, n)
+	}
+}
+
+// TestIPFIXTemplate tests a template of names, numbers and elements
+// unknown to the registry
+func TestIPFIXTemplate(t *testing.T) {
+	i := testIPFIX(t, `["sourceIPv4Address", 12, "7", {"name": "tcpControlBits", "length": 2},
+		{"id": 12236, "enterprise": 9}, {"id": 56701, "enterprise": 25461, "length": 8, "value": "ssl"},
+		{"id": 10, "length": 4, "value": 3}]`)
+	if len(i.Template.Fields) != 7 || i.Template.recordLength() != 4+4+2+2+4+8+4 {
+		t.Fatalf("unexpected template %s", i.Template)
+	}
+	if name := i.Template.String(); name != "sourceIPv4Address, destinationIPv4Address, sourceTransportPort, tcpControlBits, connectionClientIPv4Address, 25461/23933, 10" {
+		t.Errorf("template %s", name)
+	}
+
+	msg := testIPFIXMessage(i, Traffic{SourceIP: net.ParseIP("10.10.1.45"), DestinationIP: net.ParseIP("10.10.1.100"), SourcePort: 51515, DestinationPort: 443, Protocol: "TCP"})
+	record := decodeIPFIXRecord(t, msg)
+	if !net.IP(record[8]).Equal(net.ParseIP("10.10.1.45")) || !net.IP(record[12]).Equal(net.ParseIP("10.10.1.100")) {
+		t.Errorf("addresses %v %v", net.IP(record[8]), net.IP(record[12]))
+	}
+	if binary.BigEndian.Uint16(record[7]) != 51515 || binary.BigEndian.Uint16(record[6]) != ipfixTCPFlags {
+		t.Errorf("port %d, TCP flags %#x", binary.BigEndian.Uint16(record[7]), binary.BigEndian.Uint16(record[6]))
+	}
+	if !net.IP(record[0x8000|12236]).Equal(net.ParseIP("10.10.1.45")) {
+		t.Errorf("Cisco client address %v", net.IP(record[0x8000|12236]))
+	}
+	if string(record[56701]) != "ssl\x00\x00\x00\x00\x00" || binary.BigEndian.Uint32(record[10]) != 3 {
+		t.Errorf("constant values %q, %d", record[56701], binary.BigEndian.Uint32(record[10]))
+	}
+
+	for _, invalid := range []string{
+		`["noSuchElement"]`,
+		`[{"id": 56701, "enterprise": 25461}]`,
+		`[{"name": "sourceMacAddress", "length": 4}]`,
+		`[{"id": 10, "length": 1, "value": "too long"}]`,
+	} {
+		if _, err := parseIPFIXTemplate(ipfixTemplateID, invalid); err == nil {
+			t.Errorf("invalid template %s accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// IPFIX message layout (RFC 7011)
+const (
+	ipfixVersion           = 10
+	ipfixHeaderLength      = 16
+	ipfixSetHeaderLength   = 4
+	ipfixTemplateSetID     = 2
+	ipfixTemplateID        = 257 // Default template ID
+	ipfixObservationDomain = 257
+	ipfixUDPOverhead       = 28 // IPv4 and UDP headers
+
+	defaultIPFIXMTU        = 1500
+	defaultTemplateRefresh = 10 * time.Minute
+)
+
+// ipfixExporter is the exporting process sending the flows of the devices
+// to a collector over one UDP socket, like a switch exports the flows of
+// all its ports. It numbers the data records for the sequence numbers of
+// the messages, sends the template in the first message and again every
+// refresh interval, and packs as many records as the MTU allows in each
+// message. Devices exporting different templates have their own exporter.
+type ipfixExporter struct {
+	conn       net.Conn
+	templateID uint16
+	template   []byte        // Template set
+	maxMessage int           // Largest message fitting the MTU
+	refresh    time.Duration // Template refresh interval, 0 sends it once
+
+	mu           sync.Mutex
+	sequence     uint32    // Data records sent, modulo 2^32
+	templateSent time.Time // Last message carrying the template
+}
+
+// ipfixExporters holds the exporter of each collector, shared by the
+// devices
+var ipfixExporters = &ipfixExporterRegistry{exporters: make(map[string]*ipfixExporter)}
+
+type ipfixExporterRegistry struct {
+	mu        sync.Mutex
+	exporters map[string]*ipfixExporter
+}
+
+// get returns the exporter of the template of cfg to its collector,
+// created on first use with its MTU and template refresh interval
+func (r *ipfixExporterRegistry) get(cfg *IpFix) (*ipfixExporter, error) {
+	addr := net.JoinHostPort(cfg.DestinationIP.String(), strconv.Itoa(cfg.DestinationPort))
+	key := addr + "/" + string(cfg.Template.templateSet())
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e, ok := r.exporters[key]; ok {
+		return e, nil
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	e := newIPFIXExporter(conn, cfg.Template, cfg.MTU, cfg.TemplateRefresh)
+	r.exporters[key] = e
+	logger.Info("IPFIX exporter to %s started", addr)
+	return e, nil
+}
+
+func newIPFIXExporter(conn net.Conn, template *ipfixTemplate, mtu int, refresh time.Duration) *ipfixExporter {
+	return &ipfixExporter{
+		conn:       conn,
+		templateID: template.ID,
+		template:   template.templateSet(),
+		maxMessage: mtu - ipfixUDPOverhead,
+		refresh:    refresh,
+	}
+}
+
+// Export sends data records in as few messages as the MTU allows
+func (e *ipfixExporter) Export(records [][]byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	for len(records) > 0 || e.templateDue(now) {
+		withTemplate := e.templateDue(now)
+		room := e.maxMessage - ipfixHeaderLength - ipfixSetHeaderLength
+		if withTemplate {
+			room -= len(e.template)
+		}
+		n, size := 0, 0
+		for n < len(records) && size+len(records[n]) <= room {
+			size += len(records[n])
+			n++
+		}
+		if n == 0 && !withTemplate {
+			return fmt.Errorf("IPFIX record of %d bytes does not fit in the MTU", len(records[0]))
+		}
+
+		message := e.message(now, withTemplate, records[:n])
+		if _, err := e.conn.Write(message); err != nil {
+			return err
+		}
+		metrics.IncrementIPFIX()
+		if withTemplate {
+			e.templateSent = now
+		}
+		e.sequence += uint32(n)
+		records = records[n:]
+	}
+	return nil
+}
+
+// templateDue reports whether the next message must carry the template
+func (e *ipfixExporter) templateDue(now time.Time) bool {
+	return e.templateSent.IsZero() || (e.refresh > 0 && now.Sub(e.templateSent) >= e.refresh)
+}
+
+// message builds an IPFIX message with the template, if asked, and a data
+// set of the records. Its sequence number counts the records sent before.
+func (e *ipfixExporter) message(now time.Time, withTemplate bool, records [][]byte) []byte {
+	message := make([]byte, ipfixHeaderLength, e.maxMessage)
+	binary.BigEndian.PutUint16(message[0:2], ipfixVersion)
+	binary.BigEndian.PutUint32(message[4:8], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(message[8:12], e.sequence)
+	binary.BigEndian.PutUint32(message[12:16], ipfixObservationDomain)
+
+	if withTemplate {
+		message = append(message, e.template...)
+	}
+	if len(records) > 0 {
+		set := len(message)
+		message = append(message, 0, 0, 0, 0)
+		for _, record := range records {
+			message = append(message, record...)
+		}
+		binary.BigEndian.PutUint16(message[set:set+2], e.templateID) // Set ID matches Template ID
+		binary.BigEndian.PutUint16(message[set+2:set+4], uint16(len(message)-set))
+	}
+	binary.BigEndian.PutUint16(message[2:4], uint16(len(message)))
+	return message
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ipfixFlow is a flow of the traffic JSON with the values derived for its
+// export
+type ipfixFlow struct {
+	*Traffic
+	srcMAC, dstMAC []byte
+	protocol       uint8
+	direction      uint8
+	start, end     time.Time
+}
+
+// ipfixElement is an Information Element of the registry and how its value
+// is taken from a flow: an unsigned integer sent in reduced-size encoding
+// (RFC 7011 6.2) when the template shortens it, or bytes of a fixed length
+type ipfixElement struct {
+	Name       string
+	ID         uint16
+	Enterprise uint32 // Private Enterprise Number, 0 for the IANA elements
+	Length     uint16
+
+	unsigned func(f *ipfixFlow) uint64
+	bytes    func(f *ipfixFlow) []byte
+}
+
+// Value getters of the registry
+func ipfixConstant(v uint64) func(*ipfixFlow) uint64 {
+	return func(*ipfixFlow) uint64 { return v }
+}
+
+func ipfixSourceIP(f *ipfixFlow) []byte        { return f.SourceIP.To4() }
+func ipfixDestinationIP(f *ipfixFlow) []byte   { return f.DestinationIP.To4() }
+func ipfixSourceMAC(f *ipfixFlow) []byte       { return f.srcMAC }
+func ipfixDestinationMAC(f *ipfixFlow) []byte  { return f.dstMAC }
+func ipfixSourcePort(f *ipfixFlow) uint64      { return uint64(f.SourcePort) }
+func ipfixDestinationPort(f *ipfixFlow) uint64 { return uint64(f.DestinationPort) }
+func ipfixPackets(f *ipfixFlow) uint64         { return uint64(f.Packets) }
+func ipfixOctets(f *ipfixFlow) uint64          { return f.octets() }
+func ipfixStartMillis(f *ipfixFlow) uint64     { return uint64(f.start.UnixMilli()) }
+func ipfixEndMillis(f *ipfixFlow) uint64       { return uint64(f.end.UnixMilli()) }
+
+// ipfixRegistry lists the Information Elements filled from the flows: the
+// IANA ones and the Cisco (PEN 9) connection elements
+var ipfixRegistry = []ipfixElement{
+	{Name: "octetDeltaCount", ID: 1, Length: 8, unsigned: ipfixOctets},
+	{Name: "packetDeltaCount", ID: 2, Length: 8, unsigned: ipfixPackets},
+	{Name: "protocolIdentifier", ID: 4, Length: 1, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.protocol) }},
+	{Name: "ipClassOfService", ID: 5, Length: 1, unsigned: ipfixConstant(0)},
+	{Name: "tcpControlBits", ID: 6, Length: 1, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.tcpFlags(f.protocol)) }},
+	{Name: "sourceTransportPort", ID: 7, Length: 2, unsigned: ipfixSourcePort},
+	{Name: "sourceIPv4Address", ID: 8, Length: 4, bytes: ipfixSourceIP},
+	{Name: "destinationTransportPort", ID: 11, Length: 2, unsigned: ipfixDestinationPort},
+	{Name: "destinationIPv4Address", ID: 12, Length: 4, bytes: ipfixDestinationIP},
+	{Name: "sourceMacAddress", ID: 56, Length: 6, bytes: ipfixSourceMAC},
+	{Name: "postDestinationMacAddress", ID: 57, Length: 6, bytes: ipfixDestinationMAC},
+	{Name: "ipVersion", ID: 60, Length: 1, unsigned: ipfixConstant(4)},
+	{Name: "flowDirection", ID: 61, Length: 1, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.direction) }},
+	{Name: "destinationMacAddress", ID: 80, Length: 6, bytes: ipfixDestinationMAC},
+	{Name: "postSourceMacAddress", ID: 81, Length: 6, bytes: ipfixSourceMAC},
+	{Name: "octetTotalCount", ID: 85, Length: 8, unsigned: ipfixOctets},
+	{Name: "packetTotalCount", ID: 86, Length: 8, unsigned: ipfixPackets},
+	{Name: "applicationId", ID: 95, Length: 4, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.applicationID()) }},
+	{Name: "flowEndReason", ID: 136, Length: 1, unsigned: ipfixConstant(3)}, // End of flow detected
+	{Name: "observationPointId", ID: 138, Length: 8, unsigned: ipfixConstant(1)},
+	{Name: "flowStartSeconds", ID: 150, Length: 4, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.start.Unix()) }},
+	{Name: "flowEndSeconds", ID: 151, Length: 4, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.end.Unix()) }},
+	{Name: "flowStartMilliseconds", ID: 152, Length: 8, unsigned: ipfixStartMillis},
+	{Name: "flowEndMilliseconds", ID: 153, Length: 8, unsigned: ipfixEndMillis},
+	{Name: "flowDurationMilliseconds", ID: 161, Length: 4, unsigned: func(f *ipfixFlow) uint64 { return uint64(f.end.Sub(f.start).Milliseconds()) }},
+	{Name: "biflowDirection", ID: 239, Length: 1, unsigned: ipfixConstant(1)}, // Initiator
+	{Name: "newConnectionDeltaCount", ID: 278, Length: 4, unsigned: ipfixConstant(1)},
+
+	// Cisco connection elements: the client is the flow source
+	{Name: "connectionClientIPv4Address", ID: 12236, Enterprise: 9, Length: 4, bytes: ipfixSourceIP},
+	{Name: "connectionServerIPv4Address", ID: 12237, Enterprise: 9, Length: 4, bytes: ipfixDestinationIP},
+	{Name: "connectionClientTransportPort", ID: 12240, Enterprise: 9, Length: 2, unsigned: ipfixSourcePort},
+	{Name: "connectionServerTransportPort", ID: 12241, Enterprise: 9, Length: 2, unsigned: ipfixDestinationPort},
+}
+
+// defaultIPFIXTemplate is the template exported when none is configured
+var defaultIPFIXTemplate = []string{
+	"sourceMacAddress", "postSourceMacAddress", "destinationMacAddress", "postDestinationMacAddress",
+	"sourceIPv4Address", "destinationIPv4Address", "sourceTransportPort", "destinationTransportPort",
+	"tcpControlBits", "flowDirection", "packetDeltaCount", "octetDeltaCount",
+	"flowStartMilliseconds", "flowEndMilliseconds", "biflowDirection", "newConnectionDeltaCount",
+	"connectionClientIPv4Address", "connectionClientTransportPort",
+	"connectionServerIPv4Address", "connectionServerTransportPort",
+	"observationPointId", "ipVersion", "protocolIdentifier", "applicationId",
+}
+
+// lookupIPFIXElement finds an element of the registry by name, ignoring
+// case
+func lookupIPFIXElement(name string) (*ipfixElement, bool) {
+	for n := range ipfixRegistry {
+		if strings.EqualFold(ipfixRegistry[n].Name, name) {
+			return &ipfixRegistry[n], true
+		}
+	}
+	return nil, false
+}
+
+// lookupIPFIXElementID finds an element of the registry by number
+func lookupIPFIXElementID(id uint16, enterprise uint32) (*ipfixElement, bool) {
+	for n := range ipfixRegistry {
+		if ipfixRegistry[n].ID == id && ipfixRegistry[n].Enterprise == enterprise {
+			return &ipfixRegistry[n], true
+		}
+	}
+	return nil, false
+}
+
+// ipfixField is a field of a template: an element of the registry, or an
+// element it does not know sent with a constant value
+type ipfixField struct {
+	ID         uint16
+	Enterprise uint32
+	Length     uint16
+
+	element  *ipfixElement
+	constant []byte // Value of the field when set, zeros for unknown elements
+}
+
+// ipfixTemplate is the template of the exported records
+type ipfixTemplate struct {
+	ID     uint16
+	Fields []ipfixField
+}
+
+// ipfixFieldEntry is an object entry of the template JSON
+type ipfixFieldEntry struct {
+	Name       string          `json:"name,omitempty"`
+	ID         uint16          `json:"id,omitempty"`
+	Enterprise uint32          `json:"enterprise,omitempty"`
+	Length     uint16          `json:"length,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"` // Number or string
+}
+
+// parseIPFIXTemplate parses the template JSON, a list of element names,
+// numbers or objects giving the id, enterprise number, length and value
+// of the element. An empty list is the default template.
+func parseIPFIXTemplate(id uint16, body string) (*ipfixTemplate, error) {
+	var entries []json.RawMessage
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		return nil, fmt.Errorf("invalid template JSON: %v", err)
+	}
+	if len(entries) == 0 {
+		for _, name := range defaultIPFIXTemplate {
+			entries = append(entries, json.RawMessage(strconv.Quote(name)))
+		}
+	}
+
+	t := &ipfixTemplate{ID: id}
+	for n, raw := range entries {
+		var entry ipfixFieldEntry
+		var name string
+		switch {
+		case json.Unmarshal(raw, &name) == nil:
+			if number, err := strconv.ParseUint(name, 10, 15); err == nil {
+				entry.ID = uint16(number)
+			} else {
+				entry.Name = name
+			}
+		case json.Unmarshal(raw, &entry.ID) == nil:
+		default:
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				return nil, fmt.Errorf("field %d: %v", n+1, err)
+			}
+		}
+
+		field, err := entry.field()
+		if err != nil {
+			return nil, fmt.Errorf("field %d: %v", n+1, err)
+		}
+		t.Fields = append(t.Fields, field)
+	}
+	return t, nil
+}
+
+// field resolves a template entry against the registry
+func (entry *ipfixFieldEntry) field() (ipfixField, error) {
+	var element *ipfixElement
+	var ok bool
+	if entry.Name != "" {
+		if element, ok = lookupIPFIXElement(entry.Name); !ok {
+			return ipfixField{}, fmt.Errorf("unknown information element %q", entry.Name)
+		}
+	} else if entry.ID&0x7fff == 0 || (entry.ID > 0x7fff && entry.Enterprise == 0) {
+		return ipfixField{}, fmt.Errorf("invalid information element ID %d", entry.ID)
+	} else {
+		// Vendors often document their elements with the enterprise bit set
+		entry.ID &= 0x7fff
+		element, ok = lookupIPFIXElementID(entry.ID, entry.Enterprise)
+	}
+
+	f := ipfixField{ID: entry.ID, Enterprise: entry.Enterprise, Length: entry.Length}
+	if ok {
+		f.ID, f.Enterprise, f.element = element.ID, element.Enterprise, element
+		switch {
+		case f.Length == 0:
+			f.Length = element.Length
+		case element.bytes != nil && f.Length != element.Length:
+			return f, fmt.Errorf("%s is %d bytes long", element.Name, element.Length)
+		case f.Length > 8:
+			return f, fmt.Errorf("%s is at most 8 bytes long", element.Name)
+		}
+	} else if f.Length == 0 || f.Length == 0xffff {
+		return f, fmt.Errorf("unknown information element %d/%d needs a fixed length", entry.Enterprise, entry.ID)
+	}
+
+	if len(entry.Value) > 0 {
+		constant, err := ipfixConstantValue(entry.Value, f.Length)
+		if err != nil {
+			return f, err
+		}
+		f.constant = constant
+	} else if !ok {
+		f.constant = make([]byte, f.Length)
+	}
+	return f, nil
+}
+
+// ipfixConstantValue encodes the configured value of a field: an unsigned
+// number or a string padded with zeros
+func ipfixConstantValue(raw json.RawMessage, length uint16) ([]byte, error) {
+	b := make([]byte, length)
+	var number uint64
+	if err := json.Unmarshal(raw, &number); err == nil {
+		putUnsigned(b, number)
+		return b, nil
+	}
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		return nil, fmt.Errorf("invalid value %s", raw)
+	}
+	if len(text) > int(length) {
+		return nil, fmt.Errorf("value %q longer than %d bytes", text, length)
+	}
+	copy(b, text)
+	return b, nil
+}
+
+// putUnsigned writes the low bytes of v in b, big endian
+func putUnsigned(b []byte, v uint64) {
+	for n := len(b) - 1; n >= 0; n-- {
+		b[n] = byte(v)
+		v >>= 8
+	}
+}
+
+// recordLength returns the length of the data records
+func (t *ipfixTemplate) recordLength() int {
+	length := 0
+	for _, f := range t.Fields {
+		length += int(f.Length)
+	}
+	return length
+}
+
+// templateSet builds the template set announcing the template
+func (t *ipfixTemplate) templateSet() []byte {
+	set := make([]byte, 8, 8+8*len(t.Fields))
+	binary.BigEndian.PutUint16(set[0:2], ipfixTemplateSetID)
+	binary.BigEndian.PutUint16(set[4:6], t.ID)
+	binary.BigEndian.PutUint16(set[6:8], uint16(len(t.Fields)))
+	for _, f := range t.Fields {
+		if f.Enterprise != 0 {
+			// Enterprise-specific elements have the enterprise bit set
+			set = binary.BigEndian.AppendUint16(set, 0x8000|f.ID)
+			set = binary.BigEndian.AppendUint16(set, f.Length)
+			set = binary.BigEndian.AppendUint32(set, f.Enterprise)
+		} else {
+			set = binary.BigEndian.AppendUint16(set, f.ID)
+			set = binary.BigEndian.AppendUint16(set, f.Length)
+		}
+	}
+	binary.BigEndian.PutUint16(set[2:4], uint16(len(set)))
+	return set
+}
+
+// record encodes the data record of a flow
+func (t *ipfixTemplate) record(flow *ipfixFlow) []byte {
+	record := make([]byte, t.recordLength())
+	b := record
+	for _, f := range t.Fields {
+		value := b[:f.Length]
+		switch {
+		case f.constant != nil:
+			copy(value, f.constant)
+		case f.element.unsigned != nil:
+			putUnsigned(value, f.element.unsigned(flow))
+		default:
+			copy(value, f.element.bytes(flow))
+		}
+		b = b[f.Length:]
+	}
+	return record
+}
+
+// String lists the names of the fields, or their numbers for the elements
+// the registry does not know
+func (t *ipfixTemplate) String() string {
+	var names strings.Builder
+	for n, f := range t.Fields {
+		if n > 0 {
+			names.WriteString(", ")
+		}
+		switch {
+		case f.element != nil:
+			names.WriteString(f.element.Name)
+		case f.Enterprise != 0:
+			fmt.Fprintf(&names, "%d/%d", f.Enterprise, f.ID)
+		default:
+			fmt.Fprintf(&names, "%d", f.ID)
+		}
+	}
+	return names.String()
+}
+
+// newIPFIXFlow derives the exported values of a flow: the device MAC for
+// its address, the protocol number and the direction
+func (i *IpFix) newIPFIXFlow(traffic Traffic, now time.Time) *ipfixFlow {
+	// Get device information from its configuration
+	deviceIP, deviceMAC, err := i.getDeviceInfo()
+	if err != nil {
+		fmt.Printf("Warning: Failed to get device info from config: %v. Using default MAC addresses.\n", err)
+		// Fallback to default MAC addresses
+		deviceIP = net.ParseIP("0.0.0.0") // This will never match, so defaults will be used
+		deviceMAC = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	}
+
+	flow := &ipfixFlow{Traffic: &traffic, start: now, end: now.Add(time.Second)}
+	flow.srcMAC, flow.dstMAC = determineMACAddresses(traffic, deviceIP, deviceMAC)
+	flow.protocol, _ = traffic.protocolNumber()
+	flow.direction = traffic.direction(deviceIP)
+	return flow
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"time"
+
+	"layeh.com/radius/rfc2865"
+)
+
+// LoadTest holds the configuration of the load generator, which starts
+// many synthetic copies of the configured device
+type LoadTest struct {
+	Enabled bool               // Enable/Disable the load generator
+	Devices int                // Number of devices to simulate
+	OUIs    []net.HardwareAddr // Vendor prefixes the device MACs are drawn from
+	Rate    int                // Devices started per second
+	Seed    int64              // Seed of the MAC generator, 0 for a random one
+	Stats   time.Duration      // Interval between statistics reports
+}
+
+// parseOUIs parses a comma-separated list of 3-byte vendor prefixes
+func parseOUIs(list string) ([]net.HardwareAddr, error) {
+	var ouis []net.HardwareAddr
+	for _, s := range splitList(list) {
+		oui, err := parseHex(s)
+		if err != nil || len(oui) != 3 {
+			return nil, fmt.Errorf("invalid OUI %q", s)
+		}
+		if oui[0]&0x01 != 0 {
+			return nil, fmt.Errorf("OUI %q is a multicast prefix", s)
+		}
+		ouis = append(ouis, net.HardwareAddr(oui))
+	}
+	if len(ouis) == 0 {
+		return nil, fmt.Errorf("no OUI configured")
+	}
+	return ouis, nil
+}
+
+// generateMACs draws the device MAC addresses, taking the OUIs in turn and
+// leaving out duplicates and the reserved addresses
+func (l *LoadTest) generateMACs(reserved ...net.HardwareAddr) ([]net.HardwareAddr, error) {
+	if l.Devices > len(l.OUIs)*(1<<24) {
+		return nil, fmt.Errorf("%d devices do not fit in %d OUI(s)", l.Devices, len(l.OUIs))
+	}
+
+	seed := l.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(seed))
+
+	seen := make(map[string]bool, l.Devices+len(reserved))
+	for _, mac := range reserved {
+		seen[mac.String()] = true
+	}
+
+	macs := make([]net.HardwareAddr, 0, l.Devices)
+	for i := 0; len(macs) < l.Devices; i++ {
+		oui := l.OUIs[i%len(l.OUIs)]
+		nic := rng.Uint32()
+		mac := net.HardwareAddr{oui[0], oui[1], oui[2], byte(nic >> 16), byte(nic >> 8), byte(nic)}
+		if seen[mac.String()] {
+			continue
+		}
+		seen[mac.String()] = true
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+// newDevice derives the i-th synthetic device from the template, the
+// device of the base configuration cm
+func (l *LoadTest) newDevice(template *Device, i int, mac net.HardwareAddr, cm *ConfigManager) *Device {
+	dev := template.withMAC(fmt.Sprintf("load-%05d", i+1), mac, cm)
+	// Synthetic devices always join as new clients: their address is their
+	// lease, reported in RADIUS and put in place of the template address in
+	// the flows. UPnP searches come from the host, not from a MAC.
+	dev.DHCP.CiAddr = net.IPv4zero
+	dev.DHCP.Inform = false
+	dev.ARP.Address = nil
+	dev.Accounting.Attributes = dev.Accounting.Attributes.Without(rfc2865.FramedIPAddress_Type)
+	dev.Authentication.Attributes = dev.Authentication.Attributes.Without(rfc2865.FramedIPAddress_Type)
+	dev.IPFIX.Enabled = dev.IPFIX.Enabled && dev.DHCP.Enabled
+	dev.IPFIX.fromLease = true
+	dev.UPnP.Enabled = false
+	if n := len(dev.Wireless.APs); n > 0 {
+		// Spread the clients over the access points
+		dev.Wireless.current = i % n
+	}
+	return dev
+}
+
+// Run creates the synthetic devices from the template device of the base
+// configuration and starts them at the configured rate
+func (l *LoadTest) Run(ctx context.Context, template *Device, base *ConfigManager, raw *RawClient, shutdown *GracefulShutdown) {
+	macs, err := l.generateMACs(template.ClientMAC)
+	if err != nil {
+		logger.Error("Load test aborted: %v", err)
+		return
+	}
+
+	if template.IPFIX.Enabled && !template.DHCP.Enabled {
+		logger.Warn("Load test: IPFIX needs DHCP to address the devices, disabled")
+	}
+
+	StartMetricsReporter(ctx, l.Stats)
+
+	limiter := NewRateLimiter(l.Rate)
+	defer limiter.Close()
+
+	logger.Info("Load test: starting %d devices at %d per second", len(macs), l.Rate)
+	start := time.Now()
+	for i, mac := range macs {
+		if ctx.Err() != nil || !limiter.Wait() {
+			return
+		}
+
+		dev := l.newDevice(template, i, mac, base)
+		dev.Start(ctx, raw, shutdown)
+		if (i+1)%l.Rate == 0 {
+			logger.Info("Load test: %d/%d devices started", i+1, len(macs))
+		}
+	}
+	logger.Info("Load test: %d devices started in %v", len(macs), time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+// TestParseOUIs tests OUI list parsing and validation
+func TestParseOUIs(t *testing.T) {
+	ouis, err := parseOUIs("90:6c:ac, 00-1b-63")
+	if err != nil || len(ouis) != 2 || ouis[1].String() != "00:1b:63" {
+		t.Errorf("unexpected OUIs %v (%v)", ouis, err)
+	}
+
+	for _, list := range []string{"", "90:6c", "01:00:5e", "zz:zz:zz"} {
+		if _, err := parseOUIs(list); err == nil {
+			t.Errorf("expected an error for %q", list)
+		}
+	}
+}
+
+// TestGenerateMACs tests that generated MACs are distinct, use every OUI,
+// skip reserved addresses and are reproducible with a seed
+func TestGenerateMACs(t *testing.T) {
+	ouis, _ := parseOUIs("90:6c:ac,00:1b:63")
+	l := &LoadTest{Devices: 5000, OUIs: ouis, Seed: 42}
+
+	first, err := l.generateMACs()
+	if err != nil || len(first) != l.Devices {
+		t.Fatalf("generated %d MACs (%v)", len(first), err)
+	}
+
+	seen := map[string]bool{}
+	perOUI := map[string]int{}
+	for _, mac := range first {
+		if seen[mac.String()] {
+			t.Fatalf("duplicate MAC %s", mac)
+		}
+		seen[mac.String()] = true
+		perOUI[mac[:3].String()]++
+	}
+	if perOUI["90:6c:ac"] != 2500 || perOUI["00:1b:63"] != 2500 {
+		t.Errorf("MACs not spread over the OUIs: %v", perOUI)
+	}
+
+	// The same seed draws the same MACs, minus the reserved one
+	again, _ := l.generateMACs(first[0])
+	if !bytes.Equal(again[0], first[1]) || !bytes.Equal(again[1], first[2]) {
+		t.Errorf("reserved MAC %s not skipped, or seed not reproducible", first[0])
+	}
+
+	l = &LoadTest{Devices: 1<<24 + 1, OUIs: []net.HardwareAddr{ouis[0]}}
+	if _, err := l.generateMACs(); err == nil {
+		t.Error("expected an error when the OUIs are too small")
+	}
+}
+
+// TestLoadTestDevice tests that synthetic devices copy the template with
+// their own MAC and the settings derived from it
+func TestLoadTestDevice(t *testing.T) {
+	cm := testConfigManager(t, `[general]
+clientmac=90:6c:ac:64:95:c1
+[dhcp]
+enabled=true
+ciaddr=10.10.1.45
+circuit_id={mac}
+[dhcpv6]
+enabled=true
+[ipv6]
+enabled=true
+[arp]
+enabled=true
+[accounting]
+User-Name = 1CC0E1408AA1
+Acct-Session-Id = 4DD66FF4-1CC0E1408AA1-0000914612
+Framed-IP-Address = 10.120.57.18
+[authentication]
+mac_format=90-6C-AC-64-95-C1
+[ipfix]
+enabled=true
+`)
+	ifi := &net.Interface{Name: "test0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}
+	template := NewDevice("template", cm, ifi)
+	mac, _ := net.ParseMAC("00:1b:63:0a:0b:0c")
+
+	l := &LoadTest{}
+	dev := l.newDevice(template, 2, mac, cm)
+	if dev.Name != "load-00003" || dev.DHCP.ClientMAC.String() != mac.String() || !dev.DHCP.Enabled {
+		t.Errorf("device %s of MAC %s, DHCP enabled %v", dev.Name, dev.DHCP.ClientMAC, dev.DHCP.Enabled)
+	}
+	if !strings.Contains(string(dev.DHCP.RelayAgentInfo), mac.String()) ||
+		!strings.Contains(string(template.DHCP.RelayAgentInfo), template.ClientMAC.String()) {
+		t.Errorf("circuit ID %q, template %q", dev.DHCP.RelayAgentInfo, template.DHCP.RelayAgentInfo)
+	}
+	if !bytes.HasSuffix(dev.DHCPv6.DUID, mac) || dev.DHCPv6.IAID != 0x630a0b0c || !bytes.Equal(dev.DHCPv6.SrcMac, mac) {
+		t.Errorf("DUID %x, IAID %#x, source MAC %s", dev.DHCPv6.DUID, dev.DHCPv6.IAID, dev.DHCPv6.SrcMac)
+	}
+	if !bytes.Equal(dev.ND.SrcMac, mac) || !bytes.Equal(dev.ARP.SrcMac, mac) {
+		t.Errorf("ND source MAC %s, ARP source MAC %s", dev.ND.SrcMac, dev.ARP.SrcMac)
+	}
+	auth := &dev.Authentication
+	if auth.UserName != "00-1B-63-0A-0B-0C" || auth.Identity != auth.UserName ||
+		auth.CallingStationId != mac.String() || dev.Accounting.CallingStationId != mac.String() {
+		t.Errorf("User-Name %s, identity %s, Calling-Station-Id %s and %s",
+			auth.UserName, auth.Identity, auth.CallingStationId, dev.Accounting.CallingStationId)
+	}
+
+	// The template address belongs to the template only, the flows are
+	// exported with the lease
+	if !dev.DHCP.CiAddr.Equal(net.IPv4zero) || !dev.IPFIX.fromLease || dev.IPFIX.DeviceMAC != mac.String() {
+		t.Errorf("ciaddr %s, IPFIX from lease %v, device %s", dev.DHCP.CiAddr, dev.IPFIX.fromLease, dev.IPFIX.DeviceMAC)
+	}
+	if _, ok := dev.Accounting.Attributes.Lookup(rfc2865.FramedIPAddress_Type); ok {
+		t.Error("template Framed-IP-Address copied")
+	}
+	if template.IPFIX.fromLease || template.Authentication.UserName != "90-6C-AC-64-95-C1" {
+		t.Errorf("template changed: IPFIX from lease %v, User-Name %s", template.IPFIX.fromLease, template.Authentication.UserName)
+	}
+	if _, ok := template.Accounting.Attributes.Lookup(rfc2865.FramedIPAddress_Type); !ok {
+		t.Error("template Framed-IP-Address removed")
+	}
+
+	// Two devices are two clients to the accounting server
+	other, _ := net.ParseMAC("00:1b:63:0a:0b:0d")
+	sessions := []*AccountingSession{
+		NewAccountingSession(&dev.Accounting, true),
+		NewAccountingSession(&l.newDevice(template, 3, other, cm).Accounting, true),
+	}
+	var packets []*radius.Packet
+	for _, s := range sessions {
+		s.begin()
+		packets = append(packets, s.packet(rfc2866.AcctStatusType_Value_Start, "", s.started))
+	}
+	if rfc2865.UserName_GetString(packets[0]) != "00-1B-63-0A-0B-0C" || rfc2865.UserName_GetString(packets[1]) != "00-1B-63-0A-0B-0D" {
+		t.Errorf("User-Name %s and %s", rfc2865.UserName_GetString(packets[0]), rfc2865.UserName_GetString(packets[1]))
+	}
+	ids := []string{rfc2866.AcctSessionID_GetString(packets[0]), rfc2866.AcctSessionID_GetString(packets[1])}
+	if ids[0] == ids[1] || !strings.Contains(ids[0], "001B630A0B0C") || !strings.Contains(ids[1], "001B630A0B0D") {
+		t.Errorf("Acct-Session-Id %s and %s", ids[0], ids[1])
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sync"
 )
 
 // Logger provides structured logging with different levels
@@ -82,6 +83,7 @@ func SafeConfigRead(configFile string) error {
 
 // GracefulShutdown handles cleanup operations
 type GracefulShutdown struct {
+	mu            sync.Mutex
 	shutdownFuncs []func() error
 }
 
@@ -92,11 +94,15 @@ func NewGracefulShutdown() *GracefulShutdown {
 }
 
 func (g *GracefulShutdown) Register(fn func() error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	g.shutdownFuncs = append(g.shutdownFuncs, fn)
 }
 
 func (g *GracefulShutdown) Shutdown() {
 	logger.Info("Starting graceful shutdown...")
+	g.mu.Lock()
+	defer g.mu.Unlock()
 	for i := len(g.shutdownFuncs) - 1; i >= 0; i-- {
 		if err := g.shutdownFuncs[i](); err != nil {
 			logger.Error("Error during shutdown: %v", err)
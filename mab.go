@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// defaultMACFormat is the format of net.HardwareAddr
+const defaultMACFormat = "aa:bb:cc:dd:ee:ff"
+
+// checkMACFormat checks a MAC address format, an example address whose
+// twelve hex digits are replaced by those of the MAC address, e.g.
+// "AABBCCDDEEFF", "aabb.ccdd.eeff" or "aa-bb-cc-dd-ee-ff"
+func checkMACFormat(format string) error {
+	digits := 0
+	for _, c := range format {
+		if isHexDigit(c) {
+			digits++
+		}
+	}
+	if digits != 12 {
+		return fmt.Errorf("MAC format %q has %d hex digits, expected 12", format, digits)
+	}
+	return nil
+}
+
+// formatMAC formats a MAC address like the example address format, in
+// upper case if the example has upper case letters
+func formatMAC(mac net.HardwareAddr, format string) string {
+	if len(mac) != 6 || checkMACFormat(format) != nil {
+		return mac.String()
+	}
+	digits := fmt.Sprintf("%x", []byte(mac))
+	if strings.ToLower(format) != format {
+		digits = strings.ToUpper(digits)
+	}
+
+	var b strings.Builder
+	i := 0
+	for _, c := range format {
+		if isHexDigit(c) {
+			b.WriteByte(digits[i])
+			i++
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexDigit(c rune) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// mabPassword is the password of MAC authentication: the configured one,
+// or the User-Name like switches do
+func (a *Authentication) mabPassword() string {
+	if a.UserPassword != "" {
+		return a.UserPassword
+	}
+	if password, ok := a.Attributes.Lookup(rfc2865.UserPassword_Type); ok {
+		return string(password)
+	}
+	return a.UserName
+}
+
+// setMABCredentials adds the password of MAC authentication to a request,
+// in User-Password (PAP) or CHAP-Password, and the Service-Type Call-Check
+// Cisco switches send for MAB, unless another one is configured
+func (a *Authentication) setMABCredentials(p *radius.Packet) error {
+	password := a.mabPassword()
+	switch a.AuthType {
+	case "chap":
+		p.Del(rfc2865.UserPassword_Type)
+		if err := setCHAPPassword(p, password); err != nil {
+			return err
+		}
+	default:
+		if err := rfc2865.UserPassword_SetString(p, password); err != nil {
+			return err
+		}
+	}
+
+	if _, ok := a.Attributes.Lookup(rfc2865.ServiceType_Type); !ok {
+		rfc2865.ServiceType_Set(p, rfc2865.ServiceType_Value_CallCheck)
+	}
+	return nil
+}
+
+// setCHAPPassword adds a CHAP-Challenge and the CHAP-Password answering it
+// (RFC 2865 5.3): the CHAP identifier followed by
+// MD5(identifier, password, challenge)
+func setCHAPPassword(p *radius.Packet, password string) error {
+	random := make([]byte, 17)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	id, challenge := random[0], random[1:]
+
+	h := md5.New()
+	h.Write([]byte{id})
+	h.Write([]byte(password))
+	h.Write(challenge)
+
+	if err := rfc2865.CHAPChallenge_Set(p, challenge); err != nil {
+		return err
+	}
+	return rfc2865.CHAPPassword_Set(p, append([]byte{id}, h.Sum(nil)...))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"net"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+func TestFormatMAC(t *testing.T) {
+	mac, _ := net.ParseMAC("90:6c:ac:0a:b1:2f")
+	tests := map[string]string{
+		"aa:bb:cc:dd:ee:ff": "90:6c:ac:0a:b1:2f",
+		"AABBCCDDEEFF":      "906CAC0AB12F",
+		"aabbccddeeff":      "906cac0ab12f",
+		"aabb.ccdd.eeff":    "906c.ac0a.b12f",
+		"AA-BB-CC-DD-EE-FF": "90-6C-AC-0A-B1-2F",
+		"aabbcc-ddeeff":     "906cac-0ab12f",
+		// Invalid formats keep the default one
+		"aa:bb:cc": "90:6c:ac:0a:b1:2f",
+	}
+	for format, expected := range tests {
+		if got := formatMAC(mac, format); got != expected {
+			t.Errorf("formatMAC(%q) = %q, expected %q", format, got, expected)
+		}
+	}
+	if checkMACFormat("aa:bb:cc") == nil {
+		t.Error("format with 6 hex digits accepted")
+	}
+}
+
+// TestMABCredentials tests the PAP and CHAP passwords and the Service-Type
+// of MAC authentication requests
+func TestMABCredentials(t *testing.T) {
+	auth := &Authentication{AuthType: "pap", UserName: "906cac0ab12f"}
+
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	if err := auth.setMABCredentials(p); err != nil {
+		t.Fatal(err)
+	}
+	if password := rfc2865.UserPassword_GetString(p); password != "906cac0ab12f" {
+		t.Errorf("PAP password %q, expected the User-Name", password)
+	}
+	if serviceType := rfc2865.ServiceType_Get(p); serviceType != rfc2865.ServiceType_Value_CallCheck {
+		t.Errorf("Service-Type %s, expected Call-Check", serviceType)
+	}
+
+	// A configured Service-Type and password take precedence
+	auth.Attributes = testRadiusAttributes(t, "[authentication]\nService-Type = Framed-User\n")
+	auth.AuthType, auth.UserPassword = "chap", "Passw0rd"
+	p = radius.New(radius.CodeAccessRequest, []byte("secret"))
+	if err := auth.Attributes.Apply(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.setMABCredentials(p); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.Lookup(rfc2865.UserPassword_Type); ok {
+		t.Error("User-Password sent with CHAP")
+	}
+	if serviceType := rfc2865.ServiceType_Get(p); serviceType != rfc2865.ServiceType_Value_FramedUser {
+		t.Errorf("Service-Type %s, expected the configured Framed-User", serviceType)
+	}
+
+	challenge := rfc2865.CHAPChallenge_Get(p)
+	chap := rfc2865.CHAPPassword_Get(p)
+	if len(challenge) != 16 || len(chap) != 17 {
+		t.Fatalf("CHAP-Challenge of %d bytes, CHAP-Password of %d bytes", len(challenge), len(chap))
+	}
+	expected := md5.Sum(append(append([]byte{chap[0]}, "Passw0rd"...), challenge...))
+	if !bytes.Equal(chap[1:], expected[:]) {
+		t.Errorf("CHAP-Password % x, expected % x", chap[1:], expected)
+	}
+}
@@ -2,18 +2,14 @@ package main
 
 import (
 	"context"
-	"crypto/rand"
 	"flag"
-	"fmt"
 	"net"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/coreos/go-systemd/daemon"
-	"github.com/krolaw/dhcp4"
-	"layeh.com/radius"
-	"layeh.com/radius/rfc2865"
-	"layeh.com/radius/rfc2869"
 )
 
 type GlobalConfig struct {
@@ -60,6 +56,48 @@ func startSystemdWatchdog(ctx context.Context) {
 	}
 }
 
+// startDevices starts the device described by the main configuration, or
+// one device per file of the devices directory
+func startDevices(ctx context.Context, netInterface *net.Interface, shutdown *GracefulShutdown) {
+	var devices []*Device
+	var err error
+	if dir := configManager.GetString("general", "devices", ""); dir != "" {
+		devices, err = loadDevices(configManager, dir, netInterface)
+		if err != nil {
+			logger.Fatal("Failed to load devices: %v", err)
+		}
+	} else {
+		devices = append(devices, NewDevice("device", configManager, netInterface))
+	}
+
+	logger.Info("Using interface: %s, simulating %d device(s)", netInterface.Name, len(devices))
+
+	Client, err := startRawClient(ctx, netInterface, devices)
+	if err != nil {
+		logger.Fatal("Failed to open the raw socket on %s: %v", netInterface.Name, err)
+	}
+
+	for _, dev := range devices {
+		dev.Start(ctx, Client, shutdown)
+	}
+}
+
+// startRawClient opens the raw socket shared by the layer 2 protocols of
+// all devices, if one of them runs any, and reads it until ctx is done
+func startRawClient(ctx context.Context, ifi *net.Interface, devices []*Device) (*RawClient, error) {
+	for _, dev := range devices {
+		if dev.needsRawSocket() {
+			client, err := NewRawClient(ifi)
+			if err != nil {
+				return nil, err
+			}
+			go client.Listen(ctx)
+			return client, nil
+		}
+	}
+	return nil, nil
+}
+
 func main() {
 	// Parse command line flags
 	configFile := flag.String("file", "/usr/local/etc/config.ini", "Configuration File Path")
@@ -91,179 +129,37 @@ func main() {
 	// Start systemd watchdog
 	go startSystemdWatchdog(ctx)
 
-	// Get network interface and client MAC with better error handling
+	// Get network interface with better error handling
 	netInterface, err := configManager.GetInterface()
 	if err != nil {
 		logger.Fatal("Failed to get network interface: %v", err)
 	}
-	clientMAC := configManager.GetClientMAC()
-
-	logger.Info("Using interface: %s, Client MAC: %s", netInterface.Name, clientMAC.String())
-
-	// Initialize DHCP interface
-	var d Interface
-	d.intNet = netInterface
-	d.ClientMAC = clientMAC
-	d.readDhcpConfigOptimized()
-
-	// Initialize UPnP
-	var u Upnp
-	u.readUpnpConfigOptimized()
-	u.intNet = netInterface
-
-	if u.Enabled {
-		fmt.Println("UPnP Discovery is enabled")
-		go func() {
-			for {
-				u.discover(time.Second * 10)
-
-				time.Sleep(time.Second * 30)
-			}
-		}()
-	}
-
-	// Initialize RADIUS Accounting
-	var acct Accounting
-	acct.ReadRadiusAccountingConfigOptimized()
-	acct.CallingStationId = clientMAC.String()
-
-	if acct.Enabled {
-		fmt.Println("Radius Accounting is enabled")
-		go func(ctx context.Context) {
-			// Event-Timestamp = "Sep 27 2018 10:27:04 EDT"
-			// Acct-Input-Packets = 4622
-			// Acct-Output-Packets = 3494
-			// Acct-Input-Octets = 859981
-			// Acct-Output-Octets = 1250913
-			// Acct-Session-Time = 5400
-			// Acct-Input-Gigawords = 0
-			// Acct-Output-Gigawords = 0
-
-		}(ctx)
-	}
-
-	// Initialize RADIUS Authentication
-	var auth Authentication
-	auth.ReadRadiusAuthenticationConfigOptimized()
-	auth.CallingStationId = clientMAC.String()
-	auth.UserName = clientMAC.String()
-
-	if auth.Enabled {
-		fmt.Println("Radius Authentication is enabled")
-		go func(ctx context.Context) {
-
-			client := radius.DefaultClient
-			client.MaxPacketErrors = 2
-			packet := radius.New(radius.CodeAccessRequest, []byte(auth.Secret))
-
-			rfc2865.UserName_SetString(packet, auth.UserName)
-			rfc2865.UserPassword_SetString(packet, auth.UserName)
-			rfc2865.NASIPAddress_Set(packet, net.ParseIP(auth.NASIPAddress))
-
-			rfc2865.CallingStationID_AddString(packet, auth.CallingStationId)
-			rfc2865.CalledStationID_AddString(packet, auth.CalledStationId)
-
-			rfc2865.NASPortType_Add(packet, rfc2865.NASPortType_Value_Ethernet)
-
-			nasPort, err := strconv.Atoi(auth.NASPort)
-
-			if err != nil {
-				fmt.Printf("Error converting NASPort to integer: %s\n", err)
-				nasPort = 0 // Default to 0 if conversion fails
-			}
-
-			rfc2865.NASPort_Add(packet, rfc2865.NASPort(nasPort))
-
-			rfc2865.FramedIPAddress_Set(packet, net.ParseIP(auth.FramedIPAddress))
-			rfc2865.NASIdentifier_AddString(packet, auth.NASIdentifier)
-
-			rfc2869.NASPortID_AddString(packet, auth.NASPortId)
-
-			rfc2865.NASIPAddress_Set(packet, net.ParseIP(auth.NASIPAddress))
-			for {
-				response, err := client.Exchange(ctx, packet, fmt.Sprintf("%s:%s", auth.ServerIP, "1812"))
-				if err != nil {
-					fmt.Printf("Error during RADIUS authentication: %s\n", err)
-					time.Sleep(time.Second * 30)
-					continue
-				}
-				switch response.Code {
-				case radius.CodeAccessAccept:
-					fmt.Println("Authentication successful")
-				case radius.CodeAccessReject:
-					fmt.Println("Authentication rejected")
-				default:
-					fmt.Printf("Received unexpected response code: %s\n", response.Code)
-				}
-
-				if len(response.Attributes) > 0 {
-					fmt.Println("\nResponse attributes:")
-					for _, attr := range response.Attributes {
-						fmt.Printf("  Type: %d, Value: %x\n", attr.Type, attr.Attribute)
-					}
-				}
-				time.Sleep(time.Second * 30) // Adjust the interval as needed
-			}
-
-		}(ctx)
-	}
 
-	// Initialize IPFIX
-	var i IpFix
-	i.readIpFixConfigOptimized()
-	if i.Enabled {
-		fmt.Println("IPFIX is enabled")
-		go func(ctx context.Context) {
-			traffic, err := i.readIpFixTraffic(i.Traffic)
-			if err != nil {
-				fmt.Printf("Error reading IPFIX traffic: %s", err)
-				return
-			}
-			for {
-				for _, t := range traffic {
-					packet := i.generateIPFIXPacket(t)
-					i.sendIPFIX(packet)
-				}
-				time.Sleep(time.Second * 10) // Adjust the interval as needed
-			}
-		}(ctx)
+	// Dynamic Authorization server for the simulated sessions
+	var coa CoA
+	coa.readCoAConfigOptimized(configManager)
+	if coa.Enabled {
+		go NewCoAServer(&coa, nasSessions).Run(ctx)
 	}
 
-	if d.Enabled {
-		fmt.Println("DHCP Discovery is enabled")
-		// Random xid
-		xid := make([]byte, 4)
-		rand.Read(xid)
-
-		// Add options
-		var options = Options{}
-
-		// Read options from json file
-		dhcpOptions := options.ReadOptions(d.Options)
-
-		broadcast := false
-		if d.DstMac.String() == "FF:FF:FF:FF:FF:FF" {
-			broadcast = true
-		}
-
-		// Request IP address
-
-		packet := RequestPacket(dhcp4.Request, d.ClientMAC, d.GiAddr, d.CiAddr, xid, broadcast, dhcpOptions)
-
-		Client, err := NewRawClient(d.intNet)
+	// Load test mode: synthetic copies of the configured device
+	var load LoadTest
+	load.readLoadTestConfigOptimized(configManager)
+	if load.Enabled {
+		template := NewDevice("template", configManager, netInterface)
+		Client, err := startRawClient(ctx, netInterface, []*Device{template})
 		if err != nil {
-			fmt.Printf("Error : %s", err)
-			panic(err)
-		}
-
-		for {
-			err = Client.sendDHCP(d.DstMac, d.SrcMac, packet, d.ServerIP, d.GiAddr)
-			if err != nil {
-				fmt.Printf("Error : %s", err)
-				panic(err)
-			}
-			time.Sleep(d.Renew)
+			logger.Fatal("Failed to open the raw socket on %s: %v", netInterface.Name, err)
 		}
+		go load.Run(ctx, template, configManager, Client, shutdown)
+	} else {
+		startDevices(ctx, netInterface, shutdown)
 	}
-	select {}
+
+	// Wait for a termination signal and shut down gracefully
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigs
+	logger.Info("Received signal %s", sig)
+	shutdown.Shutdown()
 }
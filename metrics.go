@@ -9,6 +9,8 @@ import (
 // Metrics provides runtime performance monitoring
 type Metrics struct {
 	DHCPRequests    int64
+	DHCPReplies     int64
+	DHCPLeases      int64
 	RADIUSRequests  int64
 	IPFIXPackets    int64
 	UPnPDiscoveries int64
@@ -25,6 +27,16 @@ func (m *Metrics) IncrementDHCP() {
 	atomic.AddInt64(&m.DHCPRequests, 1)
 }
 
+// IncrementDHCPReply atomically increments DHCP reply counter
+func (m *Metrics) IncrementDHCPReply() {
+	atomic.AddInt64(&m.DHCPReplies, 1)
+}
+
+// IncrementDHCPLease atomically increments the counter of bound leases
+func (m *Metrics) IncrementDHCPLease() {
+	atomic.AddInt64(&m.DHCPLeases, 1)
+}
+
 // IncrementRADIUS atomically increments RADIUS request counter
 func (m *Metrics) IncrementRADIUS() {
 	atomic.AddInt64(&m.RADIUSRequests, 1)
@@ -55,6 +67,8 @@ func (m *Metrics) PrintStats() {
 	logger.Info("=== DeviceSimulator Statistics ===")
 	logger.Info("Uptime: %v", m.GetUptime())
 	logger.Info("DHCP Requests: %d", atomic.LoadInt64(&m.DHCPRequests))
+	logger.Info("DHCP Replies: %d", atomic.LoadInt64(&m.DHCPReplies))
+	logger.Info("DHCP Leases: %d", atomic.LoadInt64(&m.DHCPLeases))
 	logger.Info("RADIUS Requests: %d", atomic.LoadInt64(&m.RADIUSRequests))
 	logger.Info("IPFIX Packets: %d", atomic.LoadInt64(&m.IPFIXPackets))
 	logger.Info("UPnP Discoveries: %d", atomic.LoadInt64(&m.UPnPDiscoveries))
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// setMessageAuthenticator adds the Message-Authenticator of a request
+// (RFC 3579 3.2), an HMAC-MD5 of the whole packet. It goes first, so that a
+// forged response cannot be made of the request attributes (Blast-RADIUS).
+// It must be set once all the other attributes are.
+func setMessageAuthenticator(p *radius.Packet) error {
+	p.Del(rfc2869.MessageAuthenticator_Type)
+	p.Attributes = append(radius.Attributes{{
+		Type:      rfc2869.MessageAuthenticator_Type,
+		Attribute: make(radius.Attribute, md5.Size),
+	}}, p.Attributes...)
+
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	p.Attributes[0].Attribute = mac.Sum(nil)
+	return nil
+}
+
+// verifyMessageAuthenticator checks the Message-Authenticator of a reply,
+// computed over the reply with the authenticator of the request. A reply
+// without one is accepted unless it is required, or the reply carries EAP.
+func verifyMessageAuthenticator(reply *radius.Packet, requestAuthenticator [16]byte, required bool) bool {
+	received, ok := reply.Lookup(rfc2869.MessageAuthenticator_Type)
+	if !ok {
+		_, hasEAP := reply.Lookup(rfc2869.EAPMessage_Type)
+		return !required && !hasEAP
+	}
+	if len(received) != md5.Size {
+		return false
+	}
+
+	check := *reply
+	check.Attributes = make(radius.Attributes, len(reply.Attributes))
+	copy(check.Attributes, reply.Attributes)
+	check.Authenticator = requestAuthenticator
+	check.Set(rfc2869.MessageAuthenticator_Type, make([]byte, md5.Size))
+	b, err := check.MarshalBinary()
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(md5.New, reply.Secret)
+	mac.Write(b)
+	return bytes.Equal(mac.Sum(nil), received)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+// TestVerifyMessageAuthenticator tests when a reply needs a valid
+// Message-Authenticator
+func TestVerifyMessageAuthenticator(t *testing.T) {
+	request := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	reply := request.Response(radius.CodeAccessReject)
+	if !verifyMessageAuthenticator(reply, request.Authenticator, false) {
+		t.Error("Message-Authenticator is optional unless required")
+	}
+	if verifyMessageAuthenticator(reply, request.Authenticator, true) {
+		t.Error("missing Message-Authenticator accepted when required")
+	}
+	rfc2869.EAPMessage_Set(reply, (&eapPacket{Code: eapFailure, ID: 1}).MarshalBinary())
+	if verifyMessageAuthenticator(reply, request.Authenticator, false) {
+		t.Error("Message-Authenticator is required with EAP")
+	}
+	reply.Set(rfc2869.MessageAuthenticator_Type, make([]byte, md5.Size))
+	if verifyMessageAuthenticator(reply, request.Authenticator, false) {
+		t.Error("invalid Message-Authenticator accepted")
+	}
+	if err := setMessageAuthenticator(reply); err != nil {
+		t.Fatal(err)
+	}
+	if !verifyMessageAuthenticator(reply, request.Authenticator, true) {
+		t.Error("valid Message-Authenticator rejected")
+	}
+}
+
+// TestMABMessageAuthenticator tests MAC authentication against servers
+// signing their responses or not
+func TestMABMessageAuthenticator(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	var signResponses atomic.Bool
+	firstAttribute := make(chan radius.Type, 1)
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte("secret")),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			firstAttribute <- r.Attributes[0].Type
+			if r.Attributes[0].Type == rfc2869.MessageAuthenticator_Type &&
+				!verifyMessageAuthenticator(r.Packet, r.Authenticator, true) {
+				t.Error("invalid Message-Authenticator in the request")
+			}
+			response := r.Response(radius.CodeAccessAccept)
+			if signResponses.Load() {
+				setMessageAuthenticator(response)
+			}
+			w.Write(response)
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	dev := &Device{Authentication: Authentication{
+		Servers: RadiusServers{
+			Servers: []RadiusServer{{Address: conn.LocalAddr().String(), Secret: "secret", Timeout: time.Second}},
+			health:  newRadiusHealth(),
+		},
+		AuthType: "pap",
+		UserName: "906cac0ab12f",
+	}}
+	// authenticate returns the first attribute of the request and the result
+	authenticate := func() (radius.Type, error) {
+		_, err := dev.authenticateMAB(context.Background(), func(secret []byte) *radius.Packet {
+			p := radius.New(radius.CodeAccessRequest, secret)
+			rfc2865.UserName_SetString(p, dev.Authentication.UserName)
+			return p
+		})
+		return <-firstAttribute, err
+	}
+
+	if first, err := authenticate(); err != nil || first == rfc2869.MessageAuthenticator_Type {
+		t.Errorf("without Message-Authenticator: %v, first attribute %d", err, first)
+	}
+
+	dev.Authentication.MessageAuthenticator = true
+	first, err := authenticate()
+	if err == nil {
+		t.Error("unsigned response accepted with message_authenticator")
+	}
+	if first != rfc2869.MessageAuthenticator_Type {
+		t.Errorf("first attribute %d, expected Message-Authenticator", first)
+	}
+
+	signResponses.Store(true)
+	if _, err := authenticate(); err != nil {
+		t.Errorf("signed response: %v", err)
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// ICMPv6 message types used by Neighbor Discovery (RFC 4861) and MLDv2
+// (RFC 3810)
+const (
+	icmpv6RouterSolicitation   = 133
+	icmpv6RouterAdvertisement  = 134
+	icmpv6NeighborSolicitation = 135
+	icmpv6NeighborAdvertise    = 136
+	icmpv6MLDv2Report          = 143
+)
+
+// Neighbor Discovery option types
+const (
+	ndOptSourceLLA  = 1
+	ndOptTargetLLA  = 2
+	ndOptPrefixInfo = 3
+)
+
+// Neighbor Advertisement flags
+const (
+	naFlagRouter    = 0x80000000
+	naFlagSolicited = 0x40000000
+	naFlagOverride  = 0x20000000
+)
+
+// Host constants (RFC 4861 section 10)
+const (
+	ndMaxRtrSolicitations     = 3
+	ndRtrSolicitationInterval = 4 * time.Second
+	ndRetransTimer            = 1 * time.Second
+)
+
+var (
+	allNodesMulticast   = net.ParseIP("ff02::1")
+	allRoutersMulticast = net.ParseIP("ff02::2")
+	mldv2Multicast      = net.ParseIP("ff02::16")
+)
+
+// IPv6ND holds the Neighbor Discovery and SLAAC configuration of a
+// simulated device
+type IPv6ND struct {
+	Enabled       bool // Enable/Disable IPv6 Neighbor Discovery
+	ClientMAC     net.HardwareAddr
+	SrcMac        net.HardwareAddr // Source MAC (Ethernet Header)
+	Privacy       bool             // Use random interface identifiers for SLAAC (RFC 4941)
+	DAD           bool             // Run Duplicate Address Detection
+	Solicitations int              // Number of Router Solicitations to send
+}
+
+// ndAddress is an address owned by the simulated device
+type ndAddress struct {
+	ip        net.IP
+	tentative bool
+	deadline  time.Time // end of DAD for tentative addresses
+	slaac     *net.IPNet
+}
+
+// ndPacket is an ICMPv6 message received for the device
+type ndPacket struct {
+	srcMAC net.HardwareAddr
+	src    net.IP
+	dst    net.IP
+	msg    []byte
+}
+
+// NDClient sends Router Solicitations, performs DAD, forms SLAAC
+// addresses and answers Neighbor Solicitations for a simulated device
+type NDClient struct {
+	cfg *IPv6ND
+	raw *RawClient
+
+	mu    sync.Mutex
+	addrs map[string]*ndAddress
+
+	packets   chan ndPacket
+	add       chan net.IP
+	rsSent    int
+	nextRS    time.Time
+	gotAdvert bool
+}
+
+// NewNDClient creates a Neighbor Discovery client for the configured device
+func NewNDClient(cfg *IPv6ND, raw *RawClient) *NDClient {
+	return &NDClient{
+		cfg:     cfg,
+		raw:     raw,
+		addrs:   make(map[string]*ndAddress),
+		packets: make(chan ndPacket, 64),
+		add:     make(chan net.IP, 16),
+	}
+}
+
+// AddAddress assigns an address obtained elsewhere (e.g. DHCPv6) to the
+// device, running DAD on it first
+func (c *NDClient) AddAddress(ip net.IP) {
+	select {
+	case c.add <- ip:
+	default:
+		logger.Warn("IPv6 address queue full for %s, dropping %s", c.cfg.ClientMAC, ip)
+	}
+}
+
+// Addresses returns the preferred addresses of the device
+func (c *NDClient) Addresses() []net.IP {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var ips []net.IP
+	for _, a := range c.addrs {
+		if !a.tentative {
+			ips = append(ips, a.ip)
+		}
+	}
+	return ips
+}
+
+// deliver hands a received ICMPv6 message to the client
+func (c *NDClient) deliver(srcMAC net.HardwareAddr, src, dst net.IP, msg []byte) {
+	select {
+	case c.packets <- ndPacket{srcMAC: srcMAC, src: src, dst: dst, msg: msg}:
+	default:
+	}
+}
+
+// Run executes Neighbor Discovery until the context is cancelled
+func (c *NDClient) Run(ctx context.Context) {
+	c.raw.HandleICMPv6(c.cfg.ClientMAC, c.deliver)
+	defer c.raw.RemoveICMPv6(c.cfg.ClientMAC)
+
+	c.assign(linkLocalAddr(c.cfg.ClientMAC), nil)
+	c.nextRS = time.Now().Add(ndRetransTimer)
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-c.add:
+			c.assign(ip, nil)
+		case p := <-c.packets:
+			c.handle(p)
+		case now := <-ticker.C:
+			c.tick(now)
+		}
+	}
+}
+
+// tick completes DAD on tentative addresses and retransmits Router
+// Solicitations
+func (c *NDClient) tick(now time.Time) {
+	c.mu.Lock()
+	var done []*ndAddress
+	for _, a := range c.addrs {
+		if a.tentative && !now.Before(a.deadline) {
+			a.tentative = false
+			done = append(done, a)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, a := range done {
+		logger.Info("IPv6 address %s of %s is preferred", a.ip, c.cfg.ClientMAC)
+		// Tell the neighbors about the new address
+		c.sendNA(a.ip, allNodesMulticast, multicastMAC(allNodesMulticast), false)
+	}
+
+	if !c.gotAdvert && c.rsSent < c.cfg.Solicitations && !now.Before(c.nextRS) {
+		if c.hasPreferredLinkLocal() {
+			c.sendRS()
+			c.rsSent++
+			c.nextRS = now.Add(ndRtrSolicitationInterval)
+		}
+	}
+}
+
+// assign adds an address to the device, joining its solicited-node group
+// and starting DAD
+func (c *NDClient) assign(ip net.IP, prefix *net.IPNet) {
+	c.mu.Lock()
+	if _, exists := c.addrs[ip.String()]; exists {
+		c.mu.Unlock()
+		return
+	}
+	a := &ndAddress{ip: ip, slaac: prefix, tentative: c.cfg.DAD, deadline: time.Now().Add(ndRetransTimer)}
+	c.addrs[ip.String()] = a
+	groups := c.groupsLocked()
+	c.mu.Unlock()
+
+	c.sendMLDReport(groups)
+	if c.cfg.DAD {
+		logger.Debug("Starting DAD for %s", ip)
+		c.sendNS(ip, net.IPv6unspecified, solicitedNodeAddr(ip))
+	}
+}
+
+// handle processes a received ICMPv6 message
+func (c *NDClient) handle(p ndPacket) {
+	if len(p.msg) < 4 || bytes.Equal(p.srcMAC, c.cfg.ClientMAC) {
+		// Our own frames are looped back by the raw socket
+		return
+	}
+
+	switch p.msg[0] {
+	case icmpv6RouterAdvertisement:
+		c.handleRA(p)
+	case icmpv6NeighborSolicitation:
+		if len(p.msg) < 24 {
+			return
+		}
+		c.handleNS(p, net.IP(p.msg[8:24]))
+	case icmpv6NeighborAdvertise:
+		if len(p.msg) < 24 {
+			return
+		}
+		c.conflict(net.IP(p.msg[8:24]), p.srcMAC)
+	}
+}
+
+// handleNS answers solicitations for our addresses and detects duplicates
+// during DAD
+func (c *NDClient) handleNS(p ndPacket, target net.IP) {
+	c.mu.Lock()
+	a, ok := c.addrs[target.String()]
+	tentative := ok && a.tentative
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	if tentative {
+		// Another node is performing DAD for the same address
+		if p.src.IsUnspecified() {
+			c.conflict(target, p.srcMAC)
+		}
+		return
+	}
+
+	if p.src.IsUnspecified() {
+		c.sendNA(target, allNodesMulticast, multicastMAC(allNodesMulticast), false)
+		return
+	}
+	c.sendNA(target, p.src, p.srcMAC, true)
+}
+
+// conflict removes a tentative address another node is using
+func (c *NDClient) conflict(target net.IP, owner net.HardwareAddr) {
+	c.mu.Lock()
+	a, ok := c.addrs[target.String()]
+	if !ok || !a.tentative {
+		c.mu.Unlock()
+		return
+	}
+	delete(c.addrs, target.String())
+	c.mu.Unlock()
+
+	logger.Warn("DAD failed: %s is already used by %s", target, owner)
+	if a.slaac != nil && c.cfg.Privacy {
+		// Try again with another random interface identifier
+		c.assign(slaacAddr(a.slaac, c.cfg.ClientMAC, true), a.slaac)
+	}
+}
+
+// handleRA forms SLAAC addresses from the autonomous /64 prefixes of a
+// Router Advertisement
+func (c *NDClient) handleRA(p ndPacket) {
+	if len(p.msg) < 16 {
+		return
+	}
+	c.gotAdvert = true
+
+	opts := p.msg[16:]
+	for len(opts) >= 8 {
+		length := int(opts[1]) * 8
+		if length == 0 || length > len(opts) {
+			return
+		}
+		if opts[0] == ndOptPrefixInfo && length == 32 {
+			prefixLen := int(opts[2])
+			autonomous := opts[3]&0x40 != 0
+			valid := binary.BigEndian.Uint32(opts[4:8])
+			prefix := &net.IPNet{IP: net.IP(append([]byte(nil), opts[16:32]...)), Mask: net.CIDRMask(prefixLen, 128)}
+			if autonomous && prefixLen == 64 && valid > 0 && !prefix.IP.IsLinkLocalUnicast() && !c.hasPrefix(prefix) {
+				logger.Info("Router %s advertises %s, forming SLAAC address", p.src, prefix)
+				c.assign(slaacAddr(prefix, c.cfg.ClientMAC, c.cfg.Privacy), prefix)
+			}
+		}
+		opts = opts[length:]
+	}
+}
+
+// hasPrefix reports whether a SLAAC address already exists for prefix
+func (c *NDClient) hasPrefix(prefix *net.IPNet) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, a := range c.addrs {
+		if a.slaac != nil && a.slaac.String() == prefix.String() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *NDClient) hasPreferredLinkLocal() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, ok := c.addrs[linkLocalAddr(c.cfg.ClientMAC).String()]
+	return ok && !a.tentative
+}
+
+// groupsLocked returns the solicited-node groups of all addresses
+func (c *NDClient) groupsLocked() []net.IP {
+	seen := map[string]bool{}
+	var groups []net.IP
+	for _, a := range c.addrs {
+		group := solicitedNodeAddr(a.ip)
+		if !seen[group.String()] {
+			seen[group.String()] = true
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// sendRS sends a Router Solicitation from the link-local address
+func (c *NDClient) sendRS() {
+	msg := make([]byte, 8)
+	msg[0] = icmpv6RouterSolicitation
+	msg = append(msg, ndLinkLayerOption(ndOptSourceLLA, c.cfg.ClientMAC)...)
+	c.send(allRoutersMulticast, multicastMAC(allRoutersMulticast), msg, false)
+}
+
+// sendNS sends a Neighbor Solicitation for target
+func (c *NDClient) sendNS(target net.IP, src net.IP, dst net.IP) {
+	msg := make([]byte, 8, 32)
+	msg[0] = icmpv6NeighborSolicitation
+	msg = append(msg, target.To16()...)
+	if !src.IsUnspecified() {
+		msg = append(msg, ndLinkLayerOption(ndOptSourceLLA, c.cfg.ClientMAC)...)
+	}
+	c.sendFrom(src, dst, multicastMAC(dst), msg, false)
+}
+
+// sendNA advertises target to dst
+func (c *NDClient) sendNA(target net.IP, dst net.IP, dstMAC net.HardwareAddr, solicited bool) {
+	flags := uint32(naFlagOverride)
+	if solicited {
+		flags |= naFlagSolicited
+	}
+	msg := make([]byte, 8, 32)
+	msg[0] = icmpv6NeighborAdvertise
+	binary.BigEndian.PutUint32(msg[4:8], flags)
+	msg = append(msg, target.To16()...)
+	msg = append(msg, ndLinkLayerOption(ndOptTargetLLA, c.cfg.ClientMAC)...)
+	c.sendFrom(target, dst, dstMAC, msg, false)
+}
+
+// sendMLDReport joins the given groups with an MLDv2 report
+func (c *NDClient) sendMLDReport(groups []net.IP) {
+	msg := make([]byte, 8)
+	msg[0] = icmpv6MLDv2Report
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(groups)))
+	for _, group := range groups {
+		// CHANGE_TO_EXCLUDE_MODE with no sources means join
+		msg = append(msg, 4, 0, 0, 0)
+		msg = append(msg, group.To16()...)
+	}
+	src := net.IPv6unspecified
+	if c.hasPreferredLinkLocal() {
+		src = linkLocalAddr(c.cfg.ClientMAC)
+	}
+	c.sendFrom(src, mldv2Multicast, multicastMAC(mldv2Multicast), msg, true)
+}
+
+func (c *NDClient) send(dst net.IP, dstMAC net.HardwareAddr, msg []byte, routerAlert bool) {
+	c.sendFrom(linkLocalAddr(c.cfg.ClientMAC), dst, dstMAC, msg, routerAlert)
+}
+
+func (c *NDClient) sendFrom(src, dst net.IP, dstMAC net.HardwareAddr, msg []byte, routerAlert bool) {
+	hopLimit := byte(255)
+	if routerAlert {
+		hopLimit = 1
+	}
+	if err := c.raw.sendICMPv6(c.cfg.ClientMAC, dstMAC, c.cfg.SrcMac, msg, dst, src, hopLimit, routerAlert); err != nil {
+		logger.Error("Failed to send ICMPv6 type %d for %s: %v", msg[0], c.cfg.ClientMAC, err)
+		metrics.IncrementErrors()
+	}
+}
+
+// ndLinkLayerOption builds a source/target link-layer address option
+func ndLinkLayerOption(optType byte, mac net.HardwareAddr) []byte {
+	return append([]byte{optType, 1}, mac...)
+}
+
+// solicitedNodeAddr returns the solicited-node multicast address of ip
+func solicitedNodeAddr(ip net.IP) net.IP {
+	ip = ip.To16()
+	return net.IP{0xff, 0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0xff, ip[13], ip[14], ip[15]}
+}
+
+// slaacAddr forms an address in a /64 prefix from the EUI-64 of mac, or
+// from a random interface identifier for privacy addresses
+func slaacAddr(prefix *net.IPNet, mac net.HardwareAddr, privacy bool) net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, prefix.IP.To16()[:8])
+	if privacy {
+		rand.Read(ip[8:])
+		ip[8] &^= 0x02 // Clear the universal/local bit
+	} else {
+		copy(ip[8:], eui64(mac))
+	}
+	return ip
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// TestSLAACAddr tests EUI-64 and privacy address formation
+func TestSLAACAddr(t *testing.T) {
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	_, prefix, _ := net.ParseCIDR("2001:db8:1:2::/64")
+
+	if got := slaacAddr(prefix, mac, false); !got.Equal(net.ParseIP("2001:db8:1:2:926c:acff:fe64:95c1")) {
+		t.Errorf("unexpected EUI-64 address %s", got)
+	}
+
+	a, b := slaacAddr(prefix, mac, true), slaacAddr(prefix, mac, true)
+	if !prefix.Contains(a) || a.Equal(b) {
+		t.Errorf("privacy addresses %s and %s should be distinct addresses in %s", a, b, prefix)
+	}
+	if a[8]&0x02 != 0 {
+		t.Errorf("privacy address %s has the universal/local bit set", a)
+	}
+}
+
+// TestSolicitedNodeAddr tests the solicited-node multicast address and
+// its Ethernet group
+func TestSolicitedNodeAddr(t *testing.T) {
+	group := solicitedNodeAddr(net.ParseIP("fe80::926c:acff:fe64:95c1"))
+	if !group.Equal(net.ParseIP("ff02::1:ff64:95c1")) {
+		t.Errorf("unexpected solicited-node address %s", group)
+	}
+	if mac := multicastMAC(group); mac.String() != "33:33:ff:64:95:c1" {
+		t.Errorf("unexpected multicast MAC %s", mac)
+	}
+}
+
+// TestParseICMPv6 tests that a checksummed Neighbor Solicitation is
+// accepted and a corrupted one rejected
+func TestParseICMPv6(t *testing.T) {
+	src := net.ParseIP("fe80::1")
+	target := net.ParseIP("fe80::926c:acff:fe64:95c1")
+	dst := solicitedNodeAddr(target)
+
+	msg := make([]byte, 8, 24)
+	msg[0] = icmpv6NeighborSolicitation
+	msg = append(msg, target...)
+
+	packet := make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(msg))
+	packet[0] = 0x60
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(msg)))
+	packet[6] = syscall.IPPROTO_ICMPV6
+	packet[7] = 255
+	copy(packet[8:24], src)
+	copy(packet[24:40], dst)
+	packet = append(packet, msg...)
+	binary.BigEndian.PutUint16(packet[ipv6HeaderLen+2:], checksum6(src, dst, syscall.IPPROTO_ICMPV6, msg))
+
+	gotSrc, gotDst, got, ok := parseICMPv6(packet)
+	if !ok || !gotSrc.Equal(src) || !gotDst.Equal(dst) || !bytes.Equal(got[8:24], target) {
+		t.Fatalf("failed to parse Neighbor Solicitation: %v %s %s", ok, gotSrc, gotDst)
+	}
+
+	packet[len(packet)-1] ^= 0xff
+	if _, _, _, ok := parseICMPv6(packet); ok {
+		t.Error("expected a corrupted message to be rejected")
+	}
+}
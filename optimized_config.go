@@ -1,112 +1,374 @@
 package main
 
 import (
+	"encoding/binary"
+	"math"
 	"net"
+	"strings"
 	"time"
+
+	"layeh.com/radius/rfc2866"
 )
 
 // Optimized configuration methods using the ConfigManager
 
+// readVlanConfigOptimized uses the ConfigManager for better performance
+func (v *VLAN) readVlanConfigOptimized(cm *ConfigManager) {
+	v.ID = uint16(cm.GetInt("general", "vlan", 0, 0, 4094))
+	v.Priority = uint8(cm.GetInt("general", "vlan_priority", 0, 0, 7))
+	v.ServiceID = uint16(cm.GetInt("general", "svlan", 0, 0, 4094))
+	v.ServicePriority = uint8(cm.GetInt("general", "svlan_priority", 0, 0, 7))
+
+	logger.Info("VLAN configured - Tags: %s", v)
+}
+
 // readDhcpConfigOptimized uses the ConfigManager for better performance
-func (d *Interface) readDhcpConfigOptimized() {
-	d.Enabled = configManager.GetBool("dhcp", "enabled", false)
-	d.ServerIP = configManager.GetIP("dhcp", "server", net.IPv4zero)
-	d.GiAddr = configManager.GetIP("dhcp", "giaddr", net.IPv4zero)
-	d.CiAddr = configManager.GetIP("dhcp", "ciaddr", net.IPv4zero)
+func (d *Interface) readDhcpConfigOptimized(cm *ConfigManager) {
+	d.Enabled = cm.GetBool("dhcp", "enabled", false)
+	d.ServerIP = cm.GetIP("dhcp", "server", net.IPv4zero)
+	d.GiAddr = cm.GetIP("dhcp", "giaddr", net.IPv4zero)
+	d.CiAddr = cm.GetIP("dhcp", "ciaddr", net.IPv4zero)
 
 	// Default to interface MAC if not specified
-	d.SrcMac = configManager.GetMAC("dhcp", "srcmac", d.intNet.HardwareAddr)
+	d.SrcMac = cm.GetMAC("dhcp", "srcmac", d.intNet.HardwareAddr)
 
 	// Default to broadcast MAC
 	broadcastMAC, _ := net.ParseMAC("FF:FF:FF:FF:FF:FF")
-	d.DstMac = configManager.GetMAC("dhcp", "dstmac", broadcastMAC)
+	d.DstMac = cm.GetMAC("dhcp", "dstmac", broadcastMAC)
 
 	// Renew interval with reasonable default and limits
-	d.Renew = configManager.GetDuration("dhcp", "renew", 30*time.Second)
+	d.Renew = cm.GetDuration("dhcp", "renew", 30*time.Second)
 
 	// DHCP options
-	d.Options = configManager.GetString("dhcp", "options", "[]")
+	d.Options = cm.GetString("dhcp", "options", "[]")
+
+	// Message type behaviour
+	d.Inform = cm.GetBool("dhcp", "inform", false)
+	d.ReleaseOnShutdown = cm.GetBool("dhcp", "release", false)
+	d.Conflicts = cm.GetIPList("dhcp", "conflict")
+	d.readMACSettingsOptimized(cm)
 
 	logger.Info("DHCP configured - Enabled: %v, Server: %v, Renew: %v",
 		d.Enabled, d.ServerIP, d.Renew)
 }
 
+// readMACSettingsOptimized reads the settings derived from the client MAC:
+// the relay agent information (option 82), templated from the NAS settings
+func (d *Interface) readMACSettingsOptimized(cm *ConfigManager) {
+	vars := map[string]string{
+		"mac":            d.ClientMAC.String(),
+		"giaddr":         d.GiAddr.String(),
+		"nas_identifier": cm.GetString("authentication", "NAS-Identifier", ""),
+		"nas_port":       cm.GetString("authentication", "NAS-Port", ""),
+		"nas_port_id":    cm.GetString("authentication", "NAS-Port-Id", ""),
+		"nas_ip":         cm.GetString("authentication", "NAS-IP-Address", ""),
+	}
+	circuitID := expandTemplate(cm.GetString("dhcp", "circuit_id", ""), vars)
+	remoteID := expandTemplate(cm.GetString("dhcp", "remote_id", ""), vars)
+	relayInfo, err := encodeRelayAgentInfo(circuitID, remoteID)
+	if err != nil {
+		logger.Warn("Invalid relay agent information, option 82 disabled: %v", err)
+	}
+	d.RelayAgentInfo = relayInfo
+}
+
+// readDhcpv6ConfigOptimized uses the ConfigManager for better performance
+func (d *DHCPv6) readDhcpv6ConfigOptimized(cm *ConfigManager) {
+	d.Enabled = cm.GetBool("dhcpv6", "enabled", false)
+	d.readMACSettingsOptimized(cm)
+
+	d.IANA = cm.GetBool("dhcpv6", "ia_na", true)
+	d.IAPD = cm.GetBool("dhcpv6", "ia_pd", false)
+
+	var err error
+	d.ORO, err = parseORO(cm.GetString("dhcpv6", "oro", "23,24"))
+	if err != nil {
+		logger.Warn("Invalid DHCPv6 option request list: %v", err)
+	}
+	d.VendorClass = encodeDHCPv6VendorClass(
+		uint32(cm.GetInt("dhcpv6", "vendor_class_enterprise", 0, 0, math.MaxInt32)),
+		splitList(cm.GetString("dhcpv6", "vendor_class", "")))
+
+	d.RapidCommit = cm.GetBool("dhcpv6", "rapid_commit", false)
+	d.Renew = cm.GetDuration("dhcpv6", "renew", 3600*time.Second)
+	d.ReleaseOnShutdown = cm.GetBool("dhcpv6", "release", false)
+
+	d.DstMac = cm.GetMAC("dhcpv6", "dstmac", multicastMAC(dhcpv6Multicast))
+
+	// Relay-forward mode
+	d.Relay = cm.GetBool("dhcpv6", "relay", false)
+	d.ServerIP = cm.GetIP("dhcpv6", "server", nil)
+	d.RelayIP = cm.GetIP("dhcpv6", "relayaddr", nil)
+	d.LinkAddress = cm.GetIP("dhcpv6", "link_address", net.IPv6unspecified)
+	d.InterfaceID = []byte(cm.GetString("dhcpv6", "interface_id", ""))
+	if d.Relay && (d.ServerIP == nil || d.RelayIP == nil) {
+		logger.Warn("DHCPv6 relay mode needs server and relayaddr, disabling relay")
+		d.Relay = false
+	}
+
+	logger.Info("DHCPv6 configured - Enabled: %v, DUID: %x, IA_NA: %v, IA_PD: %v, Relay: %v",
+		d.Enabled, d.DUID, d.IANA, d.IAPD, d.Relay)
+}
+
+// readMACSettingsOptimized reads the settings derived from the client MAC:
+// the DUID, IAID and source MAC
+func (d *DHCPv6) readMACSettingsOptimized(cm *ConfigManager) {
+	duid, err := newDUID(cm.GetString("dhcpv6", "duid", "ll"), d.ClientMAC,
+		uint32(cm.GetInt("dhcpv6", "duid_enterprise", 0, 0, math.MaxInt32)),
+		cm.GetString("dhcpv6", "duid_identifier", ""))
+	if err != nil {
+		logger.Warn("Invalid DHCPv6 DUID configuration, using DUID-LL: %v", err)
+		duid, _ = newDUID("ll", d.ClientMAC, 0, "")
+	}
+	d.DUID = duid
+
+	// Default IAID is derived from the last four bytes of the MAC
+	d.IAID = uint32(cm.GetInt("dhcpv6", "iaid", int(binary.BigEndian.Uint32(d.ClientMAC[2:6])&0x7fffffff), 0, math.MaxInt32))
+	d.SrcMac = cm.GetMAC("dhcpv6", "srcmac", d.ClientMAC)
+}
+
+// readIPv6ConfigOptimized uses the ConfigManager for better performance
+func (n *IPv6ND) readIPv6ConfigOptimized(cm *ConfigManager) {
+	n.Enabled = cm.GetBool("ipv6", "enabled", false)
+	n.readMACSettingsOptimized(cm)
+	n.Privacy = cm.GetBool("ipv6", "privacy", false)
+	n.DAD = cm.GetBool("ipv6", "dad", true)
+	n.Solicitations = cm.GetInt("ipv6", "router_solicitations", ndMaxRtrSolicitations, 0, 100)
+
+	logger.Info("IPv6 configured - Enabled: %v, Link-local: %s, Privacy: %v, DAD: %v",
+		n.Enabled, linkLocalAddr(n.ClientMAC), n.Privacy, n.DAD)
+}
+
+// readMACSettingsOptimized reads the source MAC, the client MAC by default
+func (n *IPv6ND) readMACSettingsOptimized(cm *ConfigManager) {
+	n.SrcMac = cm.GetMAC("ipv6", "srcmac", n.ClientMAC)
+}
+
+// readArpConfigOptimized uses the ConfigManager for better performance
+func (a *ARP) readArpConfigOptimized(cm *ConfigManager) {
+	a.Enabled = cm.GetBool("arp", "enabled", false)
+	a.readMACSettingsOptimized(cm)
+	a.Address = cm.GetIP("arp", "address", nil).To4()
+	a.Probe = cm.GetBool("arp", "probe", true)
+	a.Gratuitous = cm.GetDuration("arp", "gratuitous", 0)
+
+	logger.Info("ARP configured - Enabled: %v, Address: %v, Probe: %v, Gratuitous: %v",
+		a.Enabled, a.Address, a.Probe, a.Gratuitous)
+}
+
+// readMACSettingsOptimized reads the source MAC, the client MAC by default
+func (a *ARP) readMACSettingsOptimized(cm *ConfigManager) {
+	a.SrcMac = cm.GetMAC("arp", "srcmac", a.ClientMAC)
+}
+
+// readCoAConfigOptimized uses the ConfigManager for better performance
+func (c *CoA) readCoAConfigOptimized(cm *ConfigManager) {
+	c.Enabled = cm.GetBool("coa", "enabled", false)
+	c.Listen = cm.GetString("coa", "listen", ":3799")
+	c.Secret = cm.GetString("coa", "secret", cm.GetString("authentication", "secret", "secret"))
+
+	logger.Info("CoA server configured - Enabled: %v, Listen: %s", c.Enabled, c.Listen)
+}
+
+// readLoadTestConfigOptimized uses the ConfigManager for better performance
+func (l *LoadTest) readLoadTestConfigOptimized(cm *ConfigManager) {
+	l.Enabled = cm.GetBool("loadtest", "enabled", false)
+	l.Devices = cm.GetInt("loadtest", "devices", 1000, 1, 1000000)
+	l.Rate = cm.GetInt("loadtest", "rate", 50, 1, 100000)
+	l.Seed = int64(cm.GetInt("loadtest", "seed", 0, 0, math.MaxInt32))
+	l.Stats = cm.GetDuration("loadtest", "stats", 10*time.Second)
+
+	ouis, err := parseOUIs(cm.GetString("loadtest", "oui", "90:6c:ac"))
+	if err != nil {
+		logger.Warn("Invalid load test OUIs, disabling load test: %v", err)
+		l.Enabled = false
+	}
+	l.OUIs = ouis
+
+	logger.Info("Load test configured - Enabled: %v, Devices: %d, Rate: %d/s, OUIs: %v",
+		l.Enabled, l.Devices, l.Rate, l.OUIs)
+}
+
 // readUpnpConfigOptimized uses the ConfigManager for better performance
-func (u *Upnp) readUpnpConfigOptimized() {
-	u.Enabled = configManager.GetBool("upnp", "enabled", false)
-	u.UserAgent = configManager.GetString("upnp", "useragent", "siemens ag simatic s7")
-	u.deviceType = configManager.GetString("upnp", "devicetype", "urn:schemas-upnp-org:device:InternetGatewayDevice:1")
-	u.IPAddr = configManager.GetIP("upnp", "ipaddr", net.ParseIP("239.255.255.250"))
-	u.UDPPort = configManager.GetInt("upnp", "udpport", 1900, 1, 65535)
+func (u *Upnp) readUpnpConfigOptimized(cm *ConfigManager) {
+	u.Enabled = cm.GetBool("upnp", "enabled", false)
+	u.UserAgent = cm.GetString("upnp", "useragent", "siemens ag simatic s7")
+	u.deviceType = cm.GetString("upnp", "devicetype", "urn:schemas-upnp-org:device:InternetGatewayDevice:1")
+	u.IPAddr = cm.GetIP("upnp", "ipaddr", net.ParseIP("239.255.255.250"))
+	u.UDPPort = cm.GetInt("upnp", "udpport", 1900, 1, 65535)
 
 	logger.Info("UPnP configured - Enabled: %v, IP: %v, Port: %d",
 		u.Enabled, u.IPAddr, u.UDPPort)
 }
 
 // ReadRadiusAccountingConfigOptimized uses the ConfigManager for better performance
-func (a *Accounting) ReadRadiusAccountingConfigOptimized() {
-	a.Enabled = configManager.GetBool("accounting", "enabled", false)
-
-	serverIP := configManager.GetString("accounting", "server", "")
-	if serverIP != "" {
-		a.ServerIP = net.ParseIP(serverIP)
-		if a.ServerIP == nil {
-			logger.Warn("Invalid accounting server IP: %s", serverIP)
-			a.Enabled = false
-		}
+func (a *Accounting) ReadRadiusAccountingConfigOptimized(cm *ConfigManager) {
+	a.Enabled = cm.GetBool("accounting", "enabled", false)
+
+	servers, err := readRadiusServers(cm, "accounting", radiusAcctPort)
+	if err != nil {
+		logger.Warn("Invalid accounting servers: %v", err)
+		a.Enabled = false
+	} else if a.Enabled && len(servers.Servers) == 0 {
+		logger.Warn("No accounting server configured, disabling accounting")
+		a.Enabled = false
+	}
+	a.Servers = servers
+
+	a.Secret = cm.GetString("accounting", "secret", "secret")
+	a.UserName = cm.GetString("accounting", "User-Name", "")
+	a.AcctSessionId = cm.GetString("accounting", "Acct-Session-Id", "")
+	a.CallingStationId = cm.GetString("accounting", "Calling-Station-Id", "")
+	a.CalledStationId = cm.GetString("accounting", "Called-Station-Id", "")
+	a.NASPort = cm.GetString("accounting", "NAS-Port", "")
+	a.NASPortType = cm.GetString("accounting", "NAS-Port-Type", "")
+	a.FramedIPAddress = cm.GetString("accounting", "Framed-IP-Address", "")
+	a.NASIdentifier = cm.GetString("accounting", "NAS-Identifier", "")
+	a.NASPortId = cm.GetString("accounting", "NAS-Port-Id", "")
+	a.NASIPAddress = cm.GetString("accounting", "NAS-IP-Address", "")
+
+	// Session lifecycle
+	a.InterimInterval = cm.GetDuration("accounting", "interim", 300*time.Second)
+	if a.InterimInterval <= 0 {
+		logger.Warn("Invalid accounting interim interval %v, using 300s", a.InterimInterval)
+		a.InterimInterval = 300 * time.Second
 	}
+	a.InputRate = int64(cm.GetInt("accounting", "input_rate", 20000, 0, math.MaxInt32))
+	a.OutputRate = int64(cm.GetInt("accounting", "output_rate", 5000, 0, math.MaxInt32))
+	a.PacketSize = cm.GetInt("accounting", "packet_size", 500, 1, 65535)
+	a.TerminateCause = cm.GetString("accounting", "terminate_cause", "User-Request")
 
-	a.Secret = configManager.GetString("accounting", "secret", "secret")
-	a.UserName = configManager.GetString("accounting", "User-Name", "")
-	a.AcctSessionId = configManager.GetString("accounting", "Acct-Session-Id", "")
-	a.CallingStationId = configManager.GetString("accounting", "Calling-Station-Id", "")
-	a.CalledStationId = configManager.GetString("accounting", "Called-Station-Id", "")
-	a.NASPort = configManager.GetString("accounting", "NAS-Port", "")
-	a.NASPortType = configManager.GetString("accounting", "NAS-Port-Type", "")
-	a.FramedIPAddress = configManager.GetString("accounting", "Framed-IP-Address", "")
-	a.NASIdentifier = configManager.GetString("accounting", "NAS-Identifier", "")
-	a.NASPortId = configManager.GetString("accounting", "NAS-Port-Id", "")
-	a.NASIPAddress = configManager.GetString("accounting", "NAS-IP-Address", "")
+	// Start opens a new session, Interim-Update joins one in progress and
+	// Stop only reports its end
+	statusType := cm.GetString("accounting", "Acct-Status-Type", "Start")
+	a.StatusType, err = lookupRadiusValue(statusType, rfc2866.AcctStatusType_Strings)
+	switch {
+	case err != nil:
+		logger.Warn("Invalid Acct-Status-Type %s, using Start", statusType)
+		a.StatusType = rfc2866.AcctStatusType_Value_Start
+	case a.StatusType != rfc2866.AcctStatusType_Value_Start &&
+		a.StatusType != rfc2866.AcctStatusType_Value_InterimUpdate &&
+		a.StatusType != rfc2866.AcctStatusType_Value_Stop:
+		logger.Warn("Unsupported Acct-Status-Type %s, using Start", a.StatusType)
+		a.StatusType = rfc2866.AcctStatusType_Value_Start
+	}
+	a.Attributes = readRadiusAttributes(cm, "accounting")
 
-	logger.Info("RADIUS Accounting configured - Enabled: %v, Server: %v",
-		a.Enabled, a.ServerIP)
+	logger.Info("RADIUS Accounting configured - Enabled: %v, Server: %v, Attributes: %d",
+		a.Enabled, a.Servers.String(), len(a.Attributes))
 }
 
 // ReadRadiusAuthenticationConfigOptimized uses the ConfigManager for better performance
-func (a *Authentication) ReadRadiusAuthenticationConfigOptimized() {
-	a.Enabled = configManager.GetBool("authentication", "enabled", false)
-
-	serverIP := configManager.GetString("authentication", "server", "")
-	if serverIP != "" {
-		a.ServerIP = net.ParseIP(serverIP)
-		if a.ServerIP == nil {
-			logger.Warn("Invalid authentication server IP: %s", serverIP)
-			a.Enabled = false
+func (a *Authentication) ReadRadiusAuthenticationConfigOptimized(cm *ConfigManager) {
+	a.Enabled = cm.GetBool("authentication", "enabled", false)
+
+	servers, err := readRadiusServers(cm, "authentication", radiusAuthPort)
+	if err != nil {
+		logger.Warn("Invalid authentication servers: %v", err)
+		a.Enabled = false
+	} else if a.Enabled && len(servers.Servers) == 0 {
+		logger.Warn("No authentication server configured, disabling authentication")
+		a.Enabled = false
+	}
+	a.Servers = servers
+
+	a.Secret = cm.GetString("authentication", "secret", "secret")
+	a.UserName = cm.GetString("authentication", "User-Name", "")
+	a.CallingStationId = cm.GetString("authentication", "Calling-Station-Id", "")
+	a.CalledStationId = cm.GetString("authentication", "Called-Station-Id", "")
+	a.NASPort = cm.GetString("authentication", "NAS-Port", "")
+	a.NASPortType = cm.GetString("authentication", "NAS-Port-Type", "")
+	a.FramedIPAddress = cm.GetString("authentication", "Framed-IP-Address", "")
+	a.NASIdentifier = cm.GetString("authentication", "NAS-Identifier", "")
+	a.NASPortId = cm.GetString("authentication", "NAS-Port-Id", "")
+	a.NASIPAddress = cm.GetString("authentication", "NAS-IP-Address", "")
+	a.Attributes = readRadiusAttributes(cm, "authentication")
+
+	a.AuthType = strings.ToLower(cm.GetString("authentication", "auth_type", "pap"))
+	if a.AuthType != "pap" && a.AuthType != "chap" {
+		logger.Warn("Invalid authentication type: %s, defaulting to pap", a.AuthType)
+		a.AuthType = "pap"
+	}
+	a.UserPassword = cm.GetString("authentication", "password", "")
+	a.MessageAuthenticator = cm.GetBool("authentication", "message_authenticator", true)
+	a.MACFormat = cm.GetString("authentication", "mac_format", defaultMACFormat)
+	if err := checkMACFormat(a.MACFormat); err != nil {
+		logger.Warn("Invalid mac_format, using %s: %v", defaultMACFormat, err)
+		a.MACFormat = defaultMACFormat
+	}
+
+	a.EAPMethod = strings.ToLower(cm.GetString("authentication", "eap", "none"))
+	a.Identity = cm.GetString("authentication", "eap_identity", "")
+	a.AnonymousIdentity = cm.GetString("authentication", "eap_anonymous_identity", "")
+	a.Password = cm.GetString("authentication", "eap_password", "")
+	a.CACert = cm.GetString("authentication", "eap_ca_cert", "")
+	a.ClientCert = cm.GetString("authentication", "eap_client_cert", "")
+	a.ClientKey = cm.GetString("authentication", "eap_client_key", "")
+	if _, ok := eapMethods[a.EAPMethod]; !ok {
+		if a.EAPMethod != "none" && a.EAPMethod != "" {
+			logger.Warn("Invalid EAP method: %s, using MAC authentication", a.EAPMethod)
 		}
+		a.EAPMethod = ""
+	} else if a.EAPMethod == "tls" && (a.ClientCert == "" || a.ClientKey == "") {
+		logger.Warn("EAP-TLS needs eap_client_cert and eap_client_key, using MAC authentication")
+		a.EAPMethod = ""
+	}
+
+	logger.Info("RADIUS Authentication configured - Enabled: %v, Server: %v, Type: %s, EAP: %s, Attributes: %d",
+		a.Enabled, a.Servers.String(), a.AuthType, a.EAPMethod, len(a.Attributes))
+}
+
+// readWirelessConfigOptimized uses the ConfigManager for better performance
+func (w *Wireless) readWirelessConfigOptimized(cm *ConfigManager) {
+	w.Enabled = cm.GetBool("wireless", "enabled", false)
+	w.SSID = cm.GetString("wireless", "ssid", "")
+	w.RoamInterval = cm.GetDuration("wireless", "roam_interval", 0)
+	w.RoamCause = cm.GetString("wireless", "roam_cause", "Lost-Carrier")
+	if _, err := parseTerminateCause(w.RoamCause); err != nil {
+		logger.Warn("Invalid roam_cause %s, using Lost-Carrier", w.RoamCause)
+		w.RoamCause = "Lost-Carrier"
+	}
+
+	w.RoamAccounting = strings.ToLower(cm.GetString("wireless", "roam_accounting", roamStopStart))
+	if w.RoamAccounting != roamStopStart && w.RoamAccounting != roamInterim {
+		logger.Warn("Invalid roam_accounting %s, using %s", w.RoamAccounting, roamStopStart)
+		w.RoamAccounting = roamStopStart
 	}
 
-	a.Secret = configManager.GetString("authentication", "secret", "secret")
-	a.UserName = configManager.GetString("authentication", "User-Name", "")
-	a.CallingStationId = configManager.GetString("authentication", "Calling-Station-Id", "")
-	a.CalledStationId = configManager.GetString("authentication", "Called-Station-Id", "")
-	a.NASPort = configManager.GetString("authentication", "NAS-Port", "")
-	a.NASPortType = configManager.GetString("authentication", "NAS-Port-Type", "")
-	a.FramedIPAddress = configManager.GetString("authentication", "Framed-IP-Address", "")
-	a.NASIdentifier = configManager.GetString("authentication", "NAS-Identifier", "")
-	a.NASPortId = configManager.GetString("authentication", "NAS-Port-Id", "")
-	a.NASIPAddress = configManager.GetString("authentication", "NAS-IP-Address", "")
+	aps, err := parseAccessPoints(cm.GetString("wireless", "aps", "[]"))
+	if err != nil {
+		logger.Warn("Invalid access points, disabling wireless: %v", err)
+		w.Enabled = false
+	} else if w.Enabled && len(aps) == 0 {
+		logger.Warn("No access point configured, disabling wireless")
+		w.Enabled = false
+	}
+	w.APs = aps
 
-	logger.Info("RADIUS Authentication configured - Enabled: %v, Server: %v",
-		a.Enabled, a.ServerIP)
+	logger.Info("Wireless configured - Enabled: %v, SSID: %s, APs: %d, Roaming: %v (%s)",
+		w.Enabled, w.SSID, len(w.APs), w.RoamInterval, w.RoamAccounting)
 }
 
 // readIpFixConfigOptimized uses the ConfigManager for better performance
-func (i *IpFix) readIpFixConfigOptimized() {
-	i.Enabled = configManager.GetBool("ipfix", "enabled", false)
-	i.DestinationIP = configManager.GetIP("ipfix", "destination_ip", net.ParseIP("127.0.0.1"))
-	i.DestinationPort = configManager.GetInt("ipfix", "destination_port", 4739, 1, 65535)
-	i.Traffic = configManager.GetString("ipfix", "traffic", "[]")
-
-	logger.Info("IPFIX configured - Enabled: %v, Destination: %v:%d",
-		i.Enabled, i.DestinationIP, i.DestinationPort)
+func (i *IpFix) readIpFixConfigOptimized(cm *ConfigManager) {
+	i.Enabled = cm.GetBool("ipfix", "enabled", false)
+	i.DestinationIP = cm.GetIP("ipfix", "destination_ip", net.ParseIP("127.0.0.1"))
+	i.DestinationPort = cm.GetInt("ipfix", "destination_port", 4739, 1, 65535)
+	i.Traffic = cm.GetString("ipfix", "traffic", "[]")
+	i.DeviceIP = cm.GetIP("dhcp", "ciaddr", nil)
+	i.DeviceMAC = cm.GetString("general", "clientmac", "")
+	i.MTU = cm.GetInt("ipfix", "mtu", defaultIPFIXMTU, 576, 65535)
+	i.TemplateRefresh = cm.GetDuration("ipfix", "template_refresh", defaultTemplateRefresh)
+
+	templateID := uint16(cm.GetInt("ipfix", "template_id", ipfixTemplateID, 256, 65535))
+	template, err := parseIPFIXTemplate(templateID, cm.GetString("ipfix", "template", "[]"))
+	if err != nil {
+		logger.Warn("Invalid IPFIX template, using the default one: %v", err)
+		template, _ = parseIPFIXTemplate(templateID, "[]")
+	}
+	i.Template = template
+
+	logger.Info("IPFIX configured - Enabled: %v, Destination: %v:%d, MTU: %d, Template refresh: %v",
+		i.Enabled, i.DestinationIP, i.DestinationPort, i.MTU, i.TemplateRefresh)
+	logger.Debug("IPFIX template %d: %s", i.Template.ID, i.Template)
 }
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+// radiusDataType is the dictionary data type of an attribute, which gives
+// how its configured value is encoded
+type radiusDataType int
+
+const (
+	radiusString radiusDataType = iota
+	radiusInteger
+	radiusIPAddr
+	radiusDate
+	radiusOctets
+	radiusPassword // string hidden with the shared secret (RFC 2865 5.2)
+)
+
+// radiusAttributeDef describes an attribute of the RADIUS dictionary
+type radiusAttributeDef struct {
+	Name   string
+	Type   radius.Type
+	Data   radiusDataType
+	Values map[uint32]string // Names of the enumerated values, if any
+}
+
+// radiusValues converts the value names generated for an attribute
+func radiusValues[T ~uint32](names map[T]string) map[uint32]string {
+	values := make(map[uint32]string, len(names))
+	for v, name := range names {
+		values[uint32(v)] = name
+	}
+	return values
+}
+
+// radiusDictionary lists the RFC 2865, 2866 and 2869 attributes that can
+// be set from the configuration. Vendor-Specific, EAP-Message and
+// Message-Authenticator are built by the simulator itself.
+var radiusDictionary = []radiusAttributeDef{
+	// RFC 2865
+	{"User-Name", rfc2865.UserName_Type, radiusString, nil},
+	{"User-Password", rfc2865.UserPassword_Type, radiusPassword, nil},
+	{"CHAP-Password", rfc2865.CHAPPassword_Type, radiusOctets, nil},
+	{"NAS-IP-Address", rfc2865.NASIPAddress_Type, radiusIPAddr, nil},
+	{"NAS-Port", rfc2865.NASPort_Type, radiusInteger, nil},
+	{"Service-Type", rfc2865.ServiceType_Type, radiusInteger, radiusValues(rfc2865.ServiceType_Strings)},
+	{"Framed-Protocol", rfc2865.FramedProtocol_Type, radiusInteger, radiusValues(rfc2865.FramedProtocol_Strings)},
+	{"Framed-IP-Address", rfc2865.FramedIPAddress_Type, radiusIPAddr, nil},
+	{"Framed-IP-Netmask", rfc2865.FramedIPNetmask_Type, radiusIPAddr, nil},
+	{"Framed-Routing", rfc2865.FramedRouting_Type, radiusInteger, radiusValues(rfc2865.FramedRouting_Strings)},
+	{"Filter-Id", rfc2865.FilterID_Type, radiusString, nil},
+	{"Framed-MTU", rfc2865.FramedMTU_Type, radiusInteger, nil},
+	{"Framed-Compression", rfc2865.FramedCompression_Type, radiusInteger, radiusValues(rfc2865.FramedCompression_Strings)},
+	{"Login-IP-Host", rfc2865.LoginIPHost_Type, radiusIPAddr, nil},
+	{"Login-Service", rfc2865.LoginService_Type, radiusInteger, radiusValues(rfc2865.LoginService_Strings)},
+	{"Login-TCP-Port", rfc2865.LoginTCPPort_Type, radiusInteger, radiusValues(rfc2865.LoginTCPPort_Strings)},
+	{"Reply-Message", rfc2865.ReplyMessage_Type, radiusString, nil},
+	{"Callback-Number", rfc2865.CallbackNumber_Type, radiusString, nil},
+	{"Callback-Id", rfc2865.CallbackID_Type, radiusString, nil},
+	{"Framed-Route", rfc2865.FramedRoute_Type, radiusString, nil},
+	{"Framed-IPX-Network", rfc2865.FramedIPXNetwork_Type, radiusIPAddr, nil},
+	{"State", rfc2865.State_Type, radiusOctets, nil},
+	{"Class", rfc2865.Class_Type, radiusOctets, nil},
+	{"Session-Timeout", rfc2865.SessionTimeout_Type, radiusInteger, nil},
+	{"Idle-Timeout", rfc2865.IdleTimeout_Type, radiusInteger, nil},
+	{"Termination-Action", rfc2865.TerminationAction_Type, radiusInteger, radiusValues(rfc2865.TerminationAction_Strings)},
+	{"Called-Station-Id", rfc2865.CalledStationID_Type, radiusString, nil},
+	{"Calling-Station-Id", rfc2865.CallingStationID_Type, radiusString, nil},
+	{"NAS-Identifier", rfc2865.NASIdentifier_Type, radiusString, nil},
+	{"Proxy-State", rfc2865.ProxyState_Type, radiusOctets, nil},
+	{"Login-LAT-Service", rfc2865.LoginLATService_Type, radiusString, nil},
+	{"Login-LAT-Node", rfc2865.LoginLATNode_Type, radiusString, nil},
+	{"Login-LAT-Group", rfc2865.LoginLATGroup_Type, radiusOctets, nil},
+	{"Framed-AppleTalk-Link", rfc2865.FramedAppleTalkLink_Type, radiusInteger, nil},
+	{"Framed-AppleTalk-Network", rfc2865.FramedAppleTalkNetwork_Type, radiusInteger, nil},
+	{"Framed-AppleTalk-Zone", rfc2865.FramedAppleTalkZone_Type, radiusString, nil},
+	{"CHAP-Challenge", rfc2865.CHAPChallenge_Type, radiusOctets, nil},
+	{"NAS-Port-Type", rfc2865.NASPortType_Type, radiusInteger, radiusValues(rfc2865.NASPortType_Strings)},
+	{"Port-Limit", rfc2865.PortLimit_Type, radiusInteger, nil},
+	{"Login-LAT-Port", rfc2865.LoginLATPort_Type, radiusString, nil},
+
+	// RFC 2866
+	{"Acct-Status-Type", rfc2866.AcctStatusType_Type, radiusInteger, radiusValues(rfc2866.AcctStatusType_Strings)},
+	{"Acct-Delay-Time", rfc2866.AcctDelayTime_Type, radiusInteger, nil},
+	{"Acct-Input-Octets", rfc2866.AcctInputOctets_Type, radiusInteger, nil},
+	{"Acct-Output-Octets", rfc2866.AcctOutputOctets_Type, radiusInteger, nil},
+	{"Acct-Session-Id", rfc2866.AcctSessionID_Type, radiusString, nil},
+	{"Acct-Authentic", rfc2866.AcctAuthentic_Type, radiusInteger, radiusValues(rfc2866.AcctAuthentic_Strings)},
+	{"Acct-Session-Time", rfc2866.AcctSessionTime_Type, radiusInteger, nil},
+	{"Acct-Input-Packets", rfc2866.AcctInputPackets_Type, radiusInteger, nil},
+	{"Acct-Output-Packets", rfc2866.AcctOutputPackets_Type, radiusInteger, nil},
+	{"Acct-Terminate-Cause", rfc2866.AcctTerminateCause_Type, radiusInteger, radiusValues(rfc2866.AcctTerminateCause_Strings)},
+	{"Acct-Multi-Session-Id", rfc2866.AcctMultiSessionID_Type, radiusString, nil},
+	{"Acct-Link-Count", rfc2866.AcctLinkCount_Type, radiusInteger, nil},
+
+	// RFC 2869
+	{"Acct-Input-Gigawords", rfc2869.AcctInputGigawords_Type, radiusInteger, nil},
+	{"Acct-Output-Gigawords", rfc2869.AcctOutputGigawords_Type, radiusInteger, nil},
+	{"Event-Timestamp", rfc2869.EventTimestamp_Type, radiusDate, nil},
+	{"ARAP-Zone-Access", rfc2869.ARAPZoneAccess_Type, radiusInteger, radiusValues(rfc2869.ARAPZoneAccess_Strings)},
+	{"ARAP-Security", rfc2869.ARAPSecurity_Type, radiusInteger, nil},
+	{"ARAP-Security-Data", rfc2869.ARAPSecurityData_Type, radiusString, nil},
+	{"Password-Retry", rfc2869.PasswordRetry_Type, radiusInteger, nil},
+	{"Prompt", rfc2869.Prompt_Type, radiusInteger, radiusValues(rfc2869.Prompt_Strings)},
+	{"Connect-Info", rfc2869.ConnectInfo_Type, radiusString, nil},
+	{"Configuration-Token", rfc2869.ConfigurationToken_Type, radiusString, nil},
+	{"Acct-Interim-Interval", rfc2869.AcctInterimInterval_Type, radiusInteger, nil},
+	{"NAS-Port-Id", rfc2869.NASPortID_Type, radiusString, nil},
+	{"Framed-Pool", rfc2869.FramedPool_Type, radiusString, nil},
+}
+
+// radiusAttributesByName indexes the dictionary by lower case name
+var radiusAttributesByName = func() map[string]*radiusAttributeDef {
+	byName := make(map[string]*radiusAttributeDef, len(radiusDictionary))
+	for i := range radiusDictionary {
+		byName[strings.ToLower(radiusDictionary[i].Name)] = &radiusDictionary[i]
+	}
+	return byName
+}()
+
+// lookupRadiusAttribute finds a dictionary attribute by name, ignoring case
+func lookupRadiusAttribute(name string) (*radiusAttributeDef, bool) {
+	def, ok := radiusAttributesByName[strings.ToLower(strings.TrimSpace(name))]
+	return def, ok
+}
+
+// encode converts a configured value to the attribute data type. Integers
+// take a number or a value name, octets a 0x-prefixed hex string or text,
+// and dates a Unix time or RFC 3339 timestamp.
+func (d *radiusAttributeDef) encode(value string) (radius.Attribute, error) {
+	switch d.Data {
+	case radiusInteger:
+		n, err := lookupRadiusValue(value, d.Values)
+		if err != nil {
+			return nil, err
+		}
+		return radius.NewInteger(n), nil
+	case radiusIPAddr:
+		ip := net.ParseIP(value).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", value)
+		}
+		return radius.NewIPAddr(ip)
+	case radiusDate:
+		if seconds, err := strconv.ParseUint(value, 10, 32); err == nil {
+			return radius.NewDate(time.Unix(int64(seconds), 0))
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", value)
+		}
+		return radius.NewDate(t)
+	case radiusOctets:
+		if hexValue, ok := cutHexPrefix(value); ok {
+			b, err := hex.DecodeString(hexValue)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hex value %q", value)
+			}
+			return radius.NewBytes(b)
+		}
+		return radius.NewBytes([]byte(value))
+	default:
+		// Passwords are hidden per packet, in Apply
+		return radius.NewString(value)
+	}
+}
+
+// RadiusAttribute is an attribute set from the configuration
+type RadiusAttribute struct {
+	Name  string
+	Type  radius.Type
+	Value radius.Attribute
+
+	password bool
+}
+
+// RadiusAttributes is the list of attributes a RADIUS section puts on the
+// wire
+type RadiusAttributes []RadiusAttribute
+
+// readRadiusAttributes reads every dictionary attribute of a section, then
+// the vendor-specific attributes of its vsa list. Keys written like
+// attribute names (e.g. Foo-Bar) that the dictionary does not know are
+// reported, the other keys are settings of the simulator.
+func readRadiusAttributes(cm *ConfigManager, section string) RadiusAttributes {
+	var attrs RadiusAttributes
+	for _, key := range cm.GetKeys(section) {
+		def, ok := lookupRadiusAttribute(key)
+		if !ok {
+			if strings.Contains(key, "-") {
+				logger.Warn("Unknown RADIUS attribute %s in [%s], ignored", key, section)
+			}
+			continue
+		}
+
+		value := strings.TrimSpace(cm.GetString(section, key, ""))
+		if value == "" {
+			continue
+		}
+		a, err := def.encode(value)
+		if err != nil {
+			logger.Warn("Invalid value for RADIUS attribute %s in [%s]: %v", def.Name, section, err)
+			continue
+		}
+		attrs = append(attrs, RadiusAttribute{
+			Name:     def.Name,
+			Type:     def.Type,
+			Value:    a,
+			password: def.Data == radiusPassword,
+		})
+	}
+
+	if body := cm.GetString(section, "vsa", ""); body != "" {
+		vsas, err := readVendorAttributes(body)
+		if err != nil {
+			logger.Warn("Invalid vendor-specific attributes in [%s]: %v", section, err)
+		}
+		attrs = append(attrs, vsas...)
+	}
+	return attrs
+}
+
+// Lookup returns the configured value of an attribute
+func (attrs RadiusAttributes) Lookup(t radius.Type) (radius.Attribute, bool) {
+	for _, a := range attrs {
+		if a.Type == t {
+			return a.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Without returns a copy of the attributes, leaving out those of type t
+func (attrs RadiusAttributes) Without(t radius.Type) RadiusAttributes {
+	var kept RadiusAttributes
+	for _, a := range attrs {
+		if a.Type != t {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// Apply sets the attributes in the packet, replacing any value already
+// set. Vendor-Specific attributes are all added.
+func (attrs RadiusAttributes) Apply(p *radius.Packet) error {
+	for _, a := range attrs {
+		value := a.Value
+		if a.password {
+			hidden, err := radius.NewUserPassword(a.Value, p.Secret, p.Authenticator[:])
+			if err != nil {
+				return fmt.Errorf("%s: %v", a.Name, err)
+			}
+			value = hidden
+		}
+		if a.Type == rfc2865.VendorSpecific_Type {
+			p.Add(a.Type, value)
+		} else {
+			p.Set(a.Type, value)
+		}
+	}
+	return nil
+}
+
+// lookupRadiusValue finds an enumerated attribute value by name, ignoring
+// case, or by number
+func lookupRadiusValue[T ~uint32](value string, names map[T]string) (T, error) {
+	value = strings.TrimSpace(value)
+	if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return T(n), nil
+	}
+	for v, name := range names {
+		if strings.EqualFold(name, value) {
+			return v, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown value %q", value)
+}
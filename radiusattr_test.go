@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+)
+
+// testRadiusAttributes reads the attributes of the first section of a
+// configuration
+func testRadiusAttributes(t *testing.T, content string) RadiusAttributes {
+	t.Helper()
+	cm := testConfigManager(t, content)
+	return readRadiusAttributes(cm, cm.cfg.SectionStrings()[1])
+}
+
+// TestRadiusAttributes tests that configured attributes are encoded with
+// their dictionary type
+func TestRadiusAttributes(t *testing.T) {
+	attrs := testRadiusAttributes(t, `[authentication]
+enabled = true
+secret = secret
+nas-port-type = Wireless-802.11
+NAS-Port = 24
+NAS-IP-Address = 192.168.0.1
+Acct-Status-Type = Interim-Update
+Event-Timestamp = 1700000000
+Class = 0x0102
+User-Password = hunter2
+Framed-IP-Address = not-an-ip
+Foo-Bar = 1
+`)
+	if len(attrs) != 7 {
+		t.Fatalf("expected 7 attributes, got %d: %v", len(attrs), attrs)
+	}
+
+	packet := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	if err := attrs.Apply(packet); err != nil {
+		t.Fatal(err)
+	}
+	if rfc2865.NASPortType_Get(packet) != rfc2865.NASPortType_Value_Wireless80211 || rfc2865.NASPort_Get(packet) != 24 {
+		t.Errorf("unexpected NAS-Port-Type %v or NAS-Port %d", rfc2865.NASPortType_Get(packet), rfc2865.NASPort_Get(packet))
+	}
+	if !rfc2865.NASIPAddress_Get(packet).Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Errorf("unexpected NAS-IP-Address %v", rfc2865.NASIPAddress_Get(packet))
+	}
+	if rfc2866.AcctStatusType_Get(packet) != rfc2866.AcctStatusType_Value_InterimUpdate {
+		t.Errorf("unexpected Acct-Status-Type %v", rfc2866.AcctStatusType_Get(packet))
+	}
+	if rfc2869.EventTimestamp_Get(packet).Unix() != 1700000000 {
+		t.Errorf("unexpected Event-Timestamp %v", rfc2869.EventTimestamp_Get(packet))
+	}
+	if class := rfc2865.Class_Get(packet); len(class) != 2 || class[1] != 0x02 {
+		t.Errorf("unexpected Class %x", class)
+	}
+	if rfc2865.UserPassword_GetString(packet) != "hunter2" || string(packet.Get(rfc2865.UserPassword_Type)) == "hunter2" {
+		t.Error("User-Password not hidden with the secret")
+	}
+	if _, ok := attrs.Lookup(rfc2865.FramedIPAddress_Type); ok {
+		t.Error("invalid Framed-IP-Address should be skipped")
+	}
+}
+
+// TestLookupRadiusValue tests enumerated values by name and number
+func TestLookupRadiusValue(t *testing.T) {
+	if v, err := lookupRadiusValue("ethernet", rfc2865.NASPortType_Strings); err != nil || v != rfc2865.NASPortType_Value_Ethernet {
+		t.Errorf("unexpected NAS-Port-Type %v (%v)", v, err)
+	}
+	if v, err := parseTerminateCause("4"); err != nil || v != rfc2866.AcctTerminateCause_Value_IdleTimeout {
+		t.Errorf("unexpected Acct-Terminate-Cause %v (%v)", v, err)
+	}
+	if _, err := lookupRadiusValue("Carrier-Pigeon", rfc2865.NASPortType_Strings); err == nil {
+		t.Error("expected an error for an unknown NAS-Port-Type")
+	}
+}
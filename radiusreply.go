@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc3580"
+)
+
+// ciscoVendorID is the enterprise number of Cisco-AVPair
+const ciscoVendorID = 9
+
+// AccessAccept holds the authorization attributes of an Access-Accept
+type AccessAccept struct {
+	TunnelType       rfc2868.TunnelType
+	TunnelMediumType rfc2868.TunnelMediumType
+	TunnelGroupID    string // Tunnel-Private-Group-Id, the VLAN ID or name
+	FilterIDs        []string
+	SessionTimeout   time.Duration
+	ReplyMessages    []string
+	URLRedirect      string   // Cisco-AVPair url-redirect
+	URLRedirectACL   string   // Cisco-AVPair url-redirect-acl
+	AVPairs          []string // Other Cisco-AVPairs
+}
+
+// decodeAccessAccept decodes the authorization attributes of a response
+func decodeAccessAccept(p *radius.Packet) *AccessAccept {
+	a := &AccessAccept{}
+
+	// Tunnel attributes are tagged, the first of each is used
+	if _, tunnelType, err := rfc2868.TunnelType_Lookup(p); err == nil {
+		a.TunnelType = tunnelType
+	}
+	if _, medium, err := rfc2868.TunnelMediumType_Lookup(p); err == nil {
+		a.TunnelMediumType = medium
+	}
+	if _, groupID, err := rfc2868.TunnelPrivateGroupID_LookupString(p); err == nil {
+		a.TunnelGroupID = strings.TrimSpace(groupID)
+	}
+
+	a.FilterIDs, _ = rfc2865.FilterID_GetStrings(p)
+	a.ReplyMessages, _ = rfc2865.ReplyMessage_GetStrings(p)
+	if timeout, err := rfc2865.SessionTimeout_Lookup(p); err == nil {
+		a.SessionTimeout = time.Duration(timeout) * time.Second
+	}
+
+	for _, avp := range p.Attributes {
+		if avp.Type != rfc2865.VendorSpecific_Type {
+			continue
+		}
+		vendorID, vsa, err := radius.VendorSpecific(avp.Attribute)
+		if err != nil || vendorID != ciscoVendorID {
+			continue
+		}
+		// A VSA may carry several vendor attributes
+		for len(vsa) >= 2 && int(vsa[1]) >= 2 && int(vsa[1]) <= len(vsa) {
+			typ, value := vsa[0], string(vsa[2:vsa[1]])
+			vsa = vsa[vsa[1]:]
+			if typ == 1 {
+				a.addAVPair(value)
+			}
+		}
+	}
+	return a
+}
+
+// addAVPair sorts a Cisco-AVPair ("name=value", the name possibly prefixed
+// by a protocol, e.g. "cisco-av-pair:url-redirect=...")
+func (a *AccessAccept) addAVPair(pair string) {
+	name, value, _ := strings.Cut(pair, "=")
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		name = name[i+1:]
+	}
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "url-redirect":
+		a.URLRedirect = value
+	case "url-redirect-acl":
+		a.URLRedirectACL = value
+	default:
+		a.AVPairs = append(a.AVPairs, pair)
+	}
+}
+
+// VLAN returns the VLAN ID assigned with the RFC 3580 tunnel attributes.
+// A VLAN given by name cannot be applied to the frames.
+func (a *AccessAccept) VLAN() (uint16, bool) {
+	if a.TunnelType != rfc3580.TunnelType_Value_VLAN || a.TunnelGroupID == "" {
+		return 0, false
+	}
+	if a.TunnelMediumType != 0 && a.TunnelMediumType != rfc2868.TunnelMediumType_Value_IEEE802 {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(a.TunnelGroupID, 10, 16)
+	if err != nil || id == 0 || id > 4094 {
+		return 0, false
+	}
+	return uint16(id), true
+}
+
+// String lists the decoded attributes on one line
+func (a *AccessAccept) String() string {
+	var fields []string
+	if a.TunnelType != 0 || a.TunnelGroupID != "" {
+		fields = append(fields, fmt.Sprintf("Tunnel-Type=%s Tunnel-Medium-Type=%s Tunnel-Private-Group-Id=%q",
+			a.TunnelType, a.TunnelMediumType, a.TunnelGroupID))
+	}
+	for _, filter := range a.FilterIDs {
+		fields = append(fields, fmt.Sprintf("Filter-Id=%q", filter))
+	}
+	if a.SessionTimeout > 0 {
+		fields = append(fields, fmt.Sprintf("Session-Timeout=%v", a.SessionTimeout))
+	}
+	for _, msg := range a.ReplyMessages {
+		fields = append(fields, fmt.Sprintf("Reply-Message=%q", msg))
+	}
+	if a.URLRedirect != "" {
+		fields = append(fields, fmt.Sprintf("url-redirect=%s", a.URLRedirect))
+	}
+	if a.URLRedirectACL != "" {
+		fields = append(fields, fmt.Sprintf("url-redirect-acl=%s", a.URLRedirectACL))
+	}
+	for _, pair := range a.AVPairs {
+		fields = append(fields, fmt.Sprintf("Cisco-AVPair=%q", pair))
+	}
+	if len(fields) == 0 {
+		return "no authorization attributes"
+	}
+	return strings.Join(fields, ", ")
+}
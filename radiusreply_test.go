@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2868"
+	"layeh.com/radius/rfc3580"
+)
+
+// TestDecodeAccessAccept tests the decoding of the authorization
+// attributes and the VLAN move they trigger
+func TestDecodeAccessAccept(t *testing.T) {
+	p := radius.New(radius.CodeAccessAccept, []byte("secret"))
+	rfc2868.TunnelType_Add(p, 1, rfc3580.TunnelType_Value_VLAN)
+	rfc2868.TunnelMediumType_Add(p, 1, rfc2868.TunnelMediumType_Value_IEEE802)
+	rfc2868.TunnelPrivateGroupID_AddString(p, 1, "42")
+	rfc2865.FilterID_AddString(p, "guest-acl")
+	rfc2865.SessionTimeout_Add(p, 3600)
+	rfc2865.ReplyMessage_AddString(p, "Welcome")
+	for _, pair := range []string{"url-redirect=https://portal/?mac=90:6c:ac:64:95:c1", "url-redirect-acl=REDIRECT", "subscriber:command=reauthenticate"} {
+		vsa, _ := radius.NewVendorSpecific(ciscoVendorID, append([]byte{1, byte(2 + len(pair))}, pair...))
+		p.Add(rfc2865.VendorSpecific_Type, vsa)
+	}
+
+	accept := decodeAccessAccept(p)
+	if id, ok := accept.VLAN(); !ok || id != 42 {
+		t.Errorf("unexpected VLAN %d (%v)", id, ok)
+	}
+	if accept.SessionTimeout != time.Hour || len(accept.FilterIDs) != 1 || accept.ReplyMessages[0] != "Welcome" {
+		t.Errorf("unexpected attributes: %s", accept)
+	}
+	if accept.URLRedirect != "https://portal/?mac=90:6c:ac:64:95:c1" || accept.URLRedirectACL != "REDIRECT" || len(accept.AVPairs) != 1 {
+		t.Errorf("unexpected Cisco-AVPairs: %s", accept)
+	}
+
+	// The device keeps its priority and moves to the assigned VLAN
+	mac, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	raw := &RawClient{vlans: make(map[string]VLAN)}
+	dev := &Device{Name: "test", ClientMAC: mac, VLAN: VLAN{ID: 10, Priority: 3}, raw: raw}
+	dev.authorize(accept)
+	if got := raw.vlans[mac.String()]; got.ID != 42 || got.Priority != 3 {
+		t.Errorf("device not moved to VLAN 42: %s", got)
+	}
+
+	named := &AccessAccept{TunnelType: rfc3580.TunnelType_Value_VLAN, TunnelGroupID: "guests"}
+	if _, ok := named.VLAN(); ok {
+		t.Error("a VLAN name should not be applied")
+	}
+}
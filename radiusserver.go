@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// Default ports and retry policy of the RADIUS servers
+const (
+	radiusAuthPort        = "1812"
+	radiusAcctPort        = "1813"
+	defaultRadiusTimeout  = 3 * time.Second
+	defaultRadiusRetries  = 2
+	defaultRadiusDeadTime = time.Minute
+)
+
+// RadiusServer is a RADIUS server and how a request is sent to it
+type RadiusServer struct {
+	Address string        // host:port
+	Secret  string        // Shared secret
+	Timeout time.Duration // Wait before each retransmission
+	Retries int           // Retransmissions before failing over
+}
+
+// RadiusServers are the servers of a section, tried in order like a NAS
+// does: a server that does not answer is marked dead for DeadTime and the
+// next one takes over. With StatusInterval, dead servers are probed with
+// Status-Server (RFC 5997) and revived as soon as they answer.
+type RadiusServers struct {
+	Servers        []RadiusServer
+	DeadTime       time.Duration
+	StatusInterval time.Duration
+	RadSec         *RadSec // RADIUS over TLS, UDP when nil
+
+	health *radiusHealth // Shared state, radiusServerHealth when nil
+}
+
+// radiusHealth holds the dead servers, shared by all the devices like the
+// server state of a NAS is shared by its ports
+type radiusHealth struct {
+	mu        sync.Mutex
+	deadUntil map[string]time.Time
+	probing   map[string]bool
+}
+
+var radiusServerHealth = newRadiusHealth()
+
+func newRadiusHealth() *radiusHealth {
+	return &radiusHealth{deadUntil: make(map[string]time.Time), probing: make(map[string]bool)}
+}
+
+func (rs *RadiusServers) healthState() *radiusHealth {
+	if rs.health != nil {
+		return rs.health
+	}
+	return radiusServerHealth
+}
+
+// String lists the server addresses
+func (rs *RadiusServers) String() string {
+	addrs := make([]string, len(rs.Servers))
+	for i, srv := range rs.Servers {
+		addrs[i] = srv.Address
+	}
+	return strings.Join(addrs, ", ")
+}
+
+// alive reports whether a server is not in its dead time
+func (rs *RadiusServers) alive(srv *RadiusServer) bool {
+	h := rs.healthState()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !time.Now().Before(h.deadUntil[srv.Address])
+}
+
+// candidates returns the servers alive in configuration order, or all of
+// them when they are all dead
+func (rs *RadiusServers) candidates() []*RadiusServer {
+	var alive, all []*RadiusServer
+	for i := range rs.Servers {
+		srv := &rs.Servers[i]
+		all = append(all, srv)
+		if rs.alive(srv) {
+			alive = append(alive, srv)
+		}
+	}
+	if len(alive) == 0 {
+		return all
+	}
+	return alive
+}
+
+// Pick returns the server to run a conversation with, such as EAP whose
+// requests must all go to the same server
+func (rs *RadiusServers) Pick() *RadiusServer {
+	if len(rs.Servers) == 0 {
+		return nil
+	}
+	return rs.candidates()[0]
+}
+
+// Exchange sends a request to the first server alive and fails over to the
+// next ones while they do not answer. build creates the request for the
+// secret of each server tried. It returns the request answered with the
+// response.
+func (rs *RadiusServers) Exchange(ctx context.Context, build func(secret []byte) (*radius.Packet, error)) (request, response *radius.Packet, err error) {
+	if len(rs.Servers) == 0 {
+		return nil, nil, errors.New("no RADIUS server configured")
+	}
+	var errs []error
+	for _, srv := range rs.candidates() {
+		request, err = build([]byte(srv.Secret))
+		if err != nil {
+			return nil, nil, err
+		}
+		response, err = rs.ExchangeWith(ctx, srv, request)
+		if err == nil {
+			return request, response, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, err
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", srv.Address, err))
+	}
+	return nil, nil, errors.Join(errs...)
+}
+
+// ExchangeWith sends a request to a server, retransmitting it every
+// Timeout up to Retries times over UDP. A server that does not answer is
+// marked dead.
+func (rs *RadiusServers) ExchangeWith(ctx context.Context, srv *RadiusServer, p *radius.Packet) (*radius.Packet, error) {
+	attemptCtx, cancel := context.WithTimeout(ctx, srv.Timeout*time.Duration(srv.Retries+1))
+	defer cancel()
+
+	response, err := rs.transmit(attemptCtx, srv, p, srv.Timeout)
+	if err != nil && ctx.Err() == nil {
+		rs.markDead(srv)
+	}
+	return response, err
+}
+
+// transmit sends a request over UDP, retransmitted every retry, or over
+// the RadSec connection to the server
+func (rs *RadiusServers) transmit(ctx context.Context, srv *RadiusServer, p *radius.Packet, retry time.Duration) (*radius.Packet, error) {
+	if rs.RadSec != nil {
+		conn, err := radsecConns.get(srv.Address, rs.RadSec)
+		if err != nil {
+			return nil, err
+		}
+		return conn.Exchange(ctx, p)
+	}
+	client := &radius.Client{Retry: retry, MaxPacketErrors: 2}
+	return client.Exchange(ctx, p, srv.Address)
+}
+
+// markDead holds a server down for the dead time and starts probing it
+func (rs *RadiusServers) markDead(srv *RadiusServer) {
+	if rs.DeadTime <= 0 {
+		logger.Warn("RADIUS server %s is not responding", srv.Address)
+		return
+	}
+	h := rs.healthState()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if time.Now().Before(h.deadUntil[srv.Address]) {
+		return
+	}
+	h.deadUntil[srv.Address] = time.Now().Add(rs.DeadTime)
+	logger.Warn("RADIUS server %s is not responding, marked dead for %v", srv.Address, rs.DeadTime)
+
+	if rs.StatusInterval > 0 && !h.probing[srv.Address] {
+		h.probing[srv.Address] = true
+		go rs.probe(srv)
+	}
+}
+
+// probe sends Status-Server requests to a dead server until it answers or
+// its dead time is over
+func (rs *RadiusServers) probe(srv *RadiusServer) {
+	h := rs.healthState()
+	defer func() {
+		h.mu.Lock()
+		delete(h.probing, srv.Address)
+		h.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(rs.StatusInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if rs.alive(srv) {
+			return
+		}
+		if err := rs.statusServer(context.Background(), srv); err != nil {
+			logger.Debug("Status-Server to %s: %v", srv.Address, err)
+			continue
+		}
+		h.mu.Lock()
+		delete(h.deadUntil, srv.Address)
+		h.mu.Unlock()
+		logger.Info("RADIUS server %s answered Status-Server, marked alive", srv.Address)
+		return
+	}
+}
+
+// statusServer checks that a server is up with a Status-Server request,
+// which must be signed with a Message-Authenticator
+func (rs *RadiusServers) statusServer(ctx context.Context, srv *RadiusServer) error {
+	p := radius.New(radius.CodeStatusServer, []byte(srv.Secret))
+	if err := setMessageAuthenticator(p); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, srv.Timeout)
+	defer cancel()
+
+	response, err := rs.transmit(ctx, srv, p, 0)
+	if err != nil {
+		return err
+	}
+	if !verifyMessageAuthenticator(response, p.Authenticator, false) {
+		return fmt.Errorf("invalid Message-Authenticator in %s", response.Code)
+	}
+	return nil
+}
+
+// readRadiusServers reads the servers of a RADIUS section: the JSON
+// servers list, or the comma separated server addresses sharing the
+// section secret, timeout and retries, and their transport
+func readRadiusServers(cm *ConfigManager, section, port string) (RadiusServers, error) {
+	rs := RadiusServers{
+		DeadTime:       cm.GetDuration(section, "dead_time", defaultRadiusDeadTime),
+		StatusInterval: cm.GetDuration(section, "status_interval", 0),
+	}
+	defaults := RadiusServer{
+		Secret:  cm.GetString(section, "secret", "secret"),
+		Timeout: cm.GetDuration(section, "timeout", defaultRadiusTimeout),
+		Retries: cm.GetInt(section, "retries", defaultRadiusRetries, 0, 10),
+	}
+
+	switch transport := strings.ToLower(cm.GetString(section, "transport", "udp")); transport {
+	case "udp":
+	case "radsec":
+		rs.RadSec = &RadSec{
+			CACert:     cm.GetString(section, "radsec_ca_cert", ""),
+			ClientCert: cm.GetString(section, "radsec_client_cert", ""),
+			ClientKey:  cm.GetString(section, "radsec_client_key", ""),
+			ServerName: cm.GetString(section, "radsec_server_name", ""),
+		}
+		if rs.RadSec.CACert == "" || rs.RadSec.ClientCert == "" || rs.RadSec.ClientKey == "" {
+			return rs, errors.New("RadSec needs radsec_ca_cert, radsec_client_cert and radsec_client_key")
+		}
+		// Both authentication and accounting go to the RadSec port, with
+		// the well-known secret unless another one is set
+		port = radsecPort
+		defaults.Secret = cm.GetString(section, "secret", radsecSecret)
+	default:
+		return rs, fmt.Errorf("unknown transport %q", transport)
+	}
+
+	var err error
+	if body := cm.GetString(section, "servers", ""); body != "" {
+		rs.Servers, err = parseRadiusServers(body, defaults, port)
+	} else {
+		rs.Servers, err = parseRadiusServerList(cm.GetString(section, "server", ""), defaults, port)
+	}
+	return rs, err
+}
+
+// parseRadiusServerList parses comma separated host[:port] addresses
+func parseRadiusServerList(list string, defaults RadiusServer, port string) ([]RadiusServer, error) {
+	var servers []RadiusServer
+	for _, addr := range splitList(list) {
+		srv := defaults
+		address, err := radiusServerAddress(addr, port)
+		if err != nil {
+			return servers, err
+		}
+		srv.Address = address
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// radiusServerEntry is an entry of a JSON servers list
+type radiusServerEntry struct {
+	Address string `json:"address"`
+	Secret  string `json:"secret,omitempty"`
+	Timeout string `json:"timeout,omitempty"` // Seconds or Go duration
+	Retries *int   `json:"retries,omitempty"`
+}
+
+// parseRadiusServers parses a JSON servers list, whose entries override the
+// section secret, timeout and retries
+func parseRadiusServers(body string, defaults RadiusServer, port string) ([]RadiusServer, error) {
+	var entries []radiusServerEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		return nil, fmt.Errorf("invalid servers JSON: %v", err)
+	}
+
+	var servers []RadiusServer
+	for _, entry := range entries {
+		srv := defaults
+		address, err := radiusServerAddress(entry.Address, port)
+		if err != nil {
+			return servers, err
+		}
+		srv.Address = address
+		if entry.Secret != "" {
+			srv.Secret = entry.Secret
+		}
+		if entry.Timeout != "" {
+			if srv.Timeout, err = parseSeconds(entry.Timeout); err != nil || srv.Timeout <= 0 {
+				return servers, fmt.Errorf("%s: invalid timeout %q", address, entry.Timeout)
+			}
+		}
+		if entry.Retries != nil {
+			if *entry.Retries < 0 {
+				return servers, fmt.Errorf("%s: invalid retries %d", address, *entry.Retries)
+			}
+			srv.Retries = *entry.Retries
+		}
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// radiusServerAddress adds the default port to a server address
+func radiusServerAddress(addr, port string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, p = strings.Trim(addr, "[]"), port
+	}
+	if host == "" {
+		return "", fmt.Errorf("invalid RADIUS server %q", addr)
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port in RADIUS server %q", addr)
+	}
+	return net.JoinHostPort(host, p), nil
+}
+
+// parseSeconds parses a duration given in seconds or as a Go duration
+func parseSeconds(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
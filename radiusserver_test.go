@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+)
+
+func testRadiusServers(t *testing.T, content string) (RadiusServers, error) {
+	t.Helper()
+	return readRadiusServers(testConfigManager(t, content), "authentication", radiusAuthPort)
+}
+
+func TestReadRadiusServers(t *testing.T) {
+	rs, err := testRadiusServers(t, `[authentication]
+server = 10.10.1.1, 10.10.1.2:11812, [2001:db8::1]
+secret = s3cret
+timeout = 2
+retries = 1
+dead_time = 30s
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RadiusServer{
+		{Address: "10.10.1.1:1812", Secret: "s3cret", Timeout: 2 * time.Second, Retries: 1},
+		{Address: "10.10.1.2:11812", Secret: "s3cret", Timeout: 2 * time.Second, Retries: 1},
+		{Address: "[2001:db8::1]:1812", Secret: "s3cret", Timeout: 2 * time.Second, Retries: 1},
+	}
+	if len(rs.Servers) != len(expected) || rs.DeadTime != 30*time.Second || rs.StatusInterval != 0 {
+		t.Fatalf("unexpected servers %+v", rs)
+	}
+	for i := range expected {
+		if rs.Servers[i] != expected[i] {
+			t.Errorf("server %d: got %+v, expected %+v", i, rs.Servers[i], expected[i])
+		}
+	}
+
+	// The servers list overrides server and the section defaults
+	rs, err = testRadiusServers(t, `[authentication]
+server = 10.10.1.1
+secret = s3cret
+servers = [{"address": "10.10.2.1", "timeout": "500ms", "retries": 0}, {"address": "10.10.2.2:1645", "secret": "other"}]
+status_interval = 10
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []RadiusServer{
+		{Address: "10.10.2.1:1812", Secret: "s3cret", Timeout: 500 * time.Millisecond, Retries: 0},
+		{Address: "10.10.2.2:1645", Secret: "other", Timeout: defaultRadiusTimeout, Retries: defaultRadiusRetries},
+	}
+	if len(rs.Servers) != len(expected) || rs.DeadTime != defaultRadiusDeadTime || rs.StatusInterval != 10*time.Second {
+		t.Fatalf("unexpected servers %+v", rs)
+	}
+	for i := range expected {
+		if rs.Servers[i] != expected[i] {
+			t.Errorf("server %d: got %+v, expected %+v", i, rs.Servers[i], expected[i])
+		}
+	}
+
+	if _, err := testRadiusServers(t, "[authentication]\nserver = 10.10.1.1:99999\n"); err == nil {
+		t.Error("invalid port accepted")
+	}
+}
+
+// testRadiusServer runs a RADIUS server accepting every request while up
+// and counting the Access-Requests
+func testRadiusServer(t *testing.T, up *atomic.Bool, received *atomic.Int32) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte("secret")),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			if r.Code == radius.CodeAccessRequest {
+				received.Add(1)
+			}
+			if !up.Load() {
+				return
+			}
+			response := r.Response(radius.CodeAccessAccept)
+			setMessageAuthenticator(response)
+			w.Write(response)
+		}),
+	}
+	go server.Serve(conn)
+	t.Cleanup(func() { server.Shutdown(context.Background()) })
+	return conn.LocalAddr().String()
+}
+
+// TestRadiusFailover tests the failover to the next server, the dead time
+// of the server not answering and its revival by Status-Server
+func TestRadiusFailover(t *testing.T) {
+	var primaryUp, secondaryUp atomic.Bool
+	var primaryReceived, secondaryReceived atomic.Int32
+	secondaryUp.Store(true)
+
+	rs := RadiusServers{
+		Servers: []RadiusServer{
+			{Address: testRadiusServer(t, &primaryUp, &primaryReceived), Secret: "secret", Timeout: 50 * time.Millisecond, Retries: 1},
+			{Address: testRadiusServer(t, &secondaryUp, &secondaryReceived), Secret: "secret", Timeout: 50 * time.Millisecond, Retries: 1},
+		},
+		DeadTime:       time.Minute,
+		StatusInterval: 20 * time.Millisecond,
+		health:         newRadiusHealth(),
+	}
+	exchange := func() (*radius.Packet, error) {
+		_, response, err := rs.Exchange(context.Background(), func(secret []byte) (*radius.Packet, error) {
+			return radius.New(radius.CodeAccessRequest, secret), nil
+		})
+		return response, err
+	}
+
+	if _, err := exchange(); err != nil {
+		t.Fatalf("no failover: %v", err)
+	}
+	// The last retransmission may race with the deadline
+	if n := primaryReceived.Load(); n < 2 || n > 3 {
+		t.Errorf("primary received %d requests, expected the request and 1 retry", n)
+	}
+	if rs.alive(&rs.Servers[0]) || rs.Pick() != &rs.Servers[1] {
+		t.Fatal("primary not marked dead")
+	}
+
+	// Dead servers are skipped
+	sent := primaryReceived.Load()
+	if _, err := exchange(); err != nil || secondaryReceived.Load() != 2 || primaryReceived.Load() != sent {
+		t.Errorf("second request: %v, secondary received %d", err, secondaryReceived.Load())
+	}
+
+	// The primary is probed until it answers
+	primaryUp.Store(true)
+	deadline := time.Now().Add(2 * time.Second)
+	for !rs.alive(&rs.Servers[0]) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !rs.alive(&rs.Servers[0]) {
+		t.Fatal("primary not revived by Status-Server")
+	}
+	if rs.Pick() != &rs.Servers[0] {
+		t.Error("primary not used again once revived")
+	}
+
+	// With all the servers dead, they are all tried
+	primaryUp.Store(false)
+	secondaryUp.Store(false)
+	rs.StatusInterval = 0
+	if _, err := exchange(); err == nil {
+		t.Fatal("expected an error with no server answering")
+	}
+	if rs.Pick() != &rs.Servers[0] {
+		t.Error("servers not all candidates once all dead")
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// radiusVendors maps the vendor names accepted in a vsa entry to their
+// IANA enterprise number
+var radiusVendors = map[string]uint32{
+	"cisco":     9,
+	"microsoft": 311,
+	"juniper":   2636,
+	"aruba":     14823,
+	"ruckus":    25053,
+}
+
+// vendorAttributeDef describes an attribute of a vendor dictionary
+type vendorAttributeDef struct {
+	Name   string
+	Vendor uint32
+	Type   byte
+	Data   radiusDataType
+}
+
+// vendorDictionary lists the vendor-specific attributes NAS vendors are
+// usually recognized by. Others are declared with their vendor and type.
+var vendorDictionary = []vendorAttributeDef{
+	{"Cisco-AVPair", 9, 1, radiusString},
+	{"Cisco-NAS-Port", 9, 2, radiusString},
+
+	{"Juniper-Local-User-Name", 2636, 1, radiusString},
+	{"Juniper-Allow-Commands", 2636, 2, radiusString},
+	{"Juniper-Deny-Commands", 2636, 3, radiusString},
+	{"Juniper-Allow-Configuration", 2636, 4, radiusString},
+	{"Juniper-Deny-Configuration", 2636, 5, radiusString},
+
+	{"Aruba-User-Role", 14823, 1, radiusString},
+	{"Aruba-User-Vlan", 14823, 2, radiusInteger},
+	{"Aruba-Essid-Name", 14823, 5, radiusString},
+	{"Aruba-Location-Id", 14823, 6, radiusString},
+	{"Aruba-Port-Identifier", 14823, 7, radiusString},
+	{"Aruba-AP-Group", 14823, 10, radiusString},
+	{"Aruba-Device-Type", 14823, 12, radiusString},
+
+	{"Ruckus-User-Groups", 25053, 1, radiusString},
+	{"Ruckus-Sta-RSSI", 25053, 2, radiusInteger},
+	{"Ruckus-SSID", 25053, 3, radiusString},
+	{"Ruckus-Wlan-Id", 25053, 4, radiusInteger},
+	{"Ruckus-Location", 25053, 5, radiusString},
+}
+
+// radiusEncodings maps the "encoding" of a vsa entry to its data type
+var radiusEncodings = map[string]radiusDataType{
+	"string":  radiusString,
+	"integer": radiusInteger,
+	"ipaddr":  radiusIPAddr,
+	"date":    radiusDate,
+	"octets":  radiusOctets,
+}
+
+// radiusVendor is a vendor ID, given in JSON as a number or a vendor name
+type radiusVendor uint32
+
+func (v *radiusVendor) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var id uint32
+		if err := json.Unmarshal(data, &id); err != nil {
+			return fmt.Errorf("vendor must be a number or a name")
+		}
+		*v = radiusVendor(id)
+		return nil
+	}
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		*v = radiusVendor(id)
+		return nil
+	}
+	id, ok := radiusVendors[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("unknown vendor %q", name)
+	}
+	*v = radiusVendor(id)
+	return nil
+}
+
+// VendorAttribute is an entry of the vsa list of a RADIUS section
+type VendorAttribute struct {
+	Vendor    radiusVendor `json:"vendor,omitempty"`    // Vendor ID or name, implied by a known attribute
+	Attribute string       `json:"attribute,omitempty"` // Name from the vendor dictionary
+	Type      byte         `json:"type,omitempty"`      // Vendor type, when no attribute name is given
+	Encoding  string       `json:"encoding,omitempty"`  // string, integer, ipaddr, date or octets
+	Value     string       `json:"value"`
+}
+
+// encode builds the Vendor-Specific attribute of the entry
+func (v VendorAttribute) encode() (RadiusAttribute, error) {
+	def := vendorAttributeDef{Vendor: uint32(v.Vendor), Type: v.Type, Data: radiusString}
+	if v.Attribute != "" {
+		known := false
+		for _, d := range vendorDictionary {
+			if strings.EqualFold(d.Name, v.Attribute) {
+				def, known = d, true
+				break
+			}
+		}
+		if !known {
+			return RadiusAttribute{}, fmt.Errorf("unknown vendor attribute %q", v.Attribute)
+		}
+		if v.Vendor != 0 && uint32(v.Vendor) != def.Vendor {
+			return RadiusAttribute{}, fmt.Errorf("%s: belongs to vendor %d, not %d", def.Name, def.Vendor, v.Vendor)
+		}
+	} else {
+		if def.Vendor == 0 || def.Type == 0 {
+			return RadiusAttribute{}, fmt.Errorf("vendor and type are required without an attribute name")
+		}
+		def.Name = fmt.Sprintf("Vendor-%d-Attr-%d", def.Vendor, def.Type)
+	}
+	if v.Encoding != "" {
+		data, ok := radiusEncodings[strings.ToLower(v.Encoding)]
+		if !ok {
+			return RadiusAttribute{}, fmt.Errorf("%s: unknown encoding %q", def.Name, v.Encoding)
+		}
+		def.Data = data
+	}
+
+	value, err := (&radiusAttributeDef{Name: def.Name, Data: def.Data}).encode(v.Value)
+	if err != nil {
+		return RadiusAttribute{}, fmt.Errorf("%s: %v", def.Name, err)
+	}
+	// Vendor type and length, then the value
+	if len(value) > 247 {
+		return RadiusAttribute{}, fmt.Errorf("%s: value is %d bytes, maximum is 247", def.Name, len(value))
+	}
+	sub := append(radius.Attribute{def.Type, byte(2 + len(value))}, value...)
+	vsa, err := radius.NewVendorSpecific(def.Vendor, sub)
+	if err != nil {
+		return RadiusAttribute{}, fmt.Errorf("%s: %v", def.Name, err)
+	}
+	return RadiusAttribute{Name: def.Name, Type: rfc2865.VendorSpecific_Type, Value: vsa}, nil
+}
+
+// readVendorAttributes decodes the JSON vsa list of a RADIUS section.
+// Invalid entries are skipped and reported in the returned error.
+func readVendorAttributes(body string) (RadiusAttributes, error) {
+	var entries []VendorAttribute
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		return nil, fmt.Errorf("invalid vsa JSON: %v", err)
+	}
+
+	var attrs RadiusAttributes
+	var errs []error
+	for _, entry := range entries {
+		attr, err := entry.encode()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, errors.Join(errs...)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"layeh.com/radius"
+	"layeh.com/radius/vendors/aruba"
+)
+
+// TestReadVendorAttributes tests VSA encoding from attribute names and
+// from raw vendor and type numbers
+func TestReadVendorAttributes(t *testing.T) {
+	attrs, err := readVendorAttributes(`[
+		{"attribute": "Cisco-AVPair", "value": "audit-session-id=0A0A0A0A0000001C"},
+		{"vendor": "cisco", "attribute": "cisco-avpair", "value": "service-type=Framed"},
+		{"attribute": "Aruba-Essid-Name", "value": "corp"},
+		{"vendor": "aruba", "type": 2, "encoding": "integer", "value": "20"},
+		{"vendor": 25053, "type": 3, "value": "guest"}
+	]`)
+	if err != nil || len(attrs) != 5 {
+		t.Fatalf("got %d attributes (%v)", len(attrs), err)
+	}
+
+	packet := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	attrs.Apply(packet)
+
+	var avpairs []string
+	for _, a := range packet.Attributes {
+		vendor, value, err := radius.VendorSpecific(a.Attribute)
+		if err == nil && vendor == 9 && value[0] == 1 {
+			avpairs = append(avpairs, string(value[2:]))
+		}
+	}
+	if strings.Join(avpairs, ";") != "audit-session-id=0A0A0A0A0000001C;service-type=Framed" {
+		t.Errorf("unexpected Cisco-AVPairs %q", avpairs)
+	}
+	if aruba.ArubaEssidName_GetString(packet) != "corp" || aruba.ArubaUserVlan_Get(packet) != 20 {
+		t.Errorf("unexpected Aruba-Essid-Name %q or Aruba-User-Vlan %d",
+			aruba.ArubaEssidName_GetString(packet), aruba.ArubaUserVlan_Get(packet))
+	}
+	if vendor, value, _ := radius.VendorSpecific(attrs[4].Value); vendor != 25053 || string(value) != "\x03\x07guest" {
+		t.Errorf("unexpected Ruckus-SSID %d %q", vendor, value)
+	}
+
+	_, err = readVendorAttributes(`[
+		{"attribute": "Foo-Bar", "value": "x"},
+		{"vendor": "aruba", "attribute": "Cisco-AVPair", "value": "x"},
+		{"vendor": 9, "value": "x"},
+		{"vendor": 9, "type": 1, "encoding": "ipaddr", "value": "x"}
+	]`)
+	if err == nil || len(strings.Split(err.Error(), "\n")) != 4 {
+		t.Errorf("expected four errors, got %v", err)
+	}
+	if _, err := readVendorAttributes(`[{"vendor": "acme", "type": 1, "value": "x"}]`); err == nil {
+		t.Error("expected an error for an unknown vendor")
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// RadSec (RFC 6614) port and shared secret
+const (
+	radsecPort   = "2083"
+	radsecSecret = "radsec"
+)
+
+// RadSec holds the TLS settings of RADIUS over TLS. The server certificate
+// must be issued by CACert, system roots are not trusted.
+type RadSec struct {
+	CACert     string // PEM file of the CA of the servers
+	ClientCert string // PEM client certificate
+	ClientKey  string // PEM private key of the client certificate
+	ServerName string // Name the server certificate must match, unchecked when empty
+}
+
+// tlsConfig builds the client TLS configuration
+func (r *RadSec) tlsConfig() (*tls.Config, error) {
+	roots, err := loadCertPool(r.CACert)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(r.ClientCert, r.ClientKey)
+	if err != nil {
+		return nil, fmt.Errorf("client certificate: %v", err)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if r.ServerName != "" {
+		cfg.RootCAs, cfg.ServerName = roots, r.ServerName
+	} else {
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyPeerCertificate = verifyCertChain(roots)
+	}
+	return cfg, nil
+}
+
+// loadCertPool reads the certificates of a PEM file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return roots, nil
+}
+
+// verifyCertChain checks that the peer certificate chains to roots,
+// whatever its name, for tls.Config.VerifyPeerCertificate
+func verifyCertChain(roots *x509.CertPool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		}
+		var leaf *x509.Certificate
+		for i, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				leaf = cert
+			} else {
+				opts.Intermediates.AddCert(cert)
+			}
+		}
+		if leaf == nil {
+			return fmt.Errorf("no peer certificate")
+		}
+		_, err := leaf.Verify(opts)
+		return err
+	}
+}
+
+// radsecConns holds the connections to the RadSec servers, shared by the
+// devices like the connection of a NAS is
+var radsecConns = &radsecRegistry{conns: make(map[radsecKey]*radsecConn)}
+
+type radsecRegistry struct {
+	mu    sync.Mutex
+	conns map[radsecKey]*radsecConn
+}
+
+// radsecKey identifies a connection by server and TLS settings, sections
+// using other certificates for the same server get their own connection
+type radsecKey struct {
+	addr string
+	RadSec
+}
+
+// get returns the connection to a server, created on first use
+func (r *radsecRegistry) get(addr string, cfg *RadSec) (*radsecConn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := radsecKey{addr: addr, RadSec: *cfg}
+	if c, ok := r.conns[key]; ok {
+		return c, nil
+	}
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	c := &radsecConn{addr: addr, tlsCfg: tlsCfg}
+	r.conns[key] = c
+	return c, nil
+}
+
+// radsecConn multiplexes the requests to a RadSec server over one TLS
+// connection, by RADIUS Identifier. The connection is dialed again after
+// an error.
+type radsecConn struct {
+	addr   string
+	tlsCfg *tls.Config
+
+	mu      sync.Mutex
+	conn    *tls.Conn
+	dialing chan struct{}        // Closed when the dial in progress ends
+	pending map[byte]chan []byte // Response of the outstanding requests
+	nextID  byte
+
+	writeMu sync.Mutex // Serializes the writes and their deadlines
+}
+
+// Exchange sends a request and waits for its response. Requests are not
+// retransmitted over TLS (RFC 6614 2.5): a request unanswered by its
+// deadline closes the connection, which may be half-open, and the next
+// request dials again. The Identifier of the request is replaced by a free
+// one of the connection, its Message-Authenticator is computed again.
+func (c *radsecConn) Exchange(ctx context.Context, p *radius.Packet) (*radius.Packet, error) {
+	response := make(chan []byte, 1)
+	conn, err := c.register(ctx, p, response)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unregister(conn, p.Identifier)
+
+	if _, ok := p.Lookup(rfc2869.MessageAuthenticator_Type); ok {
+		if err := setMessageAuthenticator(p); err != nil {
+			return nil, err
+		}
+	}
+	wire, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.write(ctx, conn, wire); err != nil {
+		c.fail(conn, err)
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.fail(conn, fmt.Errorf("no response within the timeout"))
+		}
+		return nil, ctx.Err()
+	case b, ok := <-response:
+		if !ok {
+			return nil, fmt.Errorf("RadSec connection to %s closed", c.addr)
+		}
+		if !radius.IsAuthenticResponse(b, wire, p.Secret) {
+			return nil, &radius.NonAuthenticResponseError{}
+		}
+		return radius.Parse(b, p.Secret)
+	}
+}
+
+// write sends a request, giving up at the deadline of ctx
+func (c *radsecConn) write(ctx context.Context, conn *tls.Conn, wire []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := conn.Write(wire)
+	return err
+}
+
+// connect returns the connection, dialed if needed. The requests arriving
+// during the dial wait for it rather than holding the lock.
+func (c *radsecConn) connect(ctx context.Context) (*tls.Conn, error) {
+	for {
+		c.mu.Lock()
+		conn, dialing := c.conn, c.dialing
+		if conn == nil && dialing == nil {
+			c.dialing = make(chan struct{})
+		}
+		c.mu.Unlock()
+
+		switch {
+		case conn != nil:
+			return conn, nil
+		case dialing != nil:
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-dialing:
+				continue
+			}
+		}
+		return c.dial(ctx)
+	}
+}
+
+// dial opens the connection and installs it, ending the dial in progress
+func (c *radsecConn) dial(ctx context.Context) (*tls.Conn, error) {
+	dialer := &tls.Dialer{Config: c.tlsCfg}
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	close(c.dialing)
+	c.dialing = nil
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn.(*tls.Conn)
+	c.pending = make(map[byte]chan []byte)
+	go c.read(c.conn, c.pending)
+	logger.Info("RadSec connection to %s established", c.addr)
+	return c.conn, nil
+}
+
+// register assigns a free Identifier of the connection to the request
+func (c *radsecConn) register(ctx context.Context, p *radius.Packet, response chan []byte) (*tls.Conn, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return nil, fmt.Errorf("RadSec connection to %s closed", c.addr)
+	}
+	if len(c.pending) == 256 {
+		return nil, errors.New("no free RADIUS identifier on the RadSec connection")
+	}
+	for {
+		c.nextID++
+		if _, busy := c.pending[c.nextID]; !busy {
+			break
+		}
+	}
+	p.Identifier = c.nextID
+	c.pending[p.Identifier] = response
+	return c.conn, nil
+}
+
+func (c *radsecConn) unregister(conn *tls.Conn, id byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == conn {
+		delete(c.pending, id)
+	}
+}
+
+// read delivers the responses received on a connection to their requests
+func (c *radsecConn) read(conn *tls.Conn, pending map[byte]chan []byte) {
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			c.fail(conn, err)
+			return
+		}
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		if length < 20 || length > radius.MaxPacketLength {
+			c.fail(conn, fmt.Errorf("invalid RADIUS length %d", length))
+			return
+		}
+		b := make([]byte, length)
+		copy(b, header)
+		if _, err := io.ReadFull(conn, b[4:]); err != nil {
+			c.fail(conn, err)
+			return
+		}
+
+		c.mu.Lock()
+		if response, ok := pending[b[1]]; ok {
+			delete(pending, b[1])
+			response <- b
+		}
+		c.mu.Unlock()
+	}
+}
+
+// fail closes a connection and fails its outstanding requests
+func (c *radsecConn) fail(conn *tls.Conn, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != conn {
+		return
+	}
+	if !errors.Is(err, net.ErrClosed) {
+		logger.Warn("RadSec connection to %s lost: %v", c.addr, err)
+	}
+	conn.Close()
+	for id, response := range c.pending {
+		close(response)
+		delete(c.pending, id)
+	}
+	c.conn = nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// testCA issues certificates for the RadSec tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a certificate for name signed by the CA
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes the certificate and key of cert in dir
+func writePEM(t *testing.T, dir string, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// testRadSecConfig writes the CA and a client certificate of ca and
+// returns the RadSec settings using them
+func testRadSecConfig(t *testing.T, ca *testCA) RadSec {
+	t.Helper()
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey := writePEM(t, dir, ca.issue(t, "nas", x509.ExtKeyUsageClientAuth))
+	return RadSec{CACert: caFile, ClientCert: clientCert, ClientKey: clientKey, ServerName: "radius.example.com"}
+}
+
+// testRadSecServer runs a RadSec server requiring a client certificate of
+// ca and accepting every request with its User-Name as Reply-Message,
+// answering in reverse order of arrival
+func testRadSecServer(t *testing.T, ca *testCA, cert tls.Certificate, batch int) string {
+	t.Helper()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var requests []*radius.Packet
+				for {
+					header := make([]byte, 4)
+					if _, err := io.ReadFull(conn, header); err != nil {
+						return
+					}
+					b := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+					copy(b, header)
+					if _, err := io.ReadFull(conn, b[4:]); err != nil {
+						return
+					}
+					request, err := radius.Parse(b, []byte(radsecSecret))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if requests = append(requests, request); len(requests) < batch {
+						continue
+					}
+					for i := len(requests) - 1; i >= 0; i-- {
+						response := requests[i].Response(radius.CodeAccessAccept)
+						rfc2865.ReplyMessage_SetString(response, rfc2865.UserName_GetString(requests[i]))
+						setMessageAuthenticator(response)
+						wire, _ := response.Encode()
+						conn.Write(wire)
+					}
+					requests = nil
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// TestRadSec tests concurrent requests over one RadSec connection and the
+// rejection of a server certificate of another CA
+func TestRadSec(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, clientKey := writePEM(t, dir, ca.issue(t, "nas", x509.ExtKeyUsageClientAuth))
+
+	const requests = 5
+	addr := testRadSecServer(t, ca, ca.issue(t, "radius.example.com", x509.ExtKeyUsageServerAuth), requests)
+	rs := RadiusServers{
+		Servers: []RadiusServer{{Address: addr, Secret: radsecSecret, Timeout: 2 * time.Second}},
+		RadSec:  &RadSec{CACert: caFile, ClientCert: clientCert, ClientKey: clientKey, ServerName: "radius.example.com"},
+		health:  newRadiusHealth(),
+	}
+
+	// The requests all have the same Identifier and are answered out of order
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			request, response, err := rs.Exchange(context.Background(), func(secret []byte) (*radius.Packet, error) {
+				p := radius.New(radius.CodeAccessRequest, secret)
+				p.Identifier = 1
+				rfc2865.UserName_SetString(p, name)
+				return p, setMessageAuthenticator(p)
+			})
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			if !verifyMessageAuthenticator(response, request.Authenticator, true) {
+				t.Errorf("%s: invalid Message-Authenticator in the response", name)
+			}
+			if reply := rfc2865.ReplyMessage_GetString(response); reply != name {
+				t.Errorf("%s: got the response to %s", name, reply)
+			}
+		}(string(rune('a' + i)))
+	}
+	wg.Wait()
+
+	// A server certificate of another CA is refused
+	other := testRadSecServer(t, ca, newTestCA(t).issue(t, "radius.example.com", x509.ExtKeyUsageServerAuth), 1)
+	rs.Servers[0].Address = other
+	rs.RadSec = &RadSec{CACert: caFile, ClientCert: clientCert, ClientKey: clientKey}
+	if _, _, err := rs.Exchange(context.Background(), func(secret []byte) (*radius.Packet, error) {
+		return radius.New(radius.CodeAccessRequest, secret), nil
+	}); err == nil {
+		t.Error("server certificate of another CA accepted")
+	}
+}
+
+// TestRadSecRegistry tests that sections with other TLS settings for the
+// same server do not share a connection
+func TestRadSecRegistry(t *testing.T) {
+	r := &radsecRegistry{conns: make(map[radsecKey]*radsecConn)}
+	get := func(addr string, cfg RadSec) *radsecConn {
+		c, err := r.get(addr, &cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	auth := testRadSecConfig(t, newTestCA(t))
+	acct := auth
+	acct.ServerName = "accounting.example.com"
+
+	c := get("10.10.1.1:2083", auth)
+	if get("10.10.1.1:2083", auth) != c {
+		t.Error("connection not shared for the same settings")
+	}
+	if other := get("10.10.1.1:2083", acct); other == c || other.tlsCfg.ServerName != "accounting.example.com" {
+		t.Error("connection shared with other TLS settings")
+	}
+	if get("10.10.1.2:2083", auth) == c {
+		t.Error("connection shared with another server")
+	}
+}
+
+// TestRadSecTimeout tests that an unanswered request closes the
+// connection and that the next requests go over a new one
+func TestRadSecTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := testRadSecConfig(t, ca)
+	// Requests are answered by pairs
+	addr := testRadSecServer(t, ca, ca.issue(t, "radius.example.com", x509.ExtKeyUsageServerAuth), 2)
+	c, err := (&radsecRegistry{conns: make(map[radsecKey]*radsecConn)}).get(addr, &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exchange := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		_, err := c.Exchange(ctx, radius.New(radius.CodeAccessRequest, []byte(radsecSecret)))
+		return err
+	}
+
+	if err := exchange(200 * time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unanswered request: %v", err)
+	}
+	c.mu.Lock()
+	closed := c.conn == nil
+	c.mu.Unlock()
+	if !closed {
+		t.Error("connection kept after an unanswered request")
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- exchange(2 * time.Second) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("request over a new connection: %v", err)
+		}
+	}
+}
+
+// TestRadSecSlowHandshake tests that a server stalling the handshake
+// holds neither the connection lock nor the requests past their deadline
+func TestRadSecSlowHandshake(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			// Never answers the ClientHello
+			defer conn.Close()
+		}
+	}()
+
+	cfg := testRadSecConfig(t, newTestCA(t))
+	c, err := (&radsecRegistry{conns: make(map[radsecKey]*radsecConn)}).get(listener.Addr().String(), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+			defer cancel()
+			_, err := c.Exchange(ctx, radius.New(radius.CodeAccessRequest, []byte(radsecSecret)))
+			errs <- err
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	locked := make(chan struct{})
+	go func() {
+		c.mu.Lock()
+		c.mu.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(100 * time.Millisecond):
+		t.Error("connection locked during the handshake")
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if err == nil {
+				t.Error("request answered without a handshake")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("request blocked past its deadline")
+		}
+	}
+}
+
+func TestReadRadSec(t *testing.T) {
+	rs, err := testRadiusServers(t, `[authentication]
+server = 10.10.1.1
+transport = radsec
+radsec_ca_cert = /etc/radsec/ca.pem
+radsec_client_cert = /etc/radsec/client.pem
+radsec_client_key = /etc/radsec/client.key
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.RadSec == nil || len(rs.Servers) != 1 || rs.Servers[0].Address != "10.10.1.1:2083" || rs.Servers[0].Secret != radsecSecret {
+		t.Errorf("unexpected RadSec servers %+v", rs.Servers)
+	}
+
+	if _, err := testRadiusServers(t, "[authentication]\nserver = 10.10.1.1\ntransport = radsec\n"); err == nil {
+		t.Error("RadSec accepted without certificates")
+	}
+	if _, err := testRadiusServers(t, "[authentication]\nserver = 10.10.1.1\ntransport = sctp\n"); err == nil {
+		t.Error("unknown transport accepted")
+	}
+}
@@ -2,27 +2,48 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"syscall"
 
+	"github.com/krolaw/dhcp4"
 	"github.com/mdlayher/ethernet"
 	"github.com/mdlayher/raw"
 )
 
 const UDP_HEADER_LEN = 8
 
+const ipv6HeaderLen = 40
+
+// etherTypeAll is ETH_P_ALL, used to receive every frame on the interface
+const etherTypeAll = 0x0003
+
 // A RawClient is a Wake-on-LAN client which operates directly on top of
 // Ethernet frames using raw sockets.  It can be used to send WoL magic packets
 // to other machines on a local network, using their hardware addresses.
 type RawClient struct {
 	ifi *net.Interface
 	p   net.PacketConn
+
+	mu     sync.RWMutex
+	dhcp   map[string]func(dhcp4.Packet)   // DHCP reply handlers by client MAC
+	dhcpv6 map[string]func(*dhcpv6Message) // DHCPv6 reply handlers by client DUID
+	icmpv6 map[string]icmpv6Handler        // ICMPv6 handlers by client MAC
+	arp    map[string]func(*arpPacket)     // ARP handlers by client MAC
+	vlans  map[string]VLAN                 // 802.1Q tagging by client MAC
 }
 
+// icmpv6Handler receives an ICMPv6 message with the source MAC and the
+// IPv6 addresses of the frame that carried it
+type icmpv6Handler func(srcMac net.HardwareAddr, srcIP, dstIP net.IP, msg []byte)
+
 type udphdr struct {
 	src  uint16
 	dst  uint16
@@ -59,20 +80,337 @@ type iphdr struct {
 // For this reason, it is typically recommended to use the regular Client type
 // instead, which operates over UDP.
 func NewRawClient(ifi *net.Interface) (*RawClient, error) {
-	// Open raw socket to send Wake-on-LAN magic packets
+	// Open raw socket to send and receive frames of every EtherType
 	var cfg raw.Config
 
-	p, err := raw.ListenPacket(ifi, 0x0806, &cfg)
+	p, err := raw.ListenPacket(ifi, etherTypeAll, &cfg)
 	if err != nil {
 		return nil, err
 	}
 
+	// Replies are addressed to the simulated MAC, not the interface MAC
+	if err := p.SetPromiscuous(true); err != nil {
+		logger.Warn("Failed to enable promiscuous mode on %s: %v", ifi.Name, err)
+	}
+
 	return &RawClient{
-		ifi: ifi,
-		p:   p,
+		ifi:    ifi,
+		p:      p,
+		dhcp:   make(map[string]func(dhcp4.Packet)),
+		dhcpv6: make(map[string]func(*dhcpv6Message)),
+		icmpv6: make(map[string]icmpv6Handler),
+		arp:    make(map[string]func(*arpPacket)),
+		vlans:  make(map[string]VLAN),
 	}, nil
 }
 
+// HandleDHCP registers fn to receive the DHCP replies sent to mac
+func (c *RawClient) HandleDHCP(mac net.HardwareAddr, fn func(dhcp4.Packet)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dhcp[mac.String()] = fn
+}
+
+// RemoveDHCP unregisters the DHCP reply handler for mac
+func (c *RawClient) RemoveDHCP(mac net.HardwareAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dhcp, mac.String())
+}
+
+// HandleDHCPv6 registers fn to receive the DHCPv6 replies for duid
+func (c *RawClient) HandleDHCPv6(duid []byte, fn func(*dhcpv6Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.dhcpv6[string(duid)] = fn
+}
+
+// RemoveDHCPv6 unregisters the DHCPv6 reply handler for duid
+func (c *RawClient) RemoveDHCPv6(duid []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.dhcpv6, string(duid))
+}
+
+// HandleICMPv6 registers fn to receive the ICMPv6 messages sent to mac
+// and to multicast groups
+func (c *RawClient) HandleICMPv6(mac net.HardwareAddr, fn icmpv6Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.icmpv6[mac.String()] = fn
+}
+
+// RemoveICMPv6 unregisters the ICMPv6 handler for mac
+func (c *RawClient) RemoveICMPv6(mac net.HardwareAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.icmpv6, mac.String())
+}
+
+// HandleARP registers fn to receive the ARP packets sent to mac and to
+// the broadcast address
+func (c *RawClient) HandleARP(mac net.HardwareAddr, fn func(*arpPacket)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.arp[mac.String()] = fn
+}
+
+// RemoveARP unregisters the ARP handler for mac
+func (c *RawClient) RemoveARP(mac net.HardwareAddr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.arp, mac.String())
+}
+
+// SetVLAN sets the 802.1Q tagging of the frames sent for device. A zero
+// VLAN sends them untagged.
+func (c *RawClient) SetVLAN(device net.HardwareAddr, vlan VLAN) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if vlan == (VLAN{}) {
+		delete(c.vlans, device.String())
+		return
+	}
+	c.vlans[device.String()] = vlan
+}
+
+// Listen reads frames from the raw socket and dispatches them until the
+// context is cancelled
+func (c *RawClient) Listen(ctx context.Context) {
+	buf := make([]byte, 65536)
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+		c.p.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := c.p.ReadFrom(buf)
+		if err != nil {
+			var nerr net.Error
+			if errors.As(err, &nerr) && nerr.Timeout() {
+				continue
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Error("Raw socket read on %s failed: %v", c.ifi.Name, err)
+			metrics.IncrementErrors()
+			time.Sleep(time.Second)
+			continue
+		}
+		c.handleFrame(buf[:n])
+	}
+}
+
+// handleFrame decodes a received frame, tagged or not, and dispatches it
+// by EtherType
+func (c *RawClient) handleFrame(b []byte) {
+	var f ethernet.Frame
+	if err := f.UnmarshalBinary(b); err != nil {
+		return
+	}
+	switch f.EtherType {
+	case ethernet.EtherTypeIPv4:
+		c.handleIPv4(&f)
+	case ethernet.EtherTypeIPv6:
+		c.handleIPv6(&f)
+	case ethernet.EtherTypeARP:
+		c.handleARP(&f)
+	}
+}
+
+// handleIPv4 passes DHCP replies on to the handler registered for their
+// client hardware address
+func (c *RawClient) handleIPv4(f *ethernet.Frame) {
+	_, _, _, dstPort, payload, ok := parseUDP(f.Payload)
+	if !ok || (dstPort != dhcpClientPort && dstPort != dhcpServerPort) {
+		return
+	}
+
+	packet := dhcp4.Packet(payload)
+	if len(packet) < 240 || packet.OpCode() != dhcp4.BootReply {
+		return
+	}
+	chaddr := packet.CHAddr()
+	if !isBroadcastMAC(f.Destination) && !bytes.Equal(f.Destination, chaddr) &&
+		!bytes.Equal(f.Destination, c.ifi.HardwareAddr) {
+		return
+	}
+
+	c.mu.RLock()
+	fn := c.dhcp[chaddr.String()]
+	c.mu.RUnlock()
+	if fn == nil {
+		return
+	}
+	// The read buffer is reused, hand over a private copy
+	fn(append(dhcp4.Packet(nil), packet...))
+}
+
+// handleARP hands a broadcast ARP packet to every registered handler and a
+// unicast one to the handler of its destination MAC
+func (c *RawClient) handleARP(f *ethernet.Frame) {
+	p, ok := parseARP(f.Payload)
+	if !ok {
+		return
+	}
+
+	c.mu.RLock()
+	var handlers []func(*arpPacket)
+	if f.Destination[0]&0x01 != 0 {
+		for _, fn := range c.arp {
+			handlers = append(handlers, fn)
+		}
+	} else if fn := c.arp[f.Destination.String()]; fn != nil {
+		handlers = append(handlers, fn)
+	}
+	c.mu.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+
+	// The read buffer is reused, decode from a private copy
+	p, _ = parseARP(append([]byte(nil), f.Payload[:arpPacketLen]...))
+	for _, fn := range handlers {
+		fn(p)
+	}
+}
+
+// handleIPv6 passes DHCPv6 replies on to the handler registered for the
+// client DUID they carry and ICMPv6 messages on to the handlers of the
+// destination MAC
+func (c *RawClient) handleIPv6(f *ethernet.Frame) {
+	if srcIP, dstIP, msg, ok := parseICMPv6(f.Payload); ok {
+		c.handleICMPv6(f, srcIP, dstIP, msg)
+		return
+	}
+
+	_, _, _, dstPort, payload, ok := parseUDP6(f.Payload)
+	if !ok || (dstPort != dhcpv6ClientPort && dstPort != dhcpv6ServerPort) {
+		return
+	}
+
+	inner, err := unwrapRelayReply(payload)
+	if err != nil || len(inner) == 0 || !isDHCPv6Reply(inner[0]) {
+		return
+	}
+	// The read buffer is reused, decode from a private copy
+	msg, err := parseDHCPv6Message(append([]byte(nil), inner...))
+	if err != nil {
+		logger.Debug("Invalid DHCPv6 message: %v", err)
+		return
+	}
+
+	c.mu.RLock()
+	fn := c.dhcpv6[string(msg.Option(dhcpv6OptClientID))]
+	c.mu.RUnlock()
+	if fn != nil {
+		fn(msg)
+	}
+}
+
+// handleICMPv6 hands a multicast message to every registered handler and
+// a unicast one to the handler of its destination MAC
+func (c *RawClient) handleICMPv6(f *ethernet.Frame, srcIP, dstIP net.IP, msg []byte) {
+	c.mu.RLock()
+	var handlers []icmpv6Handler
+	if f.Destination[0]&0x01 != 0 {
+		for _, fn := range c.icmpv6 {
+			handlers = append(handlers, fn)
+		}
+	} else if fn := c.icmpv6[f.Destination.String()]; fn != nil {
+		handlers = append(handlers, fn)
+	}
+	c.mu.RUnlock()
+	if len(handlers) == 0 {
+		return
+	}
+
+	// The read buffer is reused, hand over private copies
+	srcMac := append(net.HardwareAddr(nil), f.Source...)
+	srcIP = append(net.IP(nil), srcIP...)
+	dstIP = append(net.IP(nil), dstIP...)
+	msg = append([]byte(nil), msg...)
+	for _, fn := range handlers {
+		fn(srcMac, srcIP, dstIP, msg)
+	}
+}
+
+// parseICMPv6 extracts the addresses and message of an IPv6/ICMPv6 packet
+// without extension headers, verifying its checksum
+func parseICMPv6(b []byte) (srcIP, dstIP net.IP, msg []byte, ok bool) {
+	if len(b) < ipv6HeaderLen+4 || b[0]>>4 != 6 || b[6] != syscall.IPPROTO_ICMPV6 {
+		return
+	}
+	plen := int(binary.BigEndian.Uint16(b[4:6]))
+	if plen < 4 || ipv6HeaderLen+plen > len(b) {
+		return
+	}
+	srcIP = net.IP(b[8:24])
+	dstIP = net.IP(b[24:40])
+	msg = b[ipv6HeaderLen : ipv6HeaderLen+plen]
+	// A valid checksum folds to zero, which checksum reports as 0xffff
+	if checksum6(srcIP, dstIP, syscall.IPPROTO_ICMPV6, msg) != 0xffff {
+		return
+	}
+	return srcIP, dstIP, msg, true
+}
+
+// parseUDP6 extracts the addresses, ports and payload of an IPv6/UDP
+// datagram without extension headers
+func parseUDP6(b []byte) (srcIP, dstIP net.IP, srcPort, dstPort uint16, payload []byte, ok bool) {
+	if len(b) < ipv6HeaderLen+UDP_HEADER_LEN || b[0]>>4 != 6 {
+		return
+	}
+	plen := int(binary.BigEndian.Uint16(b[4:6]))
+	if b[6] != syscall.IPPROTO_UDP || ipv6HeaderLen+plen > len(b) {
+		return
+	}
+
+	udp := b[ipv6HeaderLen : ipv6HeaderLen+plen]
+	ulen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if ulen < UDP_HEADER_LEN || ulen > len(udp) {
+		return
+	}
+
+	srcIP = net.IP(b[8:24])
+	dstIP = net.IP(b[24:40])
+	srcPort = binary.BigEndian.Uint16(udp[0:2])
+	dstPort = binary.BigEndian.Uint16(udp[2:4])
+	return srcIP, dstIP, srcPort, dstPort, udp[UDP_HEADER_LEN:ulen], true
+}
+
+// parseUDP extracts the addresses, ports and payload of an unfragmented
+// IPv4/UDP datagram
+func parseUDP(b []byte) (srcIP, dstIP net.IP, srcPort, dstPort uint16, payload []byte, ok bool) {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return
+	}
+	ihl := int(b[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(b[2:4]))
+	if ihl < 20 || total < ihl+UDP_HEADER_LEN || total > len(b) {
+		return
+	}
+	if b[9] != syscall.IPPROTO_UDP {
+		return
+	}
+	// Skip fragments (MF set or non-zero offset)
+	if binary.BigEndian.Uint16(b[6:8])&0x3fff != 0 {
+		return
+	}
+
+	udp := b[ihl:total]
+	ulen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if ulen < UDP_HEADER_LEN || ulen > len(udp) {
+		return
+	}
+
+	srcIP = net.IP(b[12:16])
+	dstIP = net.IP(b[16:20])
+	srcPort = binary.BigEndian.Uint16(udp[0:2])
+	dstPort = binary.BigEndian.Uint16(udp[2:4])
+	return srcIP, dstIP, srcPort, dstPort, udp[UDP_HEADER_LEN:ulen], true
+}
+
 // Close closes a RawClient's raw socket.
 func (c *RawClient) Close() error {
 	return c.p.Close()
@@ -208,15 +546,12 @@ func sendUnicastDHCP(dhcp []byte, dstIP net.IP, srcIP net.IP, giAddr net.IP, udp
 }
 
 // sendDHCP create a udp packet and stores it in an
-// Ethernet frame, and sends the frame over a raw socket to attempt to wake
-// a machine.
-func (c *RawClient) sendDHCP(dstMac net.HardwareAddr, srcMac net.HardwareAddr, dhcp []byte, dstIP net.IP, srcIP net.IP) error {
+// Ethernet frame, and sends the frame over a raw socket from udpsrc to
+// udpdst on the VLAN of device.
+func (c *RawClient) sendDHCP(device net.HardwareAddr, dstMac net.HardwareAddr, srcMac net.HardwareAddr, dhcp []byte, dstIP net.IP, srcIP net.IP, udpsrc int, udpdst int) error {
 
 	proto := 17
 
-	udpsrc := uint(67)
-	udpdst := uint(68)
-
 	udp := udphdr{
 		src: uint16(udpsrc),
 		dst: uint16(udpdst),
@@ -261,6 +596,82 @@ func (c *RawClient) sendDHCP(dstMac net.HardwareAddr, srcMac net.HardwareAddr, d
 	ipHeader := buff.Bytes()
 	packet := append(ipHeader, dataWithHeader...)
 
+	return c.writeFrame(device, dstMac, srcMac, ethernet.EtherTypeIPv4, packet)
+}
+
+// sendUDP6 creates an IPv6/UDP packet and sends it in an Ethernet frame
+// over the raw socket on the VLAN of device
+func (c *RawClient) sendUDP6(device net.HardwareAddr, dstMac net.HardwareAddr, srcMac net.HardwareAddr, payload []byte, dstIP net.IP, srcIP net.IP, udpsrc int, udpdst int) error {
+	udplen := UDP_HEADER_LEN + len(payload)
+
+	hopLimit := byte(64)
+	if dstIP.IsMulticast() {
+		hopLimit = 1
+	}
+
+	packet := make([]byte, ipv6HeaderLen+udplen)
+	packet[0] = 0x60 // Version 6, traffic class and flow label 0
+	binary.BigEndian.PutUint16(packet[4:6], uint16(udplen))
+	packet[6] = syscall.IPPROTO_UDP
+	packet[7] = hopLimit
+	copy(packet[8:24], srcIP.To16())
+	copy(packet[24:40], dstIP.To16())
+
+	udp := packet[ipv6HeaderLen:]
+	binary.BigEndian.PutUint16(udp[0:2], uint16(udpsrc))
+	binary.BigEndian.PutUint16(udp[2:4], uint16(udpdst))
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udplen))
+	copy(udp[UDP_HEADER_LEN:], payload)
+	binary.BigEndian.PutUint16(udp[6:8], checksum6(srcIP, dstIP, syscall.IPPROTO_UDP, udp))
+
+	return c.writeFrame(device, dstMac, srcMac, ethernet.EtherTypeIPv6, packet)
+}
+
+// sendICMPv6 creates an IPv6/ICMPv6 packet and sends it in an Ethernet
+// frame over the raw socket on the VLAN of device. MLD messages need a
+// Hop-by-Hop header with the Router Alert option (RFC 2711).
+func (c *RawClient) sendICMPv6(device net.HardwareAddr, dstMac net.HardwareAddr, srcMac net.HardwareAddr, msg []byte, dstIP net.IP, srcIP net.IP, hopLimit byte, routerAlert bool) error {
+	var ext []byte
+	nextHeader := byte(syscall.IPPROTO_ICMPV6)
+	if routerAlert {
+		// Next header, length 0, Router Alert (MLD), PadN
+		ext = []byte{syscall.IPPROTO_ICMPV6, 0, 5, 2, 0, 0, 1, 0}
+		nextHeader = 0 // Hop-by-Hop Options
+	}
+
+	packet := make([]byte, ipv6HeaderLen+len(ext)+len(msg))
+	packet[0] = 0x60 // Version 6, traffic class and flow label 0
+	binary.BigEndian.PutUint16(packet[4:6], uint16(len(ext)+len(msg)))
+	packet[6] = nextHeader
+	packet[7] = hopLimit
+	copy(packet[8:24], srcIP.To16())
+	copy(packet[24:40], dstIP.To16())
+	copy(packet[ipv6HeaderLen:], ext)
+
+	icmp := packet[ipv6HeaderLen+len(ext):]
+	copy(icmp, msg)
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint16(icmp[2:4], checksum6(srcIP, dstIP, syscall.IPPROTO_ICMPV6, icmp))
+
+	return c.writeFrame(device, dstMac, srcMac, ethernet.EtherTypeIPv6, packet)
+}
+
+// checksum6 computes an upper-layer checksum over the IPv6 pseudo-header
+// and data
+func checksum6(srcIP, dstIP net.IP, proto byte, data []byte) uint16 {
+	b := make([]byte, 0, 40+len(data))
+	b = append(b, srcIP.To16()...)
+	b = append(b, dstIP.To16()...)
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, 0, 0, 0, proto)
+	b = append(b, data...)
+	return checksum(b)
+}
+
+// writeFrame wraps payload in an Ethernet frame, tagged with the VLAN of
+// device, and sends it over the raw socket. The interface MAC is used when
+// srcMac is nil.
+func (c *RawClient) writeFrame(device net.HardwareAddr, dstMac net.HardwareAddr, srcMac net.HardwareAddr, etherType ethernet.EtherType, payload []byte) error {
 	if srcMac == nil {
 		srcMac = c.ifi.HardwareAddr
 	}
@@ -268,8 +679,15 @@ func (c *RawClient) sendDHCP(dstMac net.HardwareAddr, srcMac net.HardwareAddr, d
 	f := &ethernet.Frame{
 		Destination: dstMac,
 		Source:      srcMac,
-		EtherType:   ethernet.EtherTypeIPv4,
-		Payload:     packet,
+		EtherType:   etherType,
+		Payload:     payload,
+	}
+
+	c.mu.RLock()
+	vlan, tagged := c.vlans[device.String()]
+	c.mu.RUnlock()
+	if tagged {
+		f.VLAN, f.ServiceVLAN = vlan.tags()
 	}
 	fb, err := f.MarshalBinary()
 	if err != nil {
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/krolaw/dhcp4"
+)
+
+// TestHandleDHCPFrame tests that DHCP replies, tagged or not, reach the
+// handler of their client hardware address only
+func TestHandleDHCPFrame(t *testing.T) {
+	a, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	b, _ := net.ParseMAC("90:6c:ac:64:95:c2")
+	unknown, _ := net.ParseMAC("90:6c:ac:64:95:c3")
+	server, _ := net.ParseMAC("00:11:22:33:44:55")
+
+	c := newTestRawClient(nil)
+	var received []string
+	for _, mac := range []net.HardwareAddr{a, b} {
+		mac := mac
+		c.HandleDHCP(mac, func(p dhcp4.Packet) {
+			if p.CHAddr().String() != mac.String() {
+				t.Errorf("handler of %s received a reply for %s", mac, p.CHAddr())
+			}
+			received = append(received, mac.String())
+		})
+	}
+
+	reply := func(mac net.HardwareAddr, op dhcp4.OpCode) dhcp4.Packet {
+		req := RequestPacket(dhcp4.Discover, mac, net.IPv4zero, nil, []byte{1, 2, 3, 4}, true, nil)
+		p := dhcp4.ReplyPacket(req, dhcp4.Offer, testDHCPServer, testDHCPOffer, 0, nil)
+		p.SetOpCode(op)
+		return p
+	}
+
+	for _, tc := range []struct {
+		name    string
+		chaddr  net.HardwareAddr
+		op      dhcp4.OpCode
+		dstMac  net.HardwareAddr
+		dstPort int
+		vlan    VLAN
+		want    net.HardwareAddr // Handler expected to receive the reply
+	}{
+		{"unicast", a, dhcp4.BootReply, a, dhcpClientPort, VLAN{}, a},
+		{"broadcast", b, dhcp4.BootReply, ethernetBroadcast, dhcpClientPort, VLAN{}, b},
+		{"tagged", b, dhcp4.BootReply, b, dhcpClientPort, VLAN{ID: 100}, b},
+		{"QinQ", a, dhcp4.BootReply, ethernetBroadcast, dhcpClientPort, VLAN{ID: 100, ServiceID: 200}, a},
+		{"relayed", a, dhcp4.BootReply, c.ifi.HardwareAddr, dhcpServerPort, VLAN{ID: 100}, a},
+		{"other port", a, dhcp4.BootReply, a, 5000, VLAN{}, nil},
+		{"request", a, dhcp4.BootRequest, ethernetBroadcast, dhcpServerPort, VLAN{}, nil},
+		{"unknown client", unknown, dhcp4.BootReply, ethernetBroadcast, dhcpClientPort, VLAN{}, nil},
+		{"other destination", a, dhcp4.BootReply, unknown, dhcpClientPort, VLAN{ID: 100}, nil},
+	} {
+		// The server frames are built by a raw client tagging them
+		conn := &capturePacketConn{}
+		sender := newTestRawClient(conn)
+		sender.SetVLAN(server, tc.vlan)
+		if err := sender.sendDHCP(server, tc.dstMac, server, reply(tc.chaddr, tc.op), net.IPv4bcast, testDHCPServer, dhcpServerPort, tc.dstPort); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+
+		received = nil
+		c.handleFrame(conn.frames[0])
+		switch {
+		case tc.want == nil && len(received) != 0:
+			t.Errorf("%s: reply dispatched to %v", tc.name, received)
+		case tc.want != nil && (len(received) != 1 || received[0] != tc.want.String()):
+			t.Errorf("%s: reply dispatched to %v, expected %s", tc.name, received, tc.want)
+		}
+	}
+}
+
+// TestParseUDP tests the decoding of IPv4/UDP datagrams
+func TestParseUDP(t *testing.T) {
+	conn := &capturePacketConn{}
+	c := newTestRawClient(conn)
+	payload := []byte("payload")
+	if err := c.sendDHCP(c.ifi.HardwareAddr, ethernetBroadcast, nil, payload, testDHCPServer, testDHCPOffer, dhcpClientPort, dhcpServerPort); err != nil {
+		t.Fatal(err)
+	}
+	ip := conn.frames[0][14:]
+
+	srcIP, dstIP, srcPort, dstPort, got, ok := parseUDP(ip)
+	if !ok || !srcIP.Equal(testDHCPOffer) || !dstIP.Equal(testDHCPServer) ||
+		srcPort != dhcpClientPort || dstPort != dhcpServerPort || string(got) != "payload" {
+		t.Errorf("got %s:%d -> %s:%d %q (%v)", srcIP, srcPort, dstIP, dstPort, got, ok)
+	}
+
+	for name, mutate := range map[string]func(b []byte){
+		"TCP":       func(b []byte) { b[9] = 6 },
+		"fragment":  func(b []byte) { b[6] = 0x20 },
+		"truncated": func(b []byte) { b[2] = 0x01 },
+		"IPv6":      func(b []byte) { b[0] = 0x65 },
+	} {
+		b := append([]byte(nil), ip...)
+		mutate(b)
+		if _, _, _, _, _, ok := parseUDP(b); ok {
+			t.Errorf("%s packet accepted", name)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// VLAN holds the 802.1Q tagging of the frames sent for a simulated device
+type VLAN struct {
+	ID              uint16 // Customer VLAN ID (C-tag), 0 for priority tagging only
+	Priority        uint8  // 802.1p priority of the C-tag
+	ServiceID       uint16 // Outer service VLAN ID (S-tag, QinQ), 0 for none
+	ServicePriority uint8  // 802.1p priority of the S-tag
+}
+
+// String describes the tags, e.g. "100/p3" or "200/p0:100/p3" for QinQ
+func (v VLAN) String() string {
+	if v == (VLAN{}) {
+		return "untagged"
+	}
+	tag := fmt.Sprintf("%d/p%d", v.ID, v.Priority)
+	if v.ServiceID != 0 {
+		tag = fmt.Sprintf("%d/p%d:%s", v.ServiceID, v.ServicePriority, tag)
+	}
+	return tag
+}
+
+// tags returns the C-tag and S-tag to set on a frame
+func (v VLAN) tags() (vlan *ethernet.VLAN, service *ethernet.VLAN) {
+	vlan = &ethernet.VLAN{ID: v.ID, Priority: ethernet.Priority(v.Priority)}
+	if v.ServiceID != 0 {
+		service = &ethernet.VLAN{ID: v.ServiceID, Priority: ethernet.Priority(v.ServicePriority)}
+	}
+	return vlan, service
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+)
+
+// capturePacketConn records the frames written to it
+type capturePacketConn struct {
+	frames [][]byte
+}
+
+func (c *capturePacketConn) ReadFrom(b []byte) (int, net.Addr, error) { return 0, nil, net.ErrClosed }
+func (c *capturePacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.frames = append(c.frames, append([]byte(nil), b...))
+	return len(b), nil
+}
+func (c *capturePacketConn) Close() error                       { return nil }
+func (c *capturePacketConn) LocalAddr() net.Addr                { return nil }
+func (c *capturePacketConn) SetDeadline(t time.Time) error      { return nil }
+func (c *capturePacketConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *capturePacketConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// TestWriteFrameVLAN tests that frames are tagged with the VLAN of their
+// device only
+func TestWriteFrameVLAN(t *testing.T) {
+	conn := &capturePacketConn{}
+	ifi := &net.Interface{Name: "test0", HardwareAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1}}
+	c := &RawClient{ifi: ifi, p: conn, vlans: make(map[string]VLAN)}
+
+	tagged, _ := net.ParseMAC("90:6c:ac:64:95:c1")
+	untagged, _ := net.ParseMAC("90:6c:ac:64:95:c2")
+	c.SetVLAN(tagged, VLAN{ID: 100, Priority: 3, ServiceID: 200})
+	c.SetVLAN(untagged, VLAN{})
+
+	for _, device := range []net.HardwareAddr{tagged, untagged} {
+		if err := c.writeFrame(device, ethernetBroadcast, device, ethernet.EtherTypeARP, make([]byte, arpPacketLen)); err != nil {
+			t.Fatalf("writeFrame failed: %v", err)
+		}
+	}
+
+	var f ethernet.Frame
+	if err := f.UnmarshalBinary(conn.frames[0]); err != nil {
+		t.Fatalf("invalid tagged frame: %v", err)
+	}
+	if f.VLAN == nil || f.VLAN.ID != 100 || f.VLAN.Priority != 3 ||
+		f.ServiceVLAN == nil || f.ServiceVLAN.ID != 200 || f.EtherType != ethernet.EtherTypeARP {
+		t.Errorf("unexpected tags %+v %+v", f.VLAN, f.ServiceVLAN)
+	}
+
+	var u ethernet.Frame
+	if err := u.UnmarshalBinary(conn.frames[1]); err != nil {
+		t.Fatalf("invalid untagged frame: %v", err)
+	}
+	if u.VLAN != nil || u.ServiceVLAN != nil {
+		t.Errorf("expected an untagged frame, got %+v %+v", u.VLAN, u.ServiceVLAN)
+	}
+}
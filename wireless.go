@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+)
+
+// How a wireless controller reports a client roaming to another AP
+const (
+	roamStopStart = "stop_start" // Accounting-Stop, authentication and a new session on the new AP
+	roamInterim   = "interim"    // Fast roaming: an Interim-Update of the running session
+)
+
+// Wireless simulates a client of a wireless controller: the device
+// associates to the first access point and roams to the next one every
+// RoamInterval. Its RADIUS requests carry the Called-Station-Id, NAS-IP-Address
+// and NAS-Identifier of the AP it is associated to.
+type Wireless struct {
+	Enabled        bool
+	SSID           string        // SSID of the APs that do not set one
+	APs            []AccessPoint // Access points roamed in turn
+	RoamInterval   time.Duration // Time on an AP before roaming, 0 stays on the first
+	RoamAccounting string        // stop_start or interim
+	RoamCause      string        // Acct-Terminate-Cause of the Stop sent on roaming
+
+	mu      sync.Mutex
+	current int // Index of the AP the device is associated to
+}
+
+// AccessPoint is an AP the device can associate to
+type AccessPoint struct {
+	BSSID         net.HardwareAddr
+	SSID          string // Wireless.SSID when empty
+	NASIPAddress  net.IP // Address of the controller or AP, the configured one when nil
+	NASIdentifier string // Name of the AP, the configured one when empty
+}
+
+// AP returns the access point the device is associated to
+func (w *Wireless) AP() AccessPoint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.APs[w.current]
+}
+
+// roam associates the device to the next access point and returns it
+func (w *Wireless) roam() AccessPoint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.current = (w.current + 1) % len(w.APs)
+	return w.APs[w.current]
+}
+
+// calledStationID formats the Called-Station-Id of an AP as controllers
+// do (RFC 3580 3.20): its BSSID then the SSID, e.g. 84-24-8D-D6-8B-64:Corp
+func (w *Wireless) calledStationID(ap AccessPoint) string {
+	ssid := ap.SSID
+	if ssid == "" {
+		ssid = w.SSID
+	}
+	bssid := strings.ToUpper(strings.ReplaceAll(ap.BSSID.String(), ":", "-"))
+	if ssid == "" {
+		return bssid
+	}
+	return bssid + ":" + ssid
+}
+
+// apply sets the attributes of the current AP in a request, replacing the
+// configured ones
+func (w *Wireless) apply(p *radius.Packet) error {
+	ap := w.AP()
+	rfc2865.CalledStationID_SetString(p, w.calledStationID(ap))
+	rfc2865.NASPortType_Set(p, rfc2865.NASPortType_Value_Wireless80211)
+	if ap.NASIPAddress != nil {
+		if err := rfc2865.NASIPAddress_Set(p, ap.NASIPAddress); err != nil {
+			return err
+		}
+	}
+	if ap.NASIdentifier != "" {
+		rfc2865.NASIdentifier_SetString(p, ap.NASIdentifier)
+	}
+	return nil
+}
+
+// accessPointEntry is an entry of the JSON aps list
+type accessPointEntry struct {
+	BSSID         string `json:"bssid"`
+	SSID          string `json:"ssid,omitempty"`
+	NASIPAddress  string `json:"nas_ip_address,omitempty"`
+	NASIdentifier string `json:"nas_identifier,omitempty"`
+}
+
+// parseAccessPoints parses the JSON aps list
+func parseAccessPoints(body string) ([]AccessPoint, error) {
+	var entries []accessPointEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		return nil, fmt.Errorf("invalid aps JSON: %v", err)
+	}
+
+	var aps []AccessPoint
+	for _, entry := range entries {
+		bssid, err := net.ParseMAC(entry.BSSID)
+		if err != nil || len(bssid) != 6 {
+			return nil, fmt.Errorf("invalid BSSID %q", entry.BSSID)
+		}
+		ap := AccessPoint{BSSID: bssid, SSID: entry.SSID, NASIdentifier: entry.NASIdentifier}
+		if entry.NASIPAddress != "" {
+			if ap.NASIPAddress = net.ParseIP(entry.NASIPAddress).To4(); ap.NASIPAddress == nil {
+				return nil, fmt.Errorf("%s: invalid NAS-IP-Address %q", entry.BSSID, entry.NASIPAddress)
+			}
+		}
+		aps = append(aps, ap)
+	}
+	return aps, nil
+}
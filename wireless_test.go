@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+func TestParseAccessPoints(t *testing.T) {
+	aps, err := parseAccessPoints(`[{"bssid": "84:24:8d:d6:8b:64", "nas_ip_address": "10.64.1.31", "nas_identifier": "ap-04"},
+		{"bssid": "84-24-8D-D6-8B-70", "ssid": "Guest"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Wireless{SSID: "Corp", APs: aps}
+	if id := w.calledStationID(aps[0]); id != "84-24-8D-D6-8B-64:Corp" {
+		t.Errorf("Called-Station-Id %q", id)
+	}
+	if id := w.calledStationID(aps[1]); id != "84-24-8D-D6-8B-70:Guest" {
+		t.Errorf("Called-Station-Id %q with the AP SSID", id)
+	}
+
+	// The AP attributes replace the configured ones, which stay when the
+	// AP does not set them
+	p := radius.New(radius.CodeAccessRequest, []byte("secret"))
+	testRadiusAttributes(t, "[authentication]\nCalled-Station-Id = 00-00-00-00-00-01\nNAS-IP-Address = 192.168.0.1\nNAS-Port-Type = Ethernet\n").Apply(p)
+	w.roam()
+	w.apply(p)
+	if rfc2865.CalledStationID_GetString(p) != "84-24-8D-D6-8B-70:Guest" || rfc2865.NASPortType_Get(p) != rfc2865.NASPortType_Value_Wireless80211 {
+		t.Errorf("AP attributes not set: %q %v", rfc2865.CalledStationID_GetString(p), rfc2865.NASPortType_Get(p))
+	}
+	if ip := rfc2865.NASIPAddress_Get(p); !ip.Equal(net.IPv4(192, 168, 0, 1)) {
+		t.Errorf("configured NAS-IP-Address replaced by %v", ip)
+	}
+	if w.roam(); !w.AP().NASIPAddress.Equal(net.IPv4(10, 64, 1, 31)) {
+		t.Error("roaming does not wrap around to the first AP")
+	}
+
+	if _, err := parseAccessPoints(`[{"bssid": "84:24:8d"}]`); err == nil {
+		t.Error("invalid BSSID accepted")
+	}
+}
+
+// accountingRecord is what the test accounting server received
+type accountingRecord struct {
+	status    rfc2866.AcctStatusType
+	sessionID string
+	calledID  string
+	nasIP     net.IP
+	cause     rfc2866.AcctTerminateCause
+}
+
+// TestWirelessRoaming tests the accounting of a roaming client, with a
+// new session on each AP or an Interim-Update with fast roaming
+func TestWirelessRoaming(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("cannot listen: %v", err)
+	}
+	records := make(chan accountingRecord, 10)
+	server := &radius.PacketServer{
+		SecretSource: radius.StaticSecretSource([]byte("secret")),
+		Handler: radius.HandlerFunc(func(w radius.ResponseWriter, r *radius.Request) {
+			records <- accountingRecord{
+				status:    rfc2866.AcctStatusType_Get(r.Packet),
+				sessionID: rfc2866.AcctSessionID_GetString(r.Packet),
+				calledID:  rfc2865.CalledStationID_GetString(r.Packet),
+				nasIP:     rfc2865.NASIPAddress_Get(r.Packet),
+				cause:     rfc2866.AcctTerminateCause_Get(r.Packet),
+			}
+			w.Write(r.Response(radius.CodeAccountingResponse))
+		}),
+	}
+	go server.Serve(conn)
+	defer server.Shutdown(context.Background())
+
+	aps, _ := parseAccessPoints(`[{"bssid": "84:24:8d:d6:8b:64", "nas_ip_address": "10.64.1.31"}, {"bssid": "84:24:8d:d6:8b:70", "nas_ip_address": "10.64.1.32"}]`)
+	w := &Wireless{Enabled: true, SSID: "Corp", APs: aps, RoamAccounting: roamStopStart, RoamCause: "Lost-Carrier"}
+	cfg := &Accounting{
+		Servers: RadiusServers{
+			Servers: []RadiusServer{{Address: conn.LocalAddr().String(), Secret: "secret", Timeout: time.Second}},
+			health:  newRadiusHealth(),
+		},
+		Secret:           "secret",
+		CallingStationId: "90:6c:ac:64:95:c1",
+		InterimInterval:  time.Hour,
+		PacketSize:       500,
+		TerminateCause:   "User-Request",
+		StatusType:       rfc2866.AcctStatusType_Value_Start,
+	}
+	s := NewAccountingSession(cfg, false)
+	s.wireless = w
+	go s.Run(context.Background())
+	defer s.Stop()
+
+	next := func() accountingRecord {
+		t.Helper()
+		select {
+		case r := <-records:
+			return r
+		case <-time.After(2 * time.Second):
+			t.Fatal("no accounting request")
+			return accountingRecord{}
+		}
+	}
+
+	start := next()
+	if start.status != rfc2866.AcctStatusType_Value_Start || start.calledID != "84-24-8D-D6-8B-64:Corp" || !start.nasIP.Equal(aps[0].NASIPAddress) {
+		t.Fatalf("unexpected first request %+v", start)
+	}
+
+	s.Roam()
+	stop := next()
+	if stop.status != rfc2866.AcctStatusType_Value_Stop || stop.sessionID != start.sessionID ||
+		stop.calledID != start.calledID || stop.cause != rfc2866.AcctTerminateCause_Value_LostCarrier {
+		t.Errorf("roaming did not stop the session on the old AP: %+v", stop)
+	}
+	restart := next()
+	if restart.status != rfc2866.AcctStatusType_Value_Start || restart.sessionID == start.sessionID ||
+		restart.calledID != "84-24-8D-D6-8B-70:Corp" || !restart.nasIP.Equal(aps[1].NASIPAddress) {
+		t.Errorf("no new session on the new AP: %+v", restart)
+	}
+
+	w.RoamAccounting = roamInterim
+	s.Roam()
+	interim := next()
+	if interim.status != rfc2866.AcctStatusType_Value_InterimUpdate || interim.sessionID != restart.sessionID ||
+		interim.calledID != start.calledID || !interim.nasIP.Equal(aps[0].NASIPAddress) {
+		t.Errorf("fast roaming did not update the session: %+v", interim)
+	}
+}